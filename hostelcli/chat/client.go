@@ -3,9 +3,14 @@ package chat
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Server defines requirements for chat server.
@@ -13,11 +18,35 @@ type Server interface {
 	io.ReadWriter
 }
 
+// Dialer opens a new connection to chat server.
+type Dialer func() (Server, error)
+
+// Delays between attempts to reconnect grow exponentially
+// from the minimum to the maximum.
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
 // Client allows to interact with chat server.
 type Client struct {
 	srv           Server
 	subscriptions *bytes.Buffer
+	rooms         []string
 	defaultRoom   string
+
+	dial     Dialer
+	minDelay time.Duration
+	maxDelay time.Duration
+	// json is set when client talks JSON protocol to the server
+	// rather than plain text lines.
+	json bool
+
+	// mu guards connection, rooms and messages seen in them,
+	// which are shared with the goroutine reading the server.
+	mu     sync.Mutex
+	oldest map[string]uint64
+	latest map[string]uint64
 }
 
 // NewClient returns a new instance of Client for interaction
@@ -26,27 +55,84 @@ func NewClient(srv Server) *Client {
 	return &Client{
 		srv:           srv,
 		subscriptions: bytes.NewBufferString("subscribe"),
+		minDelay:      minReconnectDelay,
+		maxDelay:      maxReconnectDelay,
+		oldest:        make(map[string]uint64),
+		latest:        make(map[string]uint64),
 	}
 }
 
+// SetDialer lets Client to reconnect using the specified dialer when
+// connection is lost. Client subscribes to its rooms again and asks
+// for messages published since the last one it has seen.
+func (cl *Client) SetDialer(dial Dialer) {
+	cl.dial = dial
+}
+
 // AddSubscription instructs Client to subscribe to the specified room.
 func (cl *Client) AddSubscription(room string, nick string) {
 	cl.subscriptions.WriteString(fmt.Sprintf("|%s:%s", room, nick))
 
+	cl.rooms = append(cl.rooms, room)
 	cl.defaultRoom = room
 }
 
+// leave forgets the specified room. If it was the default room,
+// the most recently joined of remaining rooms becomes default.
+func (cl *Client) leave(room string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for i, r := range cl.rooms {
+		if r == room {
+			cl.rooms = append(cl.rooms[:i], cl.rooms[i+1:]...)
+			break
+		}
+	}
+	if cl.defaultRoom == room {
+		cl.defaultRoom = ""
+		if len(cl.rooms) > 0 {
+			cl.defaultRoom = cl.rooms[len(cl.rooms)-1]
+		}
+	}
+}
+
+// view shows user what happens in chat.
+type view interface {
+	// received is called with every line received from the server.
+	received(ln string)
+	// status tells user about client itself, e.g. its connection.
+	status(text string)
+	// crashed is called with description of panic in receiving
+	// goroutine, and must panic in its turn.
+	crashed(desc string)
+}
+
+// plainView prints chat line by line as it goes.
+type plainView struct {
+	cl  *Client
+	out io.Writer
+}
+
+func (v *plainView) received(ln string) {
+	v.cl.seen(ln)
+	fmt.Fprintln(v.out, render(ln))
+}
+
+func (v *plainView) status(text string) {
+	fmt.Fprintln(v.out, "-!- "+text)
+}
+
+func (v *plainView) crashed(desc string) {
+	panic(desc)
+}
+
 // Run starts chat loop, allowing to interact with the server
 // using the specified terminals streams.
 func (cl *Client) Run(in io.Reader, out io.Writer) {
-	go func() {
-		s := bufio.NewScanner(cl.srv)
-		for s.Scan() {
-			fmt.Fprintln(out, s.Text())
-		}
-	}()
-
-	fmt.Fprintln(cl.srv, cl.subscriptions.String())
+	done := make(chan struct{})
+	defer close(done)
+	v := &plainView{cl: cl, out: out}
+	cl.start(v, done)
 
 	s := bufio.NewScanner(in)
 	for s.Scan() {
@@ -54,14 +140,315 @@ func (cl *Client) Run(in io.Reader, out io.Writer) {
 		if len(ln) == 0 {
 			continue
 		}
-		room := cl.defaultRoom
-		if ln[0] == '/' {
-			i := strings.Index(ln, " ")
-			if i > 0 {
-				room = ln[1:i]
-				ln = ln[i+1:]
+		if !cl.send(cl.request(ln)) {
+			v.status("Not connected, request is not sent.")
+		}
+	}
+}
+
+// start subscribes to rooms and starts receiving from the server
+// until chat loop is done.
+func (cl *Client) start(v view, done <-chan struct{}) {
+	srv := cl.srv
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				v.crashed(fmt.Sprintf("%v\n\n%s", r, debug.Stack()))
 			}
+		}()
+		cl.receive(srv, v, done)
+	}()
+	cl.handshake(srv, cl.subscriptions.String())
+}
+
+// handshake switches new connection to the protocol of client
+// and sends subscribe request, unless it's empty.
+func (cl *Client) handshake(srv Server, subscribe string) error {
+	if cl.json {
+		if _, err := fmt.Fprintln(srv, "proto|json/1"); err != nil {
+			return err
+		}
+	}
+	if subscribe == "" {
+		return nil
+	}
+	_, err := fmt.Fprintln(srv, cl.encode(subscribe))
+	return err
+}
+
+// send sends request to the server. False is returned
+// when there is no connection.
+func (cl *Client) send(req string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.srv == nil {
+		return false
+	}
+	fmt.Fprintln(cl.srv, cl.encode(req))
+	return true
+}
+
+// encode converts "name|arg1|arg2|..." request to JSON protocol
+// when client talks it.
+func (cl *Client) encode(req string) string {
+	if !cl.json {
+		return req
+	}
+	parts := strings.Split(req, "|")
+	b, _ := json.Marshal(struct {
+		Cmd  string   `json:"cmd"`
+		Args []string `json:"args,omitempty"`
+	}{parts[0], parts[1:]})
+	return string(b)
+}
+
+// receive shows lines received from the server until connection
+// is lost. Then it reconnects, if there is a dialer, and goes on
+// until chat loop is done.
+func (cl *Client) receive(srv Server, v view, done <-chan struct{}) {
+	for srv != nil {
+		s := bufio.NewScanner(srv)
+		for s.Scan() {
+			v.received(s.Text())
+		}
+		v.status("Disconnected from server.")
+		if cl.dial == nil {
+			return
+		}
+		cl.mu.Lock()
+		cl.srv = nil
+		cl.mu.Unlock()
+		if c, ok := srv.(io.Closer); ok {
+			c.Close()
+		}
+		srv = cl.reconnect(v, done)
+	}
+}
+
+// reconnect dials the server with exponential backoff until it
+// succeeds or chat loop is done. Subscriptions are restored before
+// user can send anything over the new connection.
+func (cl *Client) reconnect(v view, done <-chan struct{}) Server {
+	for delay := cl.minDelay; ; delay *= 2 {
+		if delay > cl.maxDelay {
+			delay = cl.maxDelay
+		}
+		v.status(fmt.Sprintf("Reconnecting in %v...", delay))
+		select {
+		case <-done:
+			return nil
+		case <-time.After(delay):
+		}
+		srv, err := cl.dial()
+		if err != nil {
+			v.status(fmt.Sprint("Cannot connect: ", err))
+			continue
+		}
+		cl.mu.Lock()
+		req, _ := cl.resubscription()
+		if err = cl.handshake(srv, req); err == nil {
+			cl.srv = srv
 		}
-		fmt.Fprintf(cl.srv, "publish|%s|%s\n", room, ln)
+		cl.mu.Unlock()
+		if err != nil {
+			v.status(fmt.Sprint("Cannot subscribe: ", err))
+			if c, ok := srv.(io.Closer); ok {
+				c.Close()
+			}
+			continue
+		}
+		v.status("Reconnected.")
+		return srv
+	}
+}
+
+// resubscription returns subscribe request for rooms which user
+// hasn't left. Only messages published after the last one seen in
+// a room are requested. IDs are server-wide, so for a room where
+// nothing was seen, messages after the last one seen anywhere are
+// requested. Servers which don't stamp messages with IDs don't know
+// how to do that, but then there is nothing seen to ask after.
+// Caller must hold the lock.
+func (cl *Client) resubscription() (string, bool) {
+	var latest uint64
+	for _, id := range cl.latest {
+		if id > latest {
+			latest = id
+		}
+	}
+	req := "subscribe"
+	for _, sub := range strings.Split(cl.subscriptions.String(), "|")[1:] {
+		room := strings.SplitN(sub, ":", 2)[0]
+		for _, r := range cl.rooms {
+			if r != room {
+				continue
+			}
+			req += "|" + sub
+			id, ok := cl.latest[room]
+			if !ok {
+				id = latest
+			}
+			if id != 0 {
+				req += ":since=" + strconv.FormatUint(id, 10)
+			}
+			break
+		}
+	}
+	if req == "subscribe" {
+		return "", false
+	}
+	return req, true
+}
+
+// argCommands are typed as "/name arg1 arg2 ..." and sent as
+// "name|arg1|arg2|...". The last of the specified number of
+// arguments takes the rest of line.
+var argCommands = map[string]int{
+	"topic":  2,
+	"search": 2,
+	"kick":   3,
+	"ban":    3,
+	"mute":   3,
+}
+
+// request translates line typed by user to server request.
+func (cl *Client) request(ln string) string {
+	if strings.HasPrefix(ln, "/msg ") {
+		nm := strings.SplitN(ln[len("/msg "):], " ", 2)
+		if len(nm) == 1 {
+			return "whisper|" + nm[0]
+		}
+		return fmt.Sprintf("whisper|%s|%s", nm[0], nm[1])
+	}
+	if strings.HasPrefix(ln, "/who ") {
+		return "who|" + strings.TrimSpace(ln[len("/who "):])
+	}
+	for name, n := range argCommands {
+		if strings.HasPrefix(ln, "/"+name+" ") {
+			args := strings.SplitN(strings.TrimSpace(ln[len(name)+2:]), " ", n)
+			if name == "search" && len(args) == n {
+				args = append(args[:1], searchArgs(args[1])...)
+			}
+			return name + "|" + strings.Join(args, "|")
+		}
+	}
+	if strings.HasPrefix(ln, "/history ") {
+		return cl.history(strings.Fields(ln[len("/history "):]))
+	}
+	if strings.HasPrefix(ln, "/leave ") {
+		room := strings.TrimSpace(ln[len("/leave "):])
+		cl.leave(room)
+		return "leave|" + room
+	}
+	room := cl.defaultRoom
+	if ln[0] == '/' {
+		i := strings.Index(ln, " ")
+		if i > 0 {
+			room = ln[1:i]
+			ln = ln[i+1:]
+		}
+	}
+	return fmt.Sprintf("publish|%s|%s", room, ln)
+}
+
+// searchOptions are typed among words of search query,
+// e.g. "/search room nick=bob from=2026-10-01T00:00:00Z deploy".
+var searchOptions = []string{"nick=", "from=", "to=", "limit="}
+
+// searchArgs separates search query from options typed along with it.
+func searchArgs(query string) []string {
+	var words, opts []string
+	for _, w := range strings.Fields(query) {
+		opt := false
+		for _, prefix := range searchOptions {
+			opt = opt || strings.HasPrefix(w, prefix)
+		}
+		if opt {
+			opts = append(opts, w)
+		} else {
+			words = append(words, w)
+		}
+	}
+	return append([]string{strings.Join(words, " ")}, opts...)
+}
+
+// history requests page of room history which precedes the oldest
+// message seen in room, so that repeating it scrolls further back.
+func (cl *Client) history(args []string) string {
+	if len(args) == 0 {
+		return "history|"
+	}
+	req := "history|" + args[0]
+	cl.mu.Lock()
+	if id := cl.oldest[args[0]]; id != 0 {
+		req += "|before=" + strconv.FormatUint(id, 10)
+	}
+	cl.mu.Unlock()
+	if len(args) > 1 {
+		req += "|limit=" + args[1]
+	}
+	return req
+}
+
+// seen keeps track of the oldest and the latest messages received
+// for every room.
+func (cl *Client) seen(ln string) {
+	id, _, rest, ok := parseStamp(ln)
+	if !ok {
+		return
+	}
+	i := strings.Index(rest, ": ")
+	if i < 0 {
+		return
+	}
+	cl.track(rest[strings.LastIndex(rest[:i], "@")+1:i], id)
+}
+
+// track remembers ID of message received in room.
+func (cl *Client) track(room string, id uint64) {
+	cl.mu.Lock()
+	if old := cl.oldest[room]; old == 0 || id < old {
+		cl.oldest[room] = id
+	}
+	if id > cl.latest[room] {
+		cl.latest[room] = id
+	}
+	cl.mu.Unlock()
+}
+
+// render formats line received from the server for terminal. System
+// lines about users joining and leaving rooms are set apart from chat,
+// messages are shown with local time they were published at.
+func render(ln string) string {
+	if strings.HasPrefix(ln, "* ") {
+		return "-!- " + ln[len("* "):]
+	}
+	if strings.HasPrefix(ln, "Found: ") {
+		return "Found: " + render(ln[len("Found: "):])
+	}
+	if _, at, rest, ok := parseStamp(ln); ok {
+		return "[" + at.Local().Format("15:04") + "] " + rest
+	}
+	return ln
+}
+
+// parseStamp splits message line "[id time] nick@room: text" into
+// message ID, time and the rest of line.
+func parseStamp(ln string) (id uint64, at time.Time, rest string, ok bool) {
+	end := strings.Index(ln, "] ")
+	if !strings.HasPrefix(ln, "[") || end < 0 {
+		return 0, time.Time{}, ln, false
+	}
+	stamp := strings.SplitN(ln[1:end], " ", 2)
+	if len(stamp) != 2 {
+		return 0, time.Time{}, ln, false
+	}
+	id, err := strconv.ParseUint(stamp[0], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, ln, false
+	}
+	if at, err = time.Parse(time.RFC3339, stamp[1]); err != nil {
+		return 0, time.Time{}, ln, false
 	}
+	return id, at, ln[end+2:], true
 }
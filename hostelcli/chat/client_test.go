@@ -1,9 +1,14 @@
 package chat
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"io"
+	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -41,6 +46,32 @@ func TestClientAddSubscription_GivenRoomNick_TracksDefaultRoom(t *testing.T) {
 	assert.Equal(t, "room2", cl.defaultRoom)
 }
 
+func TestClientRun_LeaveRoom_LeaveRequestedDefaultRoomUpdated(t *testing.T) {
+	in := &bytes.Buffer{}
+	out := &bytes.Buffer{}
+	srv := &testServer{}
+
+	cl := NewClient(srv)
+	cl.AddSubscription("room1", "nick1")
+	cl.AddSubscription("room2", "nick2")
+	cl.AddSubscription("room3", "nick3")
+
+	in.WriteString("/leave room3\nmsg1\n/leave room1\nmsg2\n/leave room2\n")
+	cl.Run(in, out)
+
+	s := strings.Split(srv.w.String(), "\n")
+	assert.Equal(t, []string{
+		"leave|room3",
+		"publish|room2|msg1",
+		"leave|room1",
+		"publish|room2|msg2",
+		"leave|room2",
+		"",
+	}, s[1:])
+	assert.Empty(t, cl.rooms)
+	assert.Empty(t, cl.defaultRoom)
+}
+
 func TestClientRun_HasSubscriptions_SubscribesToRooms(t *testing.T) {
 	in := &bytes.Buffer{}
 	out := &bytes.Buffer{}
@@ -69,6 +100,42 @@ func TestClientRun_PayloadMessage_PublishedToServer(t *testing.T) {
 		}, {
 			msg:      "msg3", // default room path
 			expected: "publish|room2|msg3",
+		}, {
+			msg:      "/msg nick3 private msg4",
+			expected: "whisper|nick3|private msg4",
+		}, {
+			msg:      "/msg nick3",
+			expected: "whisper|nick3",
+		}, {
+			msg:      "/who room1",
+			expected: "who|room1",
+		}, {
+			msg:      "/topic room1",
+			expected: "topic|room1",
+		}, {
+			msg:      "/topic room1 new topic",
+			expected: "topic|room1|new topic",
+		}, {
+			msg:      "/kick room1 nick3 no spam please",
+			expected: "kick|room1|nick3|no spam please",
+		}, {
+			msg:      "/ban room1 @user1",
+			expected: "ban|room1|@user1",
+		}, {
+			msg:      "/mute room1 nick3 10m",
+			expected: "mute|room1|nick3|10m",
+		}, {
+			msg:      "/search room1 deploy failed",
+			expected: "search|room1|deploy failed",
+		}, {
+			msg:      "/search room1 nick=nick3 deploy limit=5 failed",
+			expected: "search|room1|deploy failed|nick=nick3|limit=5",
+		}, {
+			msg:      "/history room1",
+			expected: "history|room1",
+		}, {
+			msg:      "/history room1 20",
+			expected: "history|room1|limit=20",
 		},
 	}
 
@@ -90,6 +157,79 @@ func TestClientRun_PayloadMessage_PublishedToServer(t *testing.T) {
 	}
 }
 
+func TestClientHistory_MessagesSeen_PagesBeforeOldest(t *testing.T) {
+	cl := NewClient(nil)
+	cl.AddSubscription("room1", "nick1")
+
+	cl.seen("[42 2026-10-17T07:05:09Z] nick1@room1: msg1")
+	cl.seen("[40 2026-10-17T07:05:08Z] nick@2@room1: msg2")
+	cl.seen("[45 2026-10-17T07:05:10Z] nick1@room1: msg3")
+	cl.seen("[30 2026-10-17T07:05:07Z] nick1@room2: msg4")
+
+	assert.Equal(t, "history|room1|before=40|limit=20", cl.request("/history room1 20"))
+	assert.Equal(t, "history|room2|before=30", cl.request("/history room2"))
+	assert.Equal(t, "history|room3", cl.request("/history room3"))
+}
+
+func TestClientResubscription_MessagesSeen_SinceLatestSeen(t *testing.T) {
+	cl := NewClient(nil)
+	cl.AddSubscription("room1", "nick1")
+	cl.AddSubscription("room2", "nick2")
+	cl.AddSubscription("room3", "nick3")
+
+	cl.seen("[42 2026-10-17T07:05:09Z] nick1@room1: msg1")
+	cl.seen("[40 2026-10-17T07:05:08Z] nick2@room1: msg2")
+	cl.seen("[43 2026-10-17T07:05:10Z] nick1@room3: msg3")
+	cl.leave("room3")
+
+	req, ok := cl.resubscription()
+	assert.True(t, ok)
+	assert.Equal(t, "subscribe|room1:nick1:since=42|room2:nick2:since=43", req)
+
+	cl.leave("room1")
+	cl.leave("room2")
+	_, ok = cl.resubscription()
+	assert.False(t, ok)
+}
+
+func TestClientRun_ConnectionLost_ReconnectsAndResubscribes(t *testing.T) {
+	in, input := io.Pipe()
+	out := &bytes.Buffer{}
+	srv1 := &testServer{}
+	srv1.r.WriteString("[42 2026-10-17T07:05:09Z] nick2@room1: msg1\n")
+	conn, srv2 := net.Pipe()
+	defer srv2.Close()
+	attempts := 0
+
+	cl := NewClient(srv1)
+	cl.minDelay, cl.maxDelay = time.Millisecond, 2*time.Millisecond
+	cl.AddSubscription("room1", "nick1")
+	cl.SetDialer(func() (Server, error) {
+		if attempts++; attempts < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return conn, nil
+	})
+	ran := make(chan struct{})
+	go func() {
+		cl.Run(in, out)
+		close(ran)
+	}()
+
+	r := bufio.NewReader(srv2)
+	ln, err := r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "subscribe|room1:nick1:since=42\n", ln)
+
+	input.Write([]byte("msg2\n"))
+	ln, _ = r.ReadString('\n')
+	assert.Equal(t, "publish|room1|msg2\n", ln)
+
+	input.Close()
+	<-ran
+	assert.Equal(t, 3, attempts)
+}
+
 func TestClientRun_EmptyMessage_NotPublishedToServer(t *testing.T) {
 	in := &bytes.Buffer{}
 	out := &bytes.Buffer{}
@@ -105,3 +245,17 @@ func TestClientRun_EmptyMessage_NotPublishedToServer(t *testing.T) {
 	s := strings.Split(srv.w.String(), "\n")
 	assert.Len(t, s, 2)
 }
+
+func TestRender_PresenceLine_RenderedAsSystemLine(t *testing.T) {
+	assert.Equal(t, "-!- nick1 joined room1.", render("* nick1 joined room1."))
+	assert.Equal(t, "nick1@room1: * msg1", render("nick1@room1: * msg1"))
+}
+
+func TestRender_StampedMessage_LocalTimeShown(t *testing.T) {
+	at := time.Date(2026, 10, 17, 7, 5, 9, 0, time.UTC)
+	expected := "[" + at.Local().Format("15:04") + "] nick1@room1: msg1"
+
+	assert.Equal(t, expected, render("[42 2026-10-17T07:05:09Z] nick1@room1: msg1"))
+	assert.Equal(t, "[x] nick1@room1: msg1", render("[x] nick1@room1: msg1"))
+	assert.Equal(t, "Found: "+expected, render("Found: [42 2026-10-17T07:05:09Z] nick1@room1: msg1"))
+}
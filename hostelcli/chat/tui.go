@@ -0,0 +1,684 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Terminal is a terminal in raw mode, where full-screen UI runs.
+type Terminal interface {
+	io.ReadWriter
+	// Size returns number of columns and rows of terminal.
+	Size() (width int, height int)
+}
+
+// Limits of what UI keeps in memory.
+const (
+	maxScrollback = 1000
+	maxInputLines = 100
+)
+
+// event is a reply of the server in JSON protocol.
+type event struct {
+	Type  string `json:"type"`
+	Code  string `json:"code"`
+	Room  string `json:"room"`
+	Nick  string `json:"nick"`
+	Text  string `json:"text"`
+	MsgID uint64 `json:"msgId"`
+	Time  string `json:"time"`
+}
+
+// tuiView passes chat to the loop of full-screen UI.
+type tuiView struct {
+	cl      *Client
+	events  chan event
+	crashes chan string
+	done    <-chan struct{}
+}
+
+func (v *tuiView) received(ln string) {
+	var ev event
+	if err := json.Unmarshal([]byte(ln), &ev); err != nil || ev.Type == "" {
+		// Not a JSON event, e.g. reply to switching protocol.
+		ev = event{Type: "status", Text: ln}
+	}
+	if ev.Type == "message" || ev.Type == "history" {
+		v.cl.track(ev.Room, ev.MsgID)
+	}
+	v.push(ev)
+}
+
+func (v *tuiView) status(text string) {
+	v.push(event{Type: "status", Text: text})
+}
+
+func (v *tuiView) push(ev event) {
+	select {
+	case v.events <- ev:
+	case <-v.done:
+	}
+}
+
+// crashed hands panic over to chat loop, so that it leaves
+// full-screen mode before program crashes.
+func (v *tuiView) crashed(desc string) {
+	select {
+	case v.crashes <- desc:
+	case <-v.done:
+		panic(desc)
+	}
+}
+
+// RunTUI starts chat loop with full-screen UI in the specified terminal.
+// Every room has its own pane, which keeps scrollback of the room and
+// counts messages received while the pane wasn't shown. The loop ends
+// when user quits with Ctrl-C, Ctrl-D or "/quit", or when process gets
+// SIGINT, SIGTERM, SIGHUP or SIGQUIT, so that terminal is restored.
+func (cl *Client) RunTUI(term Terminal) {
+	cl.json = true
+	scr := newScreen(cl.rooms)
+	done := make(chan struct{})
+	defer close(done)
+	signals := make(chan os.Signal, 1)
+	// Raw terminal doesn't turn Ctrl-C to SIGINT, but it may be sent
+	// by other processes as well as SIGQUIT.
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+	v := &tuiView{cl: cl, events: make(chan event, 64), crashes: make(chan string), done: done}
+	cl.start(v, done)
+	keys := make(chan []byte)
+	go readKeys(term, keys, done)
+
+	io.WriteString(term, "\x1b[?1049h\x1b[2J")
+	defer io.WriteString(term, "\x1b[2J\x1b[?1049l")
+	// Terminals don't tell about resizing without signals,
+	// so size is checked now and then.
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		scr.draw(term)
+		select {
+		case ev := <-v.events:
+			scr.add(ev)
+		case desc := <-v.crashes:
+			panic(desc)
+		case <-signals:
+			return
+		case <-tick.C:
+		case b, ok := <-keys:
+			if !ok {
+				return
+			}
+			for _, k := range parseKeys(b) {
+				ln, quit := scr.key(k)
+				if quit || ln == "/quit" {
+					return
+				}
+				if ln != "" {
+					cl.submit(scr, ln)
+				}
+			}
+		}
+	}
+}
+
+// submit sends line typed by user in the current pane.
+func (cl *Client) submit(scr *screen, ln string) {
+	p := scr.panes[scr.current]
+	if scr.current == 0 && ln[0] != '/' {
+		p.add("-!- Switch to a room to chat there.", false)
+		return
+	}
+	cl.defaultRoom = p.name
+	req := cl.request(ln)
+	if !cl.send(req) {
+		p.add("-!- Not connected, request is not sent.", false)
+		return
+	}
+	// Server doesn't echo messages to their sender.
+	args := strings.SplitN(req, "|", 3)
+	switch {
+	case args[0] == "leave" && len(args) == 2:
+		scr.remove(args[1])
+	case args[0] == "publish" && len(args) == 3:
+		scr.pane(args[1]).add(time.Now().Format("[15:04] ")+"<"+cl.nick(args[1])+"> "+args[2], false)
+	case args[0] == "whisper" && len(args) == 3:
+		p.add("-> "+args[1]+": "+args[2], false)
+	}
+}
+
+// nick returns nick which user has in room.
+func (cl *Client) nick(room string) string {
+	for _, sub := range strings.Split(cl.subscriptions.String(), "|")[1:] {
+		if rn := strings.SplitN(sub, ":", 2); rn[0] == room && len(rn) == 2 {
+			return rn[1]
+		}
+	}
+	return ""
+}
+
+// readKeys passes input of terminal to the channel, which is closed
+// when terminal can't be read anymore.
+func readKeys(term Terminal, keys chan<- []byte, done <-chan struct{}) {
+	defer close(keys)
+	buf := make([]byte, 256)
+	for {
+		n, err := term.Read(buf)
+		if n > 0 {
+			b := make([]byte, n)
+			copy(b, buf)
+			select {
+			case keys <- b:
+			case <-done:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+type keyCode int
+
+const (
+	keyRune keyCode = iota
+	keyEnter
+	keyBackspace
+	keyDelete
+	keyLeft
+	keyRight
+	keyUp
+	keyDown
+	keyHome
+	keyEnd
+	keyPageUp
+	keyPageDown
+	keyNextPane
+	keyPrevPane
+	keyPane // Alt with digit
+	keyKillLine
+	keyKillWord
+	keyRedraw
+	keyInterrupt
+	keyEOF
+	keyUnknown
+)
+
+type key struct {
+	code keyCode
+	r    rune
+}
+
+// escapeKeys map the final byte of "ESC [ ..." and "ESC O ..."
+// sequences or parameter of "ESC [ n ~" ones to keys.
+var (
+	escapeKeys = map[byte]keyCode{
+		'A': keyUp, 'B': keyDown, 'C': keyRight, 'D': keyLeft,
+		'H': keyHome, 'F': keyEnd, 'Z': keyPrevPane,
+	}
+	tildeKeys = map[string]keyCode{
+		"1": keyHome, "7": keyHome, "4": keyEnd, "8": keyEnd,
+		"3": keyDelete, "5": keyPageUp, "6": keyPageDown,
+	}
+	controlKeys = map[byte]keyCode{
+		'\r': keyEnter, '\n': keyEnter, 0x7f: keyBackspace, 0x08: keyBackspace,
+		'\t': keyNextPane, 0x01: keyHome, 0x05: keyEnd, 0x02: keyLeft, 0x06: keyRight,
+		0x0e: keyNextPane, 0x10: keyPrevPane, 0x15: keyKillLine, 0x17: keyKillWord,
+		0x0c: keyRedraw, 0x03: keyInterrupt, 0x04: keyEOF,
+	}
+)
+
+// parseKeys decodes keys from terminal input.
+func parseKeys(b []byte) []key {
+	var keys []key
+	for len(b) > 0 {
+		switch {
+		case b[0] == 0x1b && len(b) > 2 && (b[1] == '[' || b[1] == 'O'):
+			i := 2
+			for i < len(b) && (b[i] >= '0' && b[i] <= '9' || b[i] == ';') {
+				i++
+			}
+			if i == len(b) {
+				return append(keys, key{code: keyUnknown})
+			}
+			code, ok := escapeKeys[b[i]]
+			if b[i] == '~' {
+				code, ok = tildeKeys[strings.SplitN(string(b[2:i]), ";", 2)[0]]
+			}
+			if !ok {
+				code = keyUnknown
+			}
+			keys = append(keys, key{code: code})
+			b = b[i+1:]
+		case b[0] == 0x1b && len(b) > 1 && b[1] >= '1' && b[1] <= '9':
+			keys = append(keys, key{code: keyPane, r: rune(b[1])})
+			b = b[2:]
+		case b[0] < 0x20 || b[0] == 0x7f:
+			code, ok := controlKeys[b[0]]
+			if !ok {
+				code = keyUnknown
+			}
+			// Terminals may send CR LF for Enter.
+			if b[0] == '\r' && len(b) > 1 && b[1] == '\n' {
+				b = b[1:]
+			}
+			keys = append(keys, key{code: code})
+			b = b[1:]
+		default:
+			r, n := utf8.DecodeRune(b)
+			if r != utf8.RuneError {
+				keys = append(keys, key{code: keyRune, r: r})
+			}
+			b = b[n:]
+		}
+	}
+	return keys
+}
+
+// pane keeps scrollback of room. The first pane of screen is
+// a status one, it shows private messages.
+type pane struct {
+	name   string
+	topic  string
+	lines  []string
+	unread int
+	// scroll is number of rows scrolled back from the bottom.
+	scroll int
+}
+
+// add appends line to scrollback. Unread lines are
+// counted until pane is shown.
+func (p *pane) add(ln string, unread bool) {
+	p.lines = append(p.lines, ln)
+	if len(p.lines) > maxScrollback {
+		p.lines = p.lines[len(p.lines)-maxScrollback:]
+	}
+	if unread {
+		p.unread++
+	}
+}
+
+// screen is the state of full-screen UI.
+type screen struct {
+	panes   []*pane
+	current int
+
+	input  []rune
+	cursor int
+	// Lines entered before, position in them and
+	// the line being edited while browsing them.
+	entered []string
+	pos     int
+	draft   []rune
+
+	width  int
+	height int
+	frame  string
+}
+
+func newScreen(rooms []string) *screen {
+	scr := &screen{panes: []*pane{{name: "status"}}}
+	for _, room := range rooms {
+		scr.pane(room)
+	}
+	if len(scr.panes) > 1 {
+		scr.current = len(scr.panes) - 1
+	}
+	return scr
+}
+
+// pane returns pane of room, which is added if it doesn't exist.
+func (scr *screen) pane(room string) *pane {
+	for _, p := range scr.panes[1:] {
+		if p.name == room {
+			return p
+		}
+	}
+	p := &pane{name: room}
+	scr.panes = append(scr.panes, p)
+	return p
+}
+
+func (scr *screen) remove(room string) {
+	for i, p := range scr.panes[1:] {
+		if p.name == room {
+			scr.panes = append(scr.panes[:i+1], scr.panes[i+2:]...)
+			if scr.current > i+1 || scr.current == len(scr.panes) {
+				scr.current--
+			}
+			return
+		}
+	}
+}
+
+func (scr *screen) show(i int) {
+	if i >= 0 && i < len(scr.panes) {
+		scr.current = i
+		scr.panes[i].unread = 0
+	}
+}
+
+// add puts event to the pane it belongs to. Replies which don't
+// belong to a room go to the current pane, as they follow what
+// user does there, and so does state of client.
+func (scr *screen) add(ev event) {
+	stamp := ""
+	if at, err := time.Parse(time.RFC3339, ev.Time); err == nil {
+		stamp = "[" + at.Local().Format("15:04") + "] "
+	}
+	p := scr.panes[scr.current]
+	if ev.Room != "" {
+		p = scr.pane(ev.Room)
+	}
+	var ln string
+	switch ev.Type {
+	case "message", "history":
+		ln = stamp + "<" + ev.Nick + "> " + ev.Text
+	case "result":
+		ln = "Found: " + stamp + "<" + ev.Nick + "> " + ev.Text
+	case "private":
+		p = scr.panes[0]
+		ln = "<" + ev.Nick + "> (private) " + ev.Text
+	case "topic":
+		p.topic = ev.Text
+		switch {
+		case ev.Nick != "":
+			ln = "-!- " + ev.Nick + " set topic: " + ev.Text
+		case ev.Text == "":
+			ln = "-!- No topic is set."
+		default:
+			ln = "-!- Topic: " + ev.Text
+		}
+	case "kicked":
+		ln = "-!- You were kicked by " + ev.Nick + "."
+		if ev.Text != "" {
+			ln = "-!- You were kicked by " + ev.Nick + ": " + ev.Text
+		}
+	case "error":
+		ln = "-!- Error: " + ev.Text
+	case "ack":
+		return
+	default:
+		ln = "-!- " + ev.Text
+	}
+	live := ev.Type == "message" || ev.Type == "private"
+	p.add(ln, live && p != scr.panes[scr.current])
+}
+
+// key handles key pressed by user. Line is returned when user enters
+// it, and quit is set when user wants to leave.
+func (scr *screen) key(k key) (ln string, quit bool) {
+	switch k.code {
+	case keyRune:
+		scr.input = append(scr.input[:scr.cursor], append([]rune{k.r}, scr.input[scr.cursor:]...)...)
+		scr.cursor++
+	case keyEnter:
+		ln = strings.TrimSpace(string(scr.input))
+		if ln != "" && (len(scr.entered) == 0 || scr.entered[len(scr.entered)-1] != ln) {
+			scr.entered = append(scr.entered, ln)
+			if len(scr.entered) > maxInputLines {
+				scr.entered = scr.entered[1:]
+			}
+		}
+		scr.pos = len(scr.entered)
+		scr.input, scr.cursor = nil, 0
+	case keyBackspace:
+		if scr.cursor > 0 {
+			scr.input = append(scr.input[:scr.cursor-1], scr.input[scr.cursor:]...)
+			scr.cursor--
+		}
+	case keyDelete:
+		if scr.cursor < len(scr.input) {
+			scr.input = append(scr.input[:scr.cursor], scr.input[scr.cursor+1:]...)
+		}
+	case keyLeft:
+		if scr.cursor > 0 {
+			scr.cursor--
+		}
+	case keyRight:
+		if scr.cursor < len(scr.input) {
+			scr.cursor++
+		}
+	case keyHome:
+		scr.cursor = 0
+	case keyEnd:
+		scr.cursor = len(scr.input)
+	case keyKillLine:
+		scr.input, scr.cursor = scr.input[scr.cursor:], 0
+	case keyKillWord:
+		i := scr.cursor
+		for i > 0 && scr.input[i-1] == ' ' {
+			i--
+		}
+		for i > 0 && scr.input[i-1] != ' ' {
+			i--
+		}
+		scr.input = append(scr.input[:i], scr.input[scr.cursor:]...)
+		scr.cursor = i
+	case keyUp:
+		if scr.pos > 0 {
+			if scr.pos == len(scr.entered) {
+				scr.draft = scr.input
+			}
+			scr.pos--
+			scr.input = []rune(scr.entered[scr.pos])
+			scr.cursor = len(scr.input)
+		}
+	case keyDown:
+		if scr.pos < len(scr.entered) {
+			scr.pos++
+			scr.input = scr.draft
+			if scr.pos < len(scr.entered) {
+				scr.input = []rune(scr.entered[scr.pos])
+			}
+			scr.cursor = len(scr.input)
+		}
+	case keyPageUp:
+		scr.panes[scr.current].scroll += scr.height / 2
+	case keyPageDown:
+		p := scr.panes[scr.current]
+		if p.scroll -= scr.height / 2; p.scroll < 0 {
+			p.scroll = 0
+		}
+	case keyNextPane:
+		scr.show((scr.current + 1) % len(scr.panes))
+	case keyPrevPane:
+		scr.show((scr.current + len(scr.panes) - 1) % len(scr.panes))
+	case keyPane:
+		scr.show(int(k.r - '1'))
+	case keyRedraw:
+		scr.frame = ""
+	case keyInterrupt:
+		quit = true
+	case keyEOF:
+		if len(scr.input) == 0 {
+			quit = true
+		} else if scr.cursor < len(scr.input) {
+			scr.input = append(scr.input[:scr.cursor], scr.input[scr.cursor+1:]...)
+		}
+	}
+	return ln, quit
+}
+
+// draw renders screen to terminal, unless nothing has changed.
+// The top line shows topic of the current room, the room list with
+// unread counters is on the left, scrollback of the current room is
+// on the right, and the input line is at the bottom.
+func (scr *screen) draw(term Terminal) {
+	scr.width, scr.height = term.Size()
+	var b bytes.Buffer
+	b.WriteString("\x1b[?25l\x1b[H")
+	w, h := scr.width, scr.height
+	if w < 20 || h < 3 {
+		b.WriteString("\x1b[2J")
+		b.WriteString(fit("Terminal is too small.", w))
+		scr.flush(term, b.String())
+		return
+	}
+	p := scr.panes[scr.current]
+	title := " " + p.name
+	if p.topic != "" {
+		title += ": " + p.topic
+	}
+	if p.scroll > 0 {
+		title += " [scrolled back]"
+	}
+	b.WriteString("\x1b[7m" + fit(title, w) + "\x1b[0m")
+
+	listWidth := w / 5
+	if listWidth > 20 {
+		listWidth = 20
+	}
+	rows := scr.rows(p, w-listWidth-1, h-2)
+	for i := 0; i < h-2; i++ {
+		fmt.Fprintf(&b, "\x1b[%d;1H", i+2)
+		if i < len(scr.panes) {
+			item := scr.panes[i]
+			name := fmt.Sprintf("%d %s", i+1, item.name)
+			if item.unread > 0 {
+				name += fmt.Sprintf(" (%d)", item.unread)
+			}
+			if i == scr.current {
+				b.WriteString("\x1b[7m" + fit(name, listWidth) + "\x1b[0m")
+			} else {
+				b.WriteString(fit(name, listWidth))
+			}
+		} else {
+			b.WriteString(fit("", listWidth))
+		}
+		b.WriteString("|")
+		if i < len(rows) {
+			b.WriteString(fit(rows[i], w-listWidth-1))
+		} else {
+			b.WriteString(fit("", w-listWidth-1))
+		}
+	}
+
+	prompt := "[" + p.name + "] "
+	if textWidth([]rune(prompt)) > w/2 {
+		prompt = "> "
+	}
+	// Input is scrolled horizontally, so that cursor is always visible.
+	space := w - textWidth([]rune(prompt)) - 1
+	start := 0
+	for textWidth(scr.input[start:scr.cursor]) > space {
+		start++
+	}
+	// Writing the last cell of screen may scroll it.
+	fmt.Fprintf(&b, "\x1b[%d;1H", h)
+	b.WriteString(fit(prompt+string(scr.input[start:]), w-1))
+	col := textWidth([]rune(prompt)) + textWidth(scr.input[start:scr.cursor]) + 1
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", h, col)
+	scr.flush(term, b.String())
+}
+
+// flush writes frame to terminal unless it's the same as the last one.
+func (scr *screen) flush(term Terminal, frame string) {
+	if frame != scr.frame {
+		io.WriteString(term, frame)
+		scr.frame = frame
+	}
+}
+
+// rows returns at most height rows of pane scrollback, with lines
+// wrapped to width. Scrolling is limited to the first line.
+func (scr *screen) rows(p *pane, width int, height int) []string {
+	var rows []string
+	for _, ln := range p.lines {
+		rows = append(rows, wrap(ln, width)...)
+	}
+	if max := len(rows) - height; p.scroll > max {
+		p.scroll = max
+	}
+	if p.scroll < 0 {
+		p.scroll = 0
+	}
+	end := len(rows) - p.scroll
+	if end > height {
+		return rows[end-height : end]
+	}
+	return rows[:end]
+}
+
+// wrap splits line to rows of width columns.
+func wrap(ln string, width int) []string {
+	rows := []string{}
+	var row []rune
+	used := 0
+	for _, c := range ln {
+		if w := runeWidth(c); used+w > width && len(row) > 0 {
+			rows = append(rows, string(row))
+			row, used = nil, 0
+		}
+		row = append(row, c)
+		used += runeWidth(c)
+	}
+	return append(rows, string(row))
+}
+
+// fit truncates or pads string to exactly width columns. Control
+// and format characters are replaced, so they can't break screen
+// or be taken by terminal for escape sequences.
+func fit(s string, width int) string {
+	var b strings.Builder
+	used := 0
+	for _, c := range s {
+		if unicode.IsControl(c) || unicode.Is(unicode.Cf, c) {
+			c = '?'
+		}
+		w := runeWidth(c)
+		if used+w > width {
+			break
+		}
+		b.WriteRune(c)
+		used += w
+	}
+	return b.String() + strings.Repeat(" ", width-used)
+}
+
+// textWidth returns number of columns text takes in terminal.
+func textWidth(r []rune) int {
+	n := 0
+	for _, c := range r {
+		n += runeWidth(c)
+	}
+	return n
+}
+
+// runeWidth returns number of columns character takes in terminal:
+// none for combining marks, two for wide East Asian characters and
+// emoji, and one for others. Control and format characters are
+// shown as one replacement character.
+func runeWidth(c rune) int {
+	switch {
+	case unicode.IsControl(c) || unicode.Is(unicode.Cf, c):
+		return 1
+	case unicode.In(c, unicode.Mn, unicode.Me):
+		return 0
+	}
+	for _, r := range wideRanges {
+		if c >= r[0] && c <= r[1] {
+			return 2
+		}
+	}
+	return 1
+}
+
+// wideRanges are ranges of characters which take two columns: Hangul,
+// CJK, fullwidth forms, emoji and CJK extensions.
+var wideRanges = [][2]rune{
+	{0x1100, 0x115f}, {0x2e80, 0x303e}, {0x3040, 0xa4cf}, {0xac00, 0xd7a3},
+	{0xf900, 0xfaff}, {0xfe30, 0xfe4f}, {0xff00, 0xff60}, {0xffe0, 0xffe6},
+	{0x1f300, 0x1f64f}, {0x1f900, 0x1f9ff}, {0x20000, 0x3fffd},
+}
@@ -0,0 +1,227 @@
+package chat
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testTerminal struct {
+	in  *bytes.Buffer
+	out bytes.Buffer
+}
+
+func (term *testTerminal) Read(p []byte) (n int, err error) {
+	return term.in.Read(p)
+}
+
+func (term *testTerminal) Write(p []byte) (n int, err error) {
+	return term.out.Write(p)
+}
+
+func (term *testTerminal) Size() (int, int) {
+	return 60, 10
+}
+
+func TestParseKeys_GivenInput_KeysDecoded(t *testing.T) {
+	keys := parseKeys([]byte("aé\x1b[A\x1bOH\x1b[3~\x1b[5;2~\x1b2\r\n\x7f\x1b[Z\x1b[1;5X\x1b[1"))
+
+	assert.Equal(t, []key{
+		{code: keyRune, r: 'a'},
+		{code: keyRune, r: 'é'},
+		{code: keyUp},
+		{code: keyHome},
+		{code: keyDelete},
+		{code: keyPageUp},
+		{code: keyPane, r: '2'},
+		{code: keyEnter},
+		{code: keyBackspace},
+		{code: keyPrevPane},
+		{code: keyUnknown},
+		{code: keyUnknown},
+	}, keys)
+}
+
+func TestScreenKey_Editing_InputChanged(t *testing.T) {
+	scr := newScreen(nil)
+	typeKeys := func(s string) string {
+		var ln string
+		for _, k := range parseKeys([]byte(s)) {
+			if entered, _ := scr.key(k); entered != "" {
+				ln = entered
+			}
+		}
+		return ln
+	}
+
+	typeKeys("helo world\x01\x06\x06\x06l")
+	assert.Equal(t, "hello world", string(scr.input))
+	typeKeys("\x05\x17")
+	assert.Equal(t, "hello ", string(scr.input))
+	typeKeys("\x02\x02\x04\x1b[3~")
+	assert.Equal(t, "hell", string(scr.input))
+	typeKeys("\x02\x7f\x15")
+	assert.Equal(t, "l", string(scr.input))
+	assert.Equal(t, "x l", typeKeys("x \r"))
+	assert.Empty(t, scr.input)
+	assert.Equal(t, 0, scr.cursor)
+}
+
+func TestScreenKey_UpDown_EnteredLinesBrowsed(t *testing.T) {
+	scr := newScreen(nil)
+	for _, k := range parseKeys([]byte("one\rtwo\rtwo\rdraft")) {
+		scr.key(k)
+	}
+
+	for _, expected := range []string{"two", "one", "one"} {
+		scr.key(key{code: keyUp})
+		assert.Equal(t, expected, string(scr.input))
+	}
+	scr.key(key{code: keyDown})
+	assert.Equal(t, "two", string(scr.input))
+	scr.key(key{code: keyDown})
+	assert.Equal(t, "draft", string(scr.input))
+	assert.Equal(t, 5, scr.cursor)
+}
+
+func TestScreenKey_QuitKeys_QuitReported(t *testing.T) {
+	scr := newScreen(nil)
+
+	_, quit := scr.key(key{code: keyInterrupt})
+	assert.True(t, quit)
+
+	scr.key(key{code: keyRune, r: 'a'})
+	_, quit = scr.key(key{code: keyEOF})
+	assert.False(t, quit)
+	_, quit = scr.key(key{code: keyEOF})
+	assert.False(t, quit)
+	scr.key(key{code: keyBackspace})
+	_, quit = scr.key(key{code: keyEOF})
+	assert.True(t, quit)
+}
+
+func TestScreenAdd_GivenEvents_RoutedToPanesUnreadCounted(t *testing.T) {
+	scr := newScreen([]string{"room1", "room2"})
+
+	scr.add(event{Type: "message", Room: "room1", Nick: "nick1", Text: "msg1"})
+	scr.add(event{Type: "history", Room: "room1", Nick: "nick1", Text: "msg2"})
+	scr.add(event{Type: "presence", Room: "room1", Text: "nick2 joined room1."})
+	scr.add(event{Type: "message", Room: "room2", Nick: "nick1", Text: "msg3"})
+	scr.add(event{Type: "topic", Room: "room2", Nick: "nick1", Text: "topic1"})
+	scr.add(event{Type: "private", Nick: "nick3", Text: "msg4"})
+	scr.add(event{Type: "error", Text: "Unknown room: room3."})
+	scr.add(event{Type: "ack"})
+	scr.add(event{Type: "status", Text: "Disconnected from server."})
+
+	status, room1, room2 := scr.panes[0], scr.panes[1], scr.panes[2]
+	assert.Equal(t, []string{"<nick3> (private) msg4"}, status.lines)
+	assert.Equal(t, []string{"<nick1> msg1", "<nick1> msg2", "-!- nick2 joined room1."}, room1.lines)
+	assert.Equal(t, []string{"<nick1> msg3", "-!- nick1 set topic: topic1",
+		"-!- Error: Unknown room: room3.", "-!- Disconnected from server."}, room2.lines)
+	assert.Equal(t, "topic1", room2.topic)
+	assert.Equal(t, []int{1, 1, 0}, []int{status.unread, room1.unread, room2.unread})
+
+	scr.key(key{code: keyPane, r: '2'})
+	assert.Equal(t, 1, scr.current)
+	assert.Equal(t, 0, room1.unread)
+}
+
+func TestScreenRemove_CurrentPane_NeighbourShown(t *testing.T) {
+	scr := newScreen([]string{"room1", "room2", "room3"})
+
+	scr.remove("room3")
+	assert.Equal(t, "room2", scr.panes[scr.current].name)
+	scr.key(key{code: keyPrevPane})
+	scr.remove("room2")
+	assert.Equal(t, "room1", scr.panes[scr.current].name)
+	assert.Len(t, scr.panes, 2)
+}
+
+func TestScreenDraw_GivenPanes_ListScrollbackInputDrawn(t *testing.T) {
+	term := &testTerminal{}
+	scr := newScreen([]string{"room1", "room2"})
+	for i := 0; i < 20; i++ {
+		scr.add(event{Type: "message", Room: "room2", Nick: "nick1", Text: strings.Repeat("x", i)})
+	}
+	scr.add(event{Type: "message", Room: "room1", Nick: "nick1", Text: "msg1"})
+	scr.add(event{Type: "topic", Room: "room2", Text: "topic1"})
+	scr.key(key{code: keyRune, r: 'h'})
+
+	scr.draw(term)
+	frame := term.out.String()
+	assert.Contains(t, frame, " room2: topic1")
+	assert.Contains(t, frame, "2 room1 (1)")
+	assert.Contains(t, frame, "-!- Topic: topic1")
+	assert.NotContains(t, frame, "<nick1> xxxx\x1b")
+	assert.Contains(t, frame, "[room2] h")
+	assert.True(t, strings.HasSuffix(frame, "\x1b[10;10H\x1b[?25h"))
+
+	term.out.Reset()
+	scr.draw(term)
+	assert.Empty(t, term.out.String())
+
+	scr.key(key{code: keyPageUp})
+	scr.draw(term)
+	assert.Contains(t, term.out.String(), "[scrolled back]")
+}
+
+func TestClientRunTUI_LineEntered_PublishedOverJSON(t *testing.T) {
+	term := &testTerminal{in: bytes.NewBufferString("msg1\r\x1b1/who room1\rmsg2\r\x03")}
+	srv := &testServer{}
+
+	cl := NewClient(srv)
+	cl.AddSubscription("room1", "nick1")
+	cl.RunTUI(term)
+
+	assert.Equal(t, strings.Join([]string{
+		"proto|json/1",
+		`{"cmd":"subscribe","args":["room1:nick1"]}`,
+		`{"cmd":"publish","args":["room1","msg1"]}`,
+		`{"cmd":"who","args":["room1"]}`,
+		"",
+	}, "\n"), srv.w.String())
+	assert.True(t, strings.HasSuffix(term.out.String(), "\x1b[?1049l"))
+}
+
+func TestFit_ControlsAndWideRunes_ColumnsKept(t *testing.T) {
+	assert.Equal(t, "a?[31mb  ", fit("a\x1b[31mb", 9))
+	assert.Equal(t, "a?31mb", fit("a\u009b31mb", 6))
+	assert.Equal(t, "?abc", fit("\u202eabc", 4))
+	assert.Equal(t, "日本 ", fit("日本語", 5))
+	assert.Equal(t, "éx ", fit("éx", 3))
+}
+
+func TestWrap_WideRunes_SplitByColumns(t *testing.T) {
+	assert.Equal(t, []string{"日本", "語a"}, wrap("日本語a", 4))
+	assert.Equal(t, []string{"abc", "d"}, wrap("abcd", 3))
+}
+
+type idleTerminal struct {
+	testTerminal
+	quit chan struct{}
+}
+
+func (term *idleTerminal) Read(p []byte) (n int, err error) {
+	<-term.quit
+	return 0, io.EOF
+}
+
+type brokenServer struct {
+	testServer
+}
+
+func (srv *brokenServer) Read(p []byte) (n int, err error) {
+	panic("broken server")
+}
+
+func TestClientRunTUI_ReceivingPaniced_TerminalRestored(t *testing.T) {
+	term := &idleTerminal{quit: make(chan struct{})}
+	defer close(term.quit)
+
+	cl := NewClient(&brokenServer{})
+	assert.Panics(t, func() { cl.RunTUI(term) })
+	assert.True(t, strings.HasSuffix(term.out.String(), "\x1b[?1049l"))
+}
@@ -11,14 +11,26 @@ import (
 type Config struct {
 	Server        string
 	Subscriptions []string
+	// TLS enables TLS, server certificate is verified against
+	// TLSCA or system roots unless TLSInsecure is set.
+	TLS         bool
+	TLSCA       string
+	TLSInsecure bool
+	// TLSCert and TLSKey is a client certificate to sign in with.
+	TLSCert string
+	TLSKey  string
+	// Plain disables full-screen UI, chat goes line by line.
+	Plain bool
 }
 
 // Parse loads config from CLI and file where CLI args have priority.
 func (c *Config) Parse() error {
 	var cliServer string
 	var cliSubs string
+	var cliPlain bool
 	flag.StringVar(&cliServer, "server", "", "Hostel server address [host[:port]]")
 	flag.StringVar(&cliSubs, "subs", "", "Room subscriptions [room:nick1|room2:nick1...]")
+	flag.BoolVar(&cliPlain, "plain", false, "Use plain line mode instead of full-screen UI")
 	flag.Parse()
 
 	f, err := ioutil.ReadFile("config.json")
@@ -32,6 +44,9 @@ func (c *Config) Parse() error {
 	if cliServer != "" {
 		c.Server = cliServer
 	}
+	if cliPlain {
+		c.Plain = true
+	}
 	if cliSubs != "" {
 		c.Subscriptions = c.Subscriptions[:0]
 		for _, sub := range strings.Split(cliSubs, "|") {
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 
 	"github.com/mxmsk/hostel-chat/hostelcli/chat"
+	"github.com/mxmsk/hostel-chat/hostelcli/term"
 )
 
 func main() {
@@ -17,17 +22,89 @@ func main() {
 	log.Println("Use config:", c)
 
 	log.Println("Connecting to:", c.Server, "...")
-	conn, err := net.Dial("tcp", c.Server)
+	conn, err := dial(c)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	cl := chat.NewClient(conn)
+	cl.SetDialer(func() (chat.Server, error) {
+		return dial(c)
+	})
 	for _, sub := range c.Subscriptions {
 		room, nick := roomNickPair(sub)
 		cl.AddSubscription(room, nick)
 	}
 
+	if !c.Plain {
+		err := runTUI(cl)
+		if err == nil {
+			return
+		}
+		log.Println("Full-screen UI is not available:", err)
+	}
 	fmt.Println("Connected! You can now start chatting.")
 	cl.Run(os.Stdin, os.Stdout)
 }
+
+// terminal is the terminal of process in raw mode.
+type terminal struct{}
+
+func (terminal) Read(p []byte) (int, error) {
+	return os.Stdin.Read(p)
+}
+
+func (terminal) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (terminal) Size() (int, int) {
+	// Some terminals don't know their size.
+	w, h, err := term.Size(os.Stdout.Fd())
+	if err != nil || w == 0 || h == 0 {
+		return 80, 24
+	}
+	return w, h
+}
+
+// runTUI runs chat in full-screen UI unless stdin or stdout
+// is not a terminal which supports raw mode.
+func runTUI(cl *chat.Client) error {
+	if _, _, err := term.Size(os.Stdout.Fd()); err != nil {
+		return err
+	}
+	st, err := term.MakeRaw(os.Stdin.Fd())
+	if err != nil {
+		return err
+	}
+	defer term.Restore(os.Stdin.Fd(), st)
+	cl.RunTUI(terminal{})
+	return nil
+}
+
+func dial(c Config) (net.Conn, error) {
+	if !c.TLS {
+		return net.Dial("tcp", c.Server)
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.TLSInsecure,
+	}
+	if c.TLSCA != "" {
+		pem, err := ioutil.ReadFile(c.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + c.TLSCA)
+		}
+	}
+	if c.TLSCert != "" || c.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tls.Dial("tcp", c.Server, tlsConfig)
+}
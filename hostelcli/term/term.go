@@ -0,0 +1,35 @@
+// Package term switches terminal to raw mode, where every key is
+// delivered to program as it's pressed and nothing is echoed, so that
+// full-screen UI can draw terminal as it needs.
+package term
+
+import "errors"
+
+// ErrUnsupported is returned on platforms where raw mode
+// is not implemented.
+var ErrUnsupported = errors.New("terminal is not supported on this platform")
+
+// State is a mode of terminal to restore.
+type State struct {
+	state
+}
+
+// MakeRaw puts terminal with the specified descriptor to raw mode.
+// The previous mode is returned, so that it can be restored.
+func MakeRaw(fd uintptr) (*State, error) {
+	st, err := makeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	return &State{st}, nil
+}
+
+// Restore puts terminal back to the specified mode.
+func Restore(fd uintptr, st *State) error {
+	return restore(fd, st.state)
+}
+
+// Size returns number of columns and rows of terminal.
+func Size(fd uintptr) (width int, height int, err error) {
+	return size(fd)
+}
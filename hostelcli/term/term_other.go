@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!windows
+
+package term
+
+type state struct{}
+
+func makeRaw(fd uintptr) (state, error) {
+	return state{}, ErrUnsupported
+}
+
+func restore(fd uintptr, st state) error {
+	return ErrUnsupported
+}
+
+func size(fd uintptr) (int, int, error) {
+	return 0, 0, ErrUnsupported
+}
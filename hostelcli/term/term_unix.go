@@ -0,0 +1,52 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package term
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+type state struct {
+	termios syscall.Termios
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// makeRaw does what cfmakeraw(3) does.
+func makeRaw(fd uintptr) (state, error) {
+	var st state
+	if err := ioctl(fd, ioctlGetTermios, unsafe.Pointer(&st.termios)); err != nil {
+		return st, err
+	}
+	raw := st.termios
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	return st, ioctl(fd, ioctlSetTermios, unsafe.Pointer(&raw))
+}
+
+func restore(fd uintptr, st state) error {
+	return ioctl(fd, ioctlSetTermios, unsafe.Pointer(&st.termios))
+}
+
+func size(fd uintptr) (int, int, error) {
+	var ws struct {
+		row, col, xpixel, ypixel uint16
+	}
+	if err := ioctl(fd, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+		return 0, 0, err
+	}
+	return int(ws.col), int(ws.row), nil
+}
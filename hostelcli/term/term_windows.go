@@ -0,0 +1,82 @@
+package term
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                       = syscall.NewLazyDLL("kernel32.dll")
+	procSetConsoleMode             = kernel32.NewProc("SetConsoleMode")
+	procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+)
+
+// Console modes, see SetConsoleMode documentation.
+const (
+	enableProcessedInput            = 0x1
+	enableLineInput                 = 0x2
+	enableEchoInput                 = 0x4
+	enableVirtualTerminalInput      = 0x200
+	enableVirtualTerminalProcessing = 0x4
+)
+
+type state struct {
+	in  uint32
+	out uint32
+}
+
+func setConsoleMode(h syscall.Handle, mode uint32) error {
+	if r, _, err := procSetConsoleMode.Call(uintptr(h), uintptr(mode)); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// makeRaw turns off line input and echo of console input, which
+// then delivers keys as VT sequences. Console output is switched to
+// process VT sequences too, as UI draws with them.
+func makeRaw(fd uintptr) (state, error) {
+	var st state
+	if err := syscall.GetConsoleMode(syscall.Handle(fd), &st.in); err != nil {
+		return st, err
+	}
+	if err := syscall.GetConsoleMode(syscall.Stdout, &st.out); err != nil {
+		return st, err
+	}
+	in := st.in&^(enableProcessedInput|enableLineInput|enableEchoInput) | enableVirtualTerminalInput
+	if err := setConsoleMode(syscall.Handle(fd), in); err != nil {
+		return st, err
+	}
+	if err := setConsoleMode(syscall.Stdout, st.out|enableVirtualTerminalProcessing); err != nil {
+		setConsoleMode(syscall.Handle(fd), st.in)
+		return st, err
+	}
+	return st, nil
+}
+
+func restore(fd uintptr, st state) error {
+	if err := setConsoleMode(syscall.Stdout, st.out); err != nil {
+		return err
+	}
+	return setConsoleMode(syscall.Handle(fd), st.in)
+}
+
+type coord struct {
+	x, y int16
+}
+
+type consoleScreenBufferInfo struct {
+	size              coord
+	cursorPosition    coord
+	attributes        uint16
+	window            struct{ left, top, right, bottom int16 }
+	maximumWindowSize coord
+}
+
+func size(fd uintptr) (int, int, error) {
+	var info consoleScreenBufferInfo
+	if r, _, err := procGetConsoleScreenBufferInfo.Call(fd, uintptr(unsafe.Pointer(&info))); r == 0 {
+		return 0, 0, err
+	}
+	return int(info.window.right-info.window.left) + 1, int(info.window.bottom-info.window.top) + 1, nil
+}
@@ -0,0 +1,208 @@
+package chat
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Authenticator verifies credentials of users.
+type Authenticator interface {
+	Authenticate(name string, password string) (identity, error)
+	HasAccount(name string) bool
+}
+
+// NickRegistry keeps nicks reserved by accounts. CheckNick tells
+// whether user may use nick, and ReserveNick reserves it for user
+// once it's used.
+type NickRegistry interface {
+	CheckNick(user identity, nick string) error
+	ReserveNick(user identity, nick string) error
+}
+
+const (
+	passwordIterations = 100000
+	passwordKeyLength  = sha256.Size
+	// maxReservedNicks limits nicks reserved by an account,
+	// further nicks it uses are not reserved.
+	maxReservedNicks = 5
+)
+
+// dummySalt is used to hash password of unknown users, so that
+// it takes as long to reject them as to reject a wrong password.
+var dummySalt = make([]byte, 16)
+
+// Accounts is a list of user accounts kept in local file. Passwords
+// are stored as salted PBKDF2 hashes. Nicks used by an account are
+// reserved for it, so that nobody else can take them.
+type Accounts struct {
+	path  string
+	users map[string]*account
+	nicks map[string]string
+	mu    sync.Mutex
+}
+
+type account struct {
+	Salt  string   `json:"salt"`
+	Hash  string   `json:"hash"`
+	Iter  int      `json:"iter"`
+	Nicks []string `json:"nicks,omitempty"`
+}
+
+// OpenAccounts loads accounts from the specified file.
+// Missing file is treated as empty list of accounts.
+func OpenAccounts(path string) (*Accounts, error) {
+	a := &Accounts{
+		path:  path,
+		users: make(map[string]*account),
+		nicks: make(map[string]string),
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &a.users); err != nil {
+			return nil, err
+		}
+	}
+	for name, acc := range a.users {
+		for _, nick := range acc.Nicks {
+			a.nicks[strings.ToLower(nick)] = name
+		}
+	}
+	return a, nil
+}
+
+// accountIdentity returns identity bound to account with the specified name.
+// Unlike random connection tokens, it always starts with '@'.
+func accountIdentity(name string) identity {
+	return identity("@" + name)
+}
+
+func (user identity) account() (string, bool) {
+	if strings.HasPrefix(string(user), "@") {
+		return string(user[1:]), true
+	}
+	return "", false
+}
+
+func validAccountName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "|:@")
+}
+
+// HasAccount tells whether account with the specified name exists.
+func (a *Accounts) HasAccount(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.users[name]
+	return ok
+}
+
+// SetPassword creates account with the specified name or changes
+// password of existing one.
+func (a *Accounts) SetPassword(name string, password string) error {
+	if !validAccountName(name) {
+		return newError(codeBadRequest, "Invalid account name: %s", name)
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	acc, ok := a.users[name]
+	if !ok {
+		acc = &account{}
+		a.users[name] = acc
+	}
+	acc.Salt = hex.EncodeToString(salt)
+	acc.Iter = passwordIterations
+	acc.Hash = hex.EncodeToString(hashPassword(password, salt, acc.Iter))
+	return a.save()
+}
+
+// Authenticate checks the specified credentials and returns
+// identity of account.
+func (a *Accounts) Authenticate(name string, password string) (identity, error) {
+	a.mu.Lock()
+	acc, ok := a.users[name]
+	a.mu.Unlock()
+	failed := newError(codeAuthFailed, "Invalid user name or password")
+	if !ok {
+		hashPassword(password, dummySalt, passwordIterations)
+		return "", failed
+	}
+	salt, err := hex.DecodeString(acc.Salt)
+	if err != nil {
+		return "", err
+	}
+	expected, err := hex.DecodeString(acc.Hash)
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare(expected, hashPassword(password, salt, acc.Iter)) != 1 {
+		return "", failed
+	}
+	return accountIdentity(name), nil
+}
+
+// CheckNick checks that nick is not reserved by another account.
+func (a *Accounts) CheckNick(user identity, nick string) error {
+	name, _ := user.account()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if owner, reserved := a.nicks[strings.ToLower(nick)]; reserved && owner != name {
+		return newError(codeNickReserved, "Nick %s is reserved", nick)
+	}
+	return nil
+}
+
+// ReserveNick checks that nick is not reserved by another account.
+// Free nicks used by signed in users become reserved for them,
+// unless they have reserved as many nicks as allowed.
+func (a *Accounts) ReserveNick(user identity, nick string) error {
+	key := strings.ToLower(nick)
+	name, signedIn := user.account()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if owner, reserved := a.nicks[key]; reserved {
+		if owner != name {
+			return newError(codeNickReserved, "Nick %s is reserved", nick)
+		}
+		return nil
+	}
+	acc, ok := a.users[name]
+	if !signedIn || !ok || len(acc.Nicks) >= maxReservedNicks {
+		return nil
+	}
+	acc.Nicks = append(acc.Nicks, nick)
+	a.nicks[key] = name
+	return a.save()
+}
+
+func (a *Accounts) save() error {
+	b, err := json.MarshalIndent(a.users, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// hashPassword derives key from password with PBKDF2-HMAC-SHA256.
+func hashPassword(password string, salt []byte, iter int) []byte {
+	return pbkdf2.Key([]byte(password), salt, iter, passwordKeyLength, sha256.New)
+}
@@ -0,0 +1,118 @@
+package chat
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashPassword_KnownVectors_KeyDerived(t *testing.T) {
+	assert.Equal(t,
+		"120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b",
+		hex.EncodeToString(hashPassword("password", []byte("salt"), 1)))
+	assert.Equal(t,
+		"ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43",
+		hex.EncodeToString(hashPassword("password", []byte("salt"), 2)))
+}
+
+func TestAccountsAuthenticate_ValidCredentials_IdentityReturned(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+	a, _ := OpenAccounts(path)
+	assert.NoError(t, a.SetPassword("user1", "secret1"))
+
+	a, err := OpenAccounts(path)
+	assert.NoError(t, err)
+	user, err := a.Authenticate("user1", "secret1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, identity("@user1"), user)
+}
+
+func TestAccountsAuthenticate_InvalidCredentials_ErrorReturned(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	a, _ := OpenAccounts(filepath.Join(dir, "users.json"))
+	a.SetPassword("user1", "secret1")
+
+	_, err1 := a.Authenticate("user1", "secret2")
+	_, err2 := a.Authenticate("user2", "secret1")
+
+	assert.EqualError(t, err1, "Invalid user name or password")
+	assert.EqualError(t, err2, "Invalid user name or password")
+}
+
+func TestAccountsSetPassword_InvalidName_ErrorReturned(t *testing.T) {
+	a, _ := OpenAccounts("")
+
+	for _, name := range []string{"", "user|1", "user:1", "@user1"} {
+		assert.Error(t, a.SetPassword(name, "secret1"))
+	}
+}
+
+func TestAccountsReserveNick_SignedIn_NickReservedAcrossReopen(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+	a, _ := OpenAccounts(path)
+	a.SetPassword("user1", "secret1")
+	a.SetPassword("user2", "secret2")
+
+	assert.NoError(t, a.ReserveNick("@user1", "Nick1"))
+
+	a, _ = OpenAccounts(path)
+	assert.NoError(t, a.ReserveNick("@user1", "nick1"))
+	assert.EqualError(t, a.ReserveNick("@user2", "NICK1"), "Nick NICK1 is reserved")
+	assert.EqualError(t, a.ReserveNick("8a7f", "nick1"), "Nick nick1 is reserved")
+}
+
+func TestAccountsReserveNick_Anonymous_NickNotReserved(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	a, _ := OpenAccounts(filepath.Join(dir, "users.json"))
+	a.SetPassword("user1", "secret1")
+
+	assert.NoError(t, a.ReserveNick("8a7f", "nick1"))
+	assert.NoError(t, a.ReserveNick("@user1", "nick1"))
+	assert.Error(t, a.ReserveNick("8a7f", "nick1"))
+}
+
+func TestAccountsCheckNick_FreeNick_NickNotReserved(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	a, _ := OpenAccounts(filepath.Join(dir, "users.json"))
+	a.SetPassword("user1", "secret1")
+
+	assert.NoError(t, a.CheckNick("@user1", "nick1"))
+	assert.NoError(t, a.ReserveNick("@user2", "nick1"))
+	assert.NoError(t, a.CheckNick("8a7f", "nick1"))
+}
+
+func TestAccountsReserveNick_TooManyNicks_NickNotReserved(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	a, _ := OpenAccounts(filepath.Join(dir, "users.json"))
+	a.SetPassword("user1", "secret1")
+
+	for i := 0; i < maxReservedNicks+1; i++ {
+		assert.NoError(t, a.ReserveNick("@user1", fmt.Sprintf("nick%d", i)))
+	}
+
+	assert.Error(t, a.CheckNick("8a7f", "nick0"))
+	assert.NoError(t, a.CheckNick("8a7f", fmt.Sprintf("nick%d", maxReservedNicks)))
+}
+
+func TestAccountsHasAccount_AddedAccount_True(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	a, _ := OpenAccounts(filepath.Join(dir, "users.json"))
+	a.SetPassword("user1", "secret1")
+
+	assert.True(t, a.HasAccount("user1"))
+	assert.False(t, a.HasAccount("user2"))
+}
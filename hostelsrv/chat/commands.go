@@ -2,112 +2,799 @@ package chat
 
 import (
 	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func publicMsg(nick string, room string, msg message) message {
-	return message(fmt.Sprintf("%s@%s: %s", nick, room, msg))
-}
-
 // SubscribeCommand lets clients to subscribe to specific chat rooms.
+// Every room is given as "room:nick", and history of the room is sent
+// to client. With "room:nick:since=42" or "room:nick:since=<RFC 3339
+// time>" only messages published after the specified message ID or
+// time are sent, and client is told when some of them are no longer
+// kept in history.
 type SubscribeCommand struct {
-	hub *Hub
+	store Store
+	nicks NickRegistry
 }
 
 // NewSubscribeCommand creates a new instance of SubscribeCommand.
-func NewSubscribeCommand(hub *Hub) *SubscribeCommand {
-	return &SubscribeCommand{hub}
+func NewSubscribeCommand(store Store) *SubscribeCommand {
+	return &SubscribeCommand{store: store}
+}
+
+// NewSubscribeCommandWithNicks creates a new instance of SubscribeCommand
+// which doesn't let users to take nicks reserved by others.
+func NewSubscribeCommandWithNicks(store Store, nicks NickRegistry) *SubscribeCommand {
+	return &SubscribeCommand{store: store, nicks: nicks}
 }
 
 // Handle handles SubscribeCommand
 func (cmd *SubscribeCommand) Handle(user identity, args string, outgoing chan<- message) {
-	rnPairs := strings.Split(args, "|")
-	if !cmd.validateRoomNickPairs(rnPairs, outgoing) {
+	subs, err := parseSubscriptions(args)
+	if err != nil {
+		outgoing <- errorReply(err)
 		return
 	}
-	for _, pair := range rnPairs {
-		rn := strings.SplitN(pair, ":", 2)
-		room, nick := rn[0], rn[1]
+	for _, sub := range subs {
+		room, nick := sub.room, sub.nick
 		subscriber := subscriber{
 			nick:     nick,
 			outgoing: outgoing,
 		}
-		if err := cmd.hub.SubscribeToRoom(user, room, subscriber); err != nil {
-			outgoing <- message(err.Error() + ".")
+		if cmd.nicks != nil {
+			if err := cmd.nicks.CheckNick(user, nick); err != nil {
+				outgoing <- errorReply(err)
+				continue
+			}
+		}
+		if err := cmd.store.joinRoom(user, room, subscriber, sub.since); err != nil {
+			outgoing <- errorReply(err)
 			continue
 		}
-		history := cmd.hub.getRoomHistory(room)
-		for _, item := range history {
-			outgoing <- publicMsg(item.nick, room, item.msg)
+		// Nick is reserved only when it's actually taken.
+		if cmd.nicks != nil {
+			if err := cmd.nicks.ReserveNick(user, nick); err != nil {
+				log.Println("Cannot reserve nick", nick+":", err)
+			}
 		}
+		if topic, err := cmd.store.Topic(room); err == nil && topic != "" {
+			outgoing <- topicMsg("", room, topic)
+		}
+		cmd.store.broadcast(room, user, presenceMsg(nick, room, nick+" joined "+room+"."))
 	}
 }
 
-func (cmd *SubscribeCommand) validateRoomNickPairs(rnPairs []string, outgoing chan<- message) bool {
-	for _, pair := range rnPairs {
+// maxNickLength limits length of nicks, which are also reserved
+// for accounts.
+const maxNickLength = 32
+
+type subscription struct {
+	room  string
+	nick  string
+	since *cursor
+}
+
+func parseSubscriptions(args string) ([]subscription, error) {
+	var subs []subscription
+	for _, pair := range strings.Split(args, "|") {
 		rn := strings.SplitN(pair, ":", 2)
 		if rn[0] == "" {
-			outgoing <- message("Room name is missing.")
-			return false
+			return nil, newError(codeBadRequest, "Room name is missing")
 		}
 		if len(rn) == 1 || rn[1] == "" {
-			outgoing <- message("Nickname for " + rn[0] + " is missing.")
-			return false
+			return nil, newError(codeBadRequest, "Nickname for %s is missing", rn[0])
 		}
+		sub := subscription{room: rn[0], nick: rn[1]}
+		// Time contains ':', so the last option is looked for.
+		if i := strings.LastIndex(sub.nick, ":since="); i >= 0 {
+			since, err := parseCursor(sub.nick[i+len(":since="):])
+			if err != nil {
+				return nil, newError(codeBadRequest, "Invalid since value for %s", sub.room)
+			}
+			sub.nick, sub.since = sub.nick[:i], &since
+			if sub.nick == "" {
+				return nil, newError(codeBadRequest, "Nickname for %s is missing", sub.room)
+			}
+		}
+		if len(sub.nick) > maxNickLength {
+			return nil, newError(codeTooLong, "Nickname for %s is too long", sub.room)
+		}
+		subs = append(subs, sub)
 	}
-	return true
+	return subs, nil
+}
+
+// parseCursor parses message ID or RFC 3339 time.
+func parseCursor(s string) (cursor, error) {
+	if id, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return cursor{id: id}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return cursor{time: t}, err
 }
 
 // PublishCommand lets clients to publish message to rooms which
 // they are subscribed to.
 type PublishCommand struct {
-	hub    *Hub
-	msgCap int
+	store  Store
+	msgCap int32
 }
 
 // NewPublishCommand creates a new instance of PublishCommand.
-func NewPublishCommand(hub *Hub, msgCap int) *PublishCommand {
+func NewPublishCommand(store Store, msgCap int) *PublishCommand {
 	return &PublishCommand{
-		hub:    hub,
-		msgCap: msgCap,
+		store:  store,
+		msgCap: int32(msgCap),
 	}
 }
 
+// SetMsgCap changes maximum length of published messages.
+func (cmd *PublishCommand) SetMsgCap(msgCap int) {
+	atomic.StoreInt32(&cmd.msgCap, int32(msgCap))
+}
+
 // Handle handles PublishCommand
 func (cmd *PublishCommand) Handle(user identity, args string, outgoing chan<- message) {
 	rm := strings.SplitN(args, "|", 2)
 	if !cmd.validateRoomMsgPair(rm, outgoing) {
 		return
 	}
-	target, msg := rm[0], message(rm[1])
-	subs := cmd.hub.getSubscribers(target)
+	target, msg := rm[0], rm[1]
+	subs := cmd.store.getSubscribers(target)
 	if _, subscribed := subs[user]; !subscribed {
-		outgoing <- message("You are not subscribed to " + target + ".")
+		outgoing <- errorMsg(codeNotSubscribed, "You are not subscribed to "+target+".")
 		return
 	}
-	for id, sub := range subs {
-		if id != user {
-			sub.outgoing <- publicMsg(subs[user].nick, target, msg)
-		}
+	if left := time.Until(cmd.store.mutedUntil(target, user)); left > 0 {
+		outgoing <- errorMsg(codeMuted, fmt.Sprintf("You are muted in %s for %s.",
+			target, left.Round(time.Second)))
+		return
+	}
+	settings, _ := cmd.store.roomSettings(target)
+	if settings.ReadOnly {
+		outgoing <- errorMsg(codeReadOnly, "Room "+target+" is read-only.")
+		return
+	}
+	msgCap := settings.MaxMessageLength
+	if msgCap <= 0 {
+		msgCap = int(atomic.LoadInt32(&cmd.msgCap))
+	}
+	if len(msg) > msgCap {
+		outgoing <- errorMsg(codeTooLong, "Message is too long.")
+		return
+	}
+	item := historyItem{nick: subs[user].nick, msg: msg}
+	if _, err := cmd.store.publish(target, user, item); err != nil {
+		log.Println("Cannot save history of", target+":", err)
 	}
-	cmd.hub.AppendRoomHistory(target, historyItem{
-		nick: subs[user].nick,
-		msg:  msg,
-	})
 }
 
 func (cmd *PublishCommand) validateRoomMsgPair(rm []string, outgoing chan<- message) bool {
 	if rm[0] == "" {
-		outgoing <- message("Target room name is missing.")
+		outgoing <- errorMsg(codeBadRequest, "Target room name is missing.")
 		return false
 	}
 	if len(rm) == 1 || strings.TrimSpace(rm[1]) == "" {
-		outgoing <- message("Message is empty.")
+		outgoing <- errorMsg(codeEmptyMessage, "Message is empty.")
+		return false
+	}
+	return true
+}
+
+// Limits of rooms created by users: length of room name, number of
+// such rooms on server and number of them operated by a single user.
+const (
+	maxRoomNameLength   = 32
+	maxCreatedRooms     = 100
+	maxRoomsPerOperator = 5
+)
+
+// CreateCommand lets clients to create new chat rooms at runtime.
+// Creator of a room becomes its operator.
+type CreateCommand struct {
+	store Store
+	// mu serializes creation, so that limits of rooms are not
+	// exceeded by concurrent requests.
+	mu sync.Mutex
+}
+
+// NewCreateCommand creates a new instance of CreateCommand.
+func NewCreateCommand(store Store) *CreateCommand {
+	return &CreateCommand{store: store}
+}
+
+// Handle handles CreateCommand
+func (cmd *CreateCommand) Handle(user identity, args string, outgoing chan<- message) {
+	if !validateRoomName(args, outgoing) {
+		return
+	}
+	cmd.mu.Lock()
+	defer cmd.mu.Unlock()
+	created, operated := cmd.store.createdRooms(user)
+	if created >= maxCreatedRooms {
+		outgoing <- errorMsg(codeTooManyRooms, "Too many rooms on server.")
+		return
+	}
+	if operated >= maxRoomsPerOperator {
+		outgoing <- errorMsg(codeTooManyRooms,
+			fmt.Sprintf("You can't operate more than %d rooms.", maxRoomsPerOperator))
+		return
+	}
+	if err := cmd.store.CreateRoom(args); err != nil {
+		outgoing <- errorReply(err)
+		return
+	}
+	cmd.store.addOperator(args, user)
+	outgoing <- noticeMsg("Room " + args + " created.")
+}
+
+// validateRoomName checks name of room created by user, which may
+// contain only ASCII letters, digits, '-', '_' and '.'.
+func validateRoomName(roomName string, outgoing chan<- message) bool {
+	if roomName == "" {
+		outgoing <- errorMsg(codeBadRequest, "Room name is missing.")
+		return false
+	}
+	if len(roomName) > maxRoomNameLength {
+		outgoing <- errorMsg(codeBadRequest, "Room name is too long.")
+		return false
+	}
+	for _, r := range roomName {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' ||
+			r == '-' || r == '_' || r == '.') {
+			outgoing <- errorMsg(codeBadRequest, "Room name may contain only letters, digits, '-', '_' and '.'.")
+			return false
+		}
+	}
+	return true
+}
+
+// DeleteCommand lets operators to delete chat rooms at runtime, except
+// configured ones. Members of the deleted room are notified and
+// unsubscribed from it.
+type DeleteCommand struct {
+	store Store
+}
+
+// NewDeleteCommand creates a new instance of DeleteCommand.
+func NewDeleteCommand(store Store) *DeleteCommand {
+	return &DeleteCommand{store}
+}
+
+// Handle handles DeleteCommand
+func (cmd *DeleteCommand) Handle(user identity, args string, outgoing chan<- message) {
+	if !checkOperator(cmd.store, args, user, outgoing) {
+		return
+	}
+	// Configured room would be recreated by anybody who
+	// becomes its operator, so it's only removed from config.
+	if cmd.store.isConfigured(args) {
+		outgoing <- errorMsg(codeRoomConfigured, "Room "+args+" is configured and can't be deleted.")
+		return
+	}
+	// Members are notified while they are still in the room, so that
+	// nobody who has left it in the meantime receives the notice.
+	cmd.store.broadcast(args, user, noticeMsg("Room "+args+" was deleted."))
+	if _, err := cmd.store.DeleteRoom(args); err != nil {
+		outgoing <- errorReply(err)
+		return
+	}
+	outgoing <- noticeMsg("Room " + args + " deleted.")
+}
+
+// RetireRoom deletes room which is no longer served, e.g. removed from
+// configuration. Members are notified before they are unsubscribed.
+func RetireRoom(store Store, roomName string) error {
+	store.broadcast(roomName, "", noticeMsg("Room "+roomName+" was closed."))
+	_, err := store.DeleteRoom(roomName)
+	return err
+}
+
+// WhisperCommand lets clients to send private message to a user
+// with the specified nick. Private messages are not kept in history.
+type WhisperCommand struct {
+	store  Store
+	msgCap int32
+}
+
+// NewWhisperCommand creates a new instance of WhisperCommand.
+func NewWhisperCommand(store Store, msgCap int) *WhisperCommand {
+	return &WhisperCommand{
+		store:  store,
+		msgCap: int32(msgCap),
+	}
+}
+
+// SetMsgCap changes maximum length of private messages.
+func (cmd *WhisperCommand) SetMsgCap(msgCap int) {
+	atomic.StoreInt32(&cmd.msgCap, int32(msgCap))
+}
+
+// Handle handles WhisperCommand
+func (cmd *WhisperCommand) Handle(user identity, args string, outgoing chan<- message) {
+	nm := strings.SplitN(args, "|", 2)
+	if nm[0] == "" {
+		outgoing <- errorMsg(codeBadRequest, "Target nick is missing.")
+		return
+	}
+	if len(nm) == 1 || strings.TrimSpace(nm[1]) == "" {
+		outgoing <- errorMsg(codeEmptyMessage, "Message is empty.")
+		return
+	}
+	if len(nm[1]) > int(atomic.LoadInt32(&cmd.msgCap)) {
+		outgoing <- errorMsg(codeTooLong, "Message is too long.")
+		return
+	}
+	if err := cmd.store.whisper(user, nm[0], nm[1]); err != nil {
+		outgoing <- errorReply(err)
+	}
+}
+
+// LeaveCommand lets clients to unsubscribe from a single room.
+// Remaining members of the room are notified.
+type LeaveCommand struct {
+	store Store
+}
+
+// NewLeaveCommand creates a new instance of LeaveCommand.
+func NewLeaveCommand(store Store) *LeaveCommand {
+	return &LeaveCommand{store}
+}
+
+// Handle handles LeaveCommand
+func (cmd *LeaveCommand) Handle(user identity, args string, outgoing chan<- message) {
+	if args == "" {
+		outgoing <- errorMsg(codeBadRequest, "Room name is missing.")
+		return
+	}
+	sub, err := cmd.store.UnsubscribeFromRoom(user, args)
+	if err != nil {
+		outgoing <- errorReply(err)
+		return
+	}
+	cmd.store.broadcast(args, user, presenceMsg(sub.nick, args, sub.nick+" left "+args+"."))
+	outgoing <- noticeMsg("You left " + args + ".")
+}
+
+// WhoCommand lets clients to list nicks of room members.
+type WhoCommand struct {
+	store Store
+}
+
+// NewWhoCommand creates a new instance of WhoCommand.
+func NewWhoCommand(store Store) *WhoCommand {
+	return &WhoCommand{store}
+}
+
+// Handle handles WhoCommand
+func (cmd *WhoCommand) Handle(user identity, args string, outgoing chan<- message) {
+	if args == "" {
+		outgoing <- errorMsg(codeBadRequest, "Room name is missing.")
+		return
+	}
+	subs := cmd.store.getSubscribers(args)
+	if subs == nil {
+		outgoing <- errorMsg(codeUnknownRoom, "Unknown room: "+args+".")
+		return
+	}
+	nicks := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		nicks = append(nicks, sub.nick)
+	}
+	sort.Strings(nicks)
+	outgoing <- membersMsg(args, nicks)
+}
+
+// Number of messages returned by HistoryCommand by default and at most.
+const (
+	defaultHistoryPage = 50
+	maxHistoryPage     = 100
+)
+
+// HistoryCommand lets members of a room to page back through its
+// history: "history|room|before=<id>|limit=<n>", both options are
+// optional. Messages published before the specified one are returned
+// in chronological order, and client is told when there are no more.
+type HistoryCommand struct {
+	store Store
+}
+
+// NewHistoryCommand creates a new instance of HistoryCommand.
+func NewHistoryCommand(store Store) *HistoryCommand {
+	return &HistoryCommand{store}
+}
+
+// Handle handles HistoryCommand
+func (cmd *HistoryCommand) Handle(user identity, args string, outgoing chan<- message) {
+	opts := strings.Split(args, "|")
+	room := opts[0]
+	if room == "" {
+		outgoing <- errorMsg(codeBadRequest, "Room name is missing.")
+		return
+	}
+	before, limit := uint64(math.MaxUint64), defaultHistoryPage
+	for _, opt := range opts[1:] {
+		var err error
+		switch {
+		case strings.HasPrefix(opt, "before="):
+			before, err = strconv.ParseUint(opt[len("before="):], 10, 64)
+		case strings.HasPrefix(opt, "limit="):
+			limit, err = strconv.Atoi(opt[len("limit="):])
+			if err == nil && (limit <= 0 || limit > maxHistoryPage) {
+				err = strconv.ErrRange
+			}
+		default:
+			err = strconv.ErrSyntax
+		}
+		if err != nil {
+			outgoing <- errorMsg(codeBadRequest, "Invalid option: "+opt+".")
+			return
+		}
+	}
+	if _, subscribed := cmd.store.getSubscribers(room)[user]; !subscribed {
+		outgoing <- errorMsg(codeNotSubscribed, "You are not subscribed to "+room+".")
+		return
+	}
+	items, err := cmd.store.roomHistoryBefore(room, before, limit)
+	if err != nil {
+		outgoing <- errorReply(err)
+		return
+	}
+	for _, item := range items {
+		outgoing <- historyMsg(room, item)
+	}
+	if len(items) < limit {
+		outgoing <- noticeMsg("No earlier messages in " + room + ".")
+	}
+}
+
+// Number of results returned by SearchCommand by default and at most.
+const (
+	defaultSearchResults = 20
+	maxSearchResults     = 100
+)
+
+// SearchCommand lets members of a room to search its history:
+// "search|room|query|nick=<nick>|from=<time>|to=<time>|limit=<n>",
+// where filters are optional and times are in RFC 3339 format. Messages
+// containing all words of query are returned, the most relevant first.
+type SearchCommand struct {
+	store Store
+}
+
+// NewSearchCommand creates a new instance of SearchCommand.
+func NewSearchCommand(store Store) *SearchCommand {
+	return &SearchCommand{store}
+}
+
+// Handle handles SearchCommand
+func (cmd *SearchCommand) Handle(user identity, args string, outgoing chan<- message) {
+	opts := strings.Split(args, "|")
+	room := opts[0]
+	if room == "" {
+		outgoing <- errorMsg(codeBadRequest, "Room name is missing.")
+		return
+	}
+	q := searchQuery{limit: defaultSearchResults}
+	if len(opts) > 1 {
+		q.words = searchWords(opts[1])
+	}
+	if len(q.words) == 0 {
+		outgoing <- errorMsg(codeBadRequest, "Search query is missing.")
+		return
+	}
+	for _, opt := range opts[2:] {
+		var err error
+		switch {
+		case strings.HasPrefix(opt, "nick="):
+			q.nick = opt[len("nick="):]
+		case strings.HasPrefix(opt, "from="):
+			q.from, err = time.Parse(time.RFC3339, opt[len("from="):])
+		case strings.HasPrefix(opt, "to="):
+			q.to, err = time.Parse(time.RFC3339, opt[len("to="):])
+		case strings.HasPrefix(opt, "limit="):
+			q.limit, err = strconv.Atoi(opt[len("limit="):])
+			if err == nil && (q.limit <= 0 || q.limit > maxSearchResults) {
+				err = strconv.ErrRange
+			}
+		default:
+			err = strconv.ErrSyntax
+		}
+		if err != nil {
+			outgoing <- errorMsg(codeBadRequest, "Invalid option: "+opt+".")
+			return
+		}
+	}
+	if _, subscribed := cmd.store.getSubscribers(room)[user]; !subscribed {
+		outgoing <- errorMsg(codeNotSubscribed, "You are not subscribed to "+room+".")
+		return
+	}
+	items, err := cmd.store.searchRoom(room, q)
+	if err != nil {
+		outgoing <- errorReply(err)
+		return
+	}
+	for _, item := range items {
+		outgoing <- resultMsg(room, item)
+	}
+	if len(items) == 0 {
+		outgoing <- noticeMsg("No messages in " + room + " match the query.")
+	}
+}
+
+// maxTopicLength limits length of room topics.
+const maxTopicLength = 254
+
+// TopicCommand lets clients to read topic of a room and lets
+// its members to change it.
+type TopicCommand struct {
+	store Store
+}
+
+// NewTopicCommand creates a new instance of TopicCommand.
+func NewTopicCommand(store Store) *TopicCommand {
+	return &TopicCommand{store}
+}
+
+// Handle handles TopicCommand
+func (cmd *TopicCommand) Handle(user identity, args string, outgoing chan<- message) {
+	rt := strings.SplitN(args, "|", 2)
+	room := rt[0]
+	if room == "" {
+		outgoing <- errorMsg(codeBadRequest, "Room name is missing.")
+		return
+	}
+	if len(rt) == 1 {
+		topic, err := cmd.store.Topic(room)
+		if err != nil {
+			outgoing <- errorReply(err)
+			return
+		}
+		outgoing <- topicMsg("", room, topic)
+		return
+	}
+	sub, subscribed := cmd.store.getSubscribers(room)[user]
+	if !subscribed {
+		outgoing <- errorMsg(codeNotSubscribed, "You are not subscribed to "+room+".")
+		return
+	}
+	if len(rt[1]) > maxTopicLength {
+		outgoing <- errorMsg(codeTooLong, "Topic is too long.")
+		return
+	}
+	if err := cmd.store.SetTopic(room, rt[1]); err != nil {
+		outgoing <- errorReply(err)
+		return
+	}
+	m := topicMsg(sub.nick, room, rt[1])
+	cmd.store.broadcast(room, user, m)
+	outgoing <- m
+}
+
+// checkOperator reports error to user who isn't operator of room.
+func checkOperator(store Store, roomName string, user identity, outgoing chan<- message) bool {
+	if roomName == "" {
+		outgoing <- errorMsg(codeBadRequest, "Room name is missing.")
 		return false
 	}
-	if len(rm[1]) > cmd.msgCap {
-		outgoing <- message("Message is too long.")
+	if !store.isOperator(roomName, user) {
+		outgoing <- errorMsg(codeNotOperator, "You are not an operator of "+roomName+".")
 		return false
 	}
 	return true
 }
+
+// operatorName returns name under which operator is shown to members
+// of room: nick in the room, account name or just "operator".
+func operatorName(store Store, roomName string, user identity) string {
+	if sub, ok := store.getSubscribers(roomName)[user]; ok {
+		return sub.nick
+	}
+	if name, ok := user.account(); ok {
+		return name
+	}
+	return "operator"
+}
+
+// findMember returns member of room with the specified nick.
+func findMember(store Store, roomName string, nick string) (identity, subscriber, bool) {
+	for user, sub := range store.getSubscribers(roomName) {
+		if strings.EqualFold(sub.nick, nick) {
+			return user, sub, true
+		}
+	}
+	return "", subscriber{}, false
+}
+
+// removeMember tells member that they were kicked from room, unsubscribes
+// them and notifies remaining members.
+func removeMember(store Store, roomName string, user identity, operator string, reason string) {
+	store.notify(roomName, user, kickedMsg(operator, roomName, reason))
+	sub, err := store.UnsubscribeFromRoom(user, roomName)
+	if err != nil {
+		// Member has left the room in the meantime.
+		return
+	}
+	text := sub.nick + " was kicked by " + operator
+	if reason != "" {
+		text += ": " + reason
+	} else {
+		text += "."
+	}
+	store.broadcast(roomName, user, presenceMsg(sub.nick, roomName, text))
+}
+
+// KickCommand lets room operators to remove members from the room,
+// optionally telling them a reason: "kick|room|nick|reason".
+type KickCommand struct {
+	store Store
+}
+
+// NewKickCommand creates a new instance of KickCommand.
+func NewKickCommand(store Store) *KickCommand {
+	return &KickCommand{store}
+}
+
+// Handle handles KickCommand
+func (cmd *KickCommand) Handle(user identity, args string, outgoing chan<- message) {
+	rnr := strings.SplitN(args, "|", 3)
+	if !checkOperator(cmd.store, rnr[0], user, outgoing) {
+		return
+	}
+	if len(rnr) == 1 || rnr[1] == "" {
+		outgoing <- errorMsg(codeBadRequest, "Nick is missing.")
+		return
+	}
+	room, nick, reason := rnr[0], rnr[1], ""
+	if len(rnr) == 3 {
+		reason = rnr[2]
+	}
+	member, _, ok := findMember(cmd.store, room, nick)
+	if !ok {
+		outgoing <- errorMsg(codeNoSuchUser, "No such user in "+room+": "+nick+".")
+		return
+	}
+	operator := operatorName(cmd.store, room, user)
+	log.Println("Operator", operator, "kicked", nick, "from", room)
+	removeMember(cmd.store, room, member, operator, reason)
+	outgoing <- noticeMsg("You kicked " + nick + " from " + room + ".")
+}
+
+// BanCommand lets room operators to prevent users from joining the
+// room: "ban|room|nick-or-identity|reason". Member with the specified
+// nick is banned by both nick and identity, and is kicked. Otherwise,
+// the argument is identity when it starts with '@', e.g. "@name" of
+// an account, or nick.
+type BanCommand struct {
+	store Store
+}
+
+// NewBanCommand creates a new instance of BanCommand.
+func NewBanCommand(store Store) *BanCommand {
+	return &BanCommand{store}
+}
+
+// Handle handles BanCommand
+func (cmd *BanCommand) Handle(user identity, args string, outgoing chan<- message) {
+	rtr := strings.SplitN(args, "|", 3)
+	if !checkOperator(cmd.store, rtr[0], user, outgoing) {
+		return
+	}
+	if len(rtr) == 1 || rtr[1] == "" {
+		outgoing <- errorMsg(codeBadRequest, "Nick or identity is missing.")
+		return
+	}
+	room, target, reason := rtr[0], rtr[1], ""
+	if len(rtr) == 3 {
+		reason = rtr[2]
+	}
+	member, sub, isMember := findMember(cmd.store, room, target)
+	var err error
+	switch {
+	case isMember:
+		err = cmd.store.ban(room, member, sub.nick)
+	case strings.HasPrefix(target, "@"):
+		err = cmd.store.ban(room, identity(target), "")
+	default:
+		err = cmd.store.ban(room, "", target)
+	}
+	if err != nil {
+		outgoing <- errorReply(err)
+		return
+	}
+	operator := operatorName(cmd.store, room, user)
+	log.Println("Operator", operator, "banned", target, "from", room)
+	if isMember {
+		removeMember(cmd.store, room, member, operator, reason)
+	}
+	outgoing <- noticeMsg("You banned " + target + " from " + room + ".")
+}
+
+// MuteCommand lets room operators to prevent members from publishing
+// to the room for the specified duration: "mute|room|nick|10m".
+// Zero duration lifts the mute.
+type MuteCommand struct {
+	store Store
+}
+
+// NewMuteCommand creates a new instance of MuteCommand.
+func NewMuteCommand(store Store) *MuteCommand {
+	return &MuteCommand{store}
+}
+
+// Handle handles MuteCommand
+func (cmd *MuteCommand) Handle(user identity, args string, outgoing chan<- message) {
+	rnd := strings.SplitN(args, "|", 3)
+	if !checkOperator(cmd.store, rnd[0], user, outgoing) {
+		return
+	}
+	if len(rnd) == 1 || rnd[1] == "" {
+		outgoing <- errorMsg(codeBadRequest, "Nick is missing.")
+		return
+	}
+	if len(rnd) == 2 {
+		outgoing <- errorMsg(codeBadRequest, "Duration is missing.")
+		return
+	}
+	room, nick := rnd[0], rnd[1]
+	d, err := time.ParseDuration(rnd[2])
+	if err != nil || d < 0 {
+		outgoing <- errorMsg(codeBadRequest, "Invalid duration: "+rnd[2]+".")
+		return
+	}
+	member, _, ok := findMember(cmd.store, room, nick)
+	if !ok {
+		outgoing <- errorMsg(codeNoSuchUser, "No such user in "+room+": "+nick+".")
+		return
+	}
+	if err := cmd.store.mute(room, member, time.Now().Add(d)); err != nil {
+		outgoing <- errorReply(err)
+		return
+	}
+	operator := operatorName(cmd.store, room, user)
+	if d == 0 {
+		cmd.store.notify(room, member, noticeMsg("You are no longer muted in "+room+"."))
+		outgoing <- noticeMsg(nick + " is no longer muted in " + room + ".")
+		return
+	}
+	log.Println("Operator", operator, "muted", nick, "in", room, "for", d)
+	cmd.store.notify(room, member, noticeMsg(fmt.Sprintf("You are muted in %s for %s by %s.", room, d, operator)))
+	outgoing <- noticeMsg(fmt.Sprintf("%s is muted in %s for %s.", nick, room, d))
+}
+
+// Disconnector unsubscribes disconnected users from all rooms
+// and notifies remaining members of those rooms.
+type Disconnector struct {
+	store Store
+}
+
+// NewDisconnector creates a new instance of Disconnector.
+func NewDisconnector(store Store) *Disconnector {
+	return &Disconnector{store}
+}
+
+// Unsubscribe removes user from all rooms.
+func (d *Disconnector) Unsubscribe(user identity) {
+	for room, sub := range d.store.leaveAll(user) {
+		d.store.broadcast(room, user, presenceMsg(sub.nick, room, sub.nick+" disconnected."))
+	}
+}
+
+// Rebind moves memberships of user to another identity, e.g. when user
+// signs in. Rooms which the other identity is banned from are left, and
+// their members are notified. Names of left rooms are returned.
+func (d *Disconnector) Rebind(from identity, to identity) []string {
+	var left []string
+	for room, sub := range d.store.rebind(from, to) {
+		d.store.broadcast(room, from, presenceMsg(sub.nick, room, sub.nick+" left "+room+"."))
+		left = append(left, room)
+	}
+	sort.Strings(left)
+	return left
+}
@@ -1,11 +1,51 @@
 package chat
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+type testStore struct {
+	*Hub
+	appendErr error
+	appended  []historyItem
+}
+
+func (store *testStore) publish(roomName string, sender identity, item historyItem) (historyItem, error) {
+	store.appended = append(store.appended, item)
+	return item, store.appendErr
+}
+
+type testNicks map[string]identity
+
+func (nicks testNicks) CheckNick(user identity, nick string) error {
+	if owner, ok := nicks[nick]; ok && owner != user {
+		return newError(codeNickReserved, "Nick %s is reserved", nick)
+	}
+	return nil
+}
+
+func (nicks testNicks) ReserveNick(user identity, nick string) error {
+	if err := nicks.CheckNick(user, nick); err != nil {
+		return err
+	}
+	if _, signedIn := user.account(); signedIn {
+		nicks[nick] = user
+	}
+	return nil
+}
+
+// unstamped renders message without its ID and time.
+func unstamped(m message) string {
+	m.msgID, m.time = 0, time.Time{}
+	return m.String()
+}
+
 func TestSubscribeCommand_CorrectArgs_UserSubscribed(t *testing.T) {
 	hub := NewHub(128)
 	hub.CreateRoom("room1")
@@ -41,9 +81,23 @@ func TestSubscribeCommand_CorrectArgs_HistoryToOutgoing(t *testing.T) {
 	cmd := NewSubscribeCommand(hub)
 	cmd.Handle("id1", "room1:nick1|room2:nick2", outgoing)
 
-	assert.Equal(t, message("nick8@room1: msg1"), <-outgoing)
-	assert.Equal(t, message("nick10@room2: msg2"), <-outgoing)
-	assert.Equal(t, message("nick8@room2: msg3"), <-outgoing)
+	assert.Equal(t, "nick8@room1: msg1", (<-outgoing).String())
+	assert.Equal(t, "nick10@room2: msg2", (<-outgoing).String())
+	assert.Equal(t, "nick8@room2: msg3", (<-outgoing).String())
+}
+
+func TestSubscribeCommand_TopicSet_TopicAfterHistory(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.AppendRoomHistory("room1", historyItem{nick: "nick8", msg: "msg1"})
+	hub.SetTopic("room1", "topic1")
+	outgoing := make(chan message, 2)
+
+	cmd := NewSubscribeCommand(hub)
+	cmd.Handle("id1", "room1:nick1", outgoing)
+
+	assert.Equal(t, "nick8@room1: msg1", (<-outgoing).String())
+	assert.Equal(t, topicMsg("", "room1", "topic1"), <-outgoing)
 }
 
 func TestSubscribeCommand_HasUnknownRooms_UnknownToOutgoing(t *testing.T) {
@@ -59,8 +113,8 @@ func TestSubscribeCommand_HasUnknownRooms_UnknownToOutgoing(t *testing.T) {
 	assert.Contains(t, hub.getSubscribers("room3"), identity("id1"))
 
 	assert.Len(t, outgoing, 2)
-	assert.Contains(t, <-outgoing, "Cannot subscribe to unknown room: room2.")
-	assert.Contains(t, <-outgoing, "Cannot subscribe to unknown room: room4.")
+	assert.Contains(t, (<-outgoing).String(), "Cannot subscribe to unknown room: room2.")
+	assert.Contains(t, (<-outgoing).String(), "Cannot subscribe to unknown room: room4.")
 }
 
 func TestSubscribeCommand_HasDuplicateNicks_DuplicatesToOutgoing(t *testing.T) {
@@ -80,8 +134,41 @@ func TestSubscribeCommand_HasDuplicateNicks_DuplicatesToOutgoing(t *testing.T) {
 	assert.Contains(t, hub.getSubscribers("room4"), identity("id1"))
 
 	assert.Len(t, outgoing, 2)
-	assert.Contains(t, <-outgoing, "User nick1 already joined room1.")
-	assert.Contains(t, <-outgoing, "User nick3 already joined room3.")
+	assert.Contains(t, (<-outgoing).String(), "User nick1 already joined room1.")
+	assert.Contains(t, (<-outgoing).String(), "User nick3 already joined room3.")
+}
+
+func TestSubscribeCommand_NickReserved_ErrorToOutgoing(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	outgoing := make(chan message, 1)
+	nicks := testNicks{"nick1": "@user1"}
+
+	cmd := NewSubscribeCommandWithNicks(hub, nicks)
+	cmd.Handle("id1", "room1:nick1|room2:nick2", outgoing)
+
+	assert.NotContains(t, hub.getSubscribers("room1"), identity("id1"))
+	assert.Contains(t, hub.getSubscribers("room2"), identity("id1"))
+	assert.Len(t, outgoing, 1)
+	assert.Equal(t, errorMsg(codeNickReserved, "Nick nick1 is reserved."), <-outgoing)
+
+	cmd.Handle("@user1", "room2:nick1", make(chan message, 1))
+
+	assert.Contains(t, hub.getSubscribers("room2"), identity("@user1"))
+	assert.Equal(t, presenceMsg("nick1", "room2", "nick1 joined room2."), <-outgoing)
+}
+
+func TestSubscribeCommand_SubscribeFailed_NickNotReserved(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick1"})
+	nicks := testNicks{}
+
+	cmd := NewSubscribeCommandWithNicks(hub, nicks)
+	cmd.Handle("@user1", "room1:nick1|room2:nick2", make(chan message, 2))
+
+	assert.Empty(t, nicks)
 }
 
 func TestSubscribeCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
@@ -94,6 +181,7 @@ func TestSubscribeCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
 		{args: "room1:nick1|room2", reply: "Nickname for room2 is missing."},
 		{args: ":nick1", reply: "Room name is missing."},
 		{args: "room1:nick1|:nick2", reply: "Room name is missing."},
+		{args: "room1:" + strings.Repeat("n", 33), reply: "Nickname for room1 is too long."},
 	}
 
 	for _, testCase := range testCases {
@@ -105,7 +193,7 @@ func TestSubscribeCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
 		cmd.Handle("id", testCase.args, outgoing)
 
 		assert.Len(t, outgoing, 1)
-		assert.Contains(t, <-outgoing, testCase.reply)
+		assert.Contains(t, (<-outgoing).String(), testCase.reply)
 		assert.Len(t, hub.getSubscribers("room1"), 0)
 	}
 }
@@ -128,11 +216,11 @@ func TestPulishCommand_CorrectArgs_MessagePublished(t *testing.T) {
 	cmd.Handle("id2", "room2|msg2", make(chan message))
 	cmd.Handle("id3", "room2|msg3", make(chan message))
 
-	assert.Equal(t, message("nick2@room2: msg2"), <-outgoing1)
-	assert.Equal(t, message("nick3@room2: msg3"), <-outgoing1)
-	assert.Equal(t, message("nick1@room1: msg1"), <-outgoing2)
-	assert.Equal(t, message("nick3@room2: msg3"), <-outgoing2)
-	assert.Equal(t, message("nick2@room2: msg2"), <-outgoing3)
+	assert.Equal(t, "nick2@room2: msg2", unstamped(<-outgoing1))
+	assert.Equal(t, "nick3@room2: msg3", unstamped(<-outgoing1))
+	assert.Equal(t, "nick1@room1: msg1", unstamped(<-outgoing2))
+	assert.Equal(t, "nick3@room2: msg3", unstamped(<-outgoing2))
+	assert.Equal(t, "nick2@room2: msg2", unstamped(<-outgoing3))
 }
 
 func TestPulishCommand_RoomNotSubscribed_UnknownToOutgoing(t *testing.T) {
@@ -146,7 +234,7 @@ func TestPulishCommand_RoomNotSubscribed_UnknownToOutgoing(t *testing.T) {
 	cmd.Handle("id1", "room2|msg1", outgoing)
 
 	assert.Len(t, outgoing, 1)
-	assert.Contains(t, <-outgoing, "You are not subscribed to room2.")
+	assert.Contains(t, (<-outgoing).String(), "You are not subscribed to room2.")
 }
 
 func TestPulishCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
@@ -171,7 +259,7 @@ func TestPulishCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
 		cmd.Handle("id", testCase.args, outgoing)
 
 		assert.Len(t, outgoing, 1)
-		assert.Contains(t, <-outgoing, testCase.reply)
+		assert.Contains(t, (<-outgoing).String(), testCase.reply)
 	}
 }
 
@@ -186,16 +274,52 @@ func TestPulishCommand_MessageExceedsCapacity_ErrorToOutgoing(t *testing.T) {
 	cmd := NewPublishCommand(hub, 4)
 
 	cmd.Handle("id1", "room1|mmm", outgoing1)
-	assert.Equal(t, message("nick1@room1: mmm"), <-outgoing2)
+	assert.Equal(t, "nick1@room1: mmm", unstamped(<-outgoing2))
 
 	cmd.Handle("id1", "room1|mmmm", outgoing1)
-	assert.Equal(t, message("nick1@room1: mmmm"), <-outgoing2)
+	assert.Equal(t, "nick1@room1: mmmm", unstamped(<-outgoing2))
 
 	cmd.Handle("id1", "room1|mmmmm", outgoing1)
-	assert.Equal(t, message("Message is too long."), <-outgoing1)
+	assert.Equal(t, "Message is too long.", (<-outgoing1).String())
 
 	cmd.Handle("id1", "room1|mmmmmm", outgoing1)
-	assert.Equal(t, message("Message is too long."), <-outgoing1)
+	assert.Equal(t, "Message is too long.", (<-outgoing1).String())
+}
+
+func TestPulishCommand_CapacityChanged_NewCapacityApplied(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	outgoing1 := make(chan message, 1)
+	outgoing2 := make(chan message, 1)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1", outgoing: outgoing1})
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: outgoing2})
+
+	cmd := NewPublishCommand(hub, 4)
+	cmd.SetMsgCap(2)
+
+	cmd.Handle("id1", "room1|mmm", outgoing1)
+	assert.Equal(t, "Message is too long.", (<-outgoing1).String())
+	assert.Empty(t, outgoing2)
+}
+
+func TestPulishCommand_RoomSettings_SettingsEnforced(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	hub.ConfigureRoom("room1", RoomSettings{MaxMessageLength: 2})
+	hub.ConfigureRoom("room2", RoomSettings{ReadOnly: true})
+	outgoing := make(chan message, 1)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1", outgoing: outgoing})
+	hub.SubscribeToRoom("id1", "room2", subscriber{nick: "nick1", outgoing: outgoing})
+
+	cmd := NewPublishCommand(hub, 254)
+
+	cmd.Handle("id1", "room1|mmm", outgoing)
+	assert.Equal(t, errorMsg(codeTooLong, "Message is too long."), <-outgoing)
+
+	cmd.Handle("id1", "room2|mmm", outgoing)
+	assert.Equal(t, errorMsg(codeReadOnly, "Room room2 is read-only."), <-outgoing)
+	assert.Empty(t, hub.getRoomHistory("room2"))
 }
 
 func TestPulishCommand_MessagePublished_RoomHistoryAppended(t *testing.T) {
@@ -204,11 +328,758 @@ func TestPulishCommand_MessagePublished_RoomHistoryAppended(t *testing.T) {
 	hub.CreateRoom("room2")
 	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1", outgoing: make(chan message)})
 	hub.SubscribeToRoom("id1", "room2", subscriber{nick: "nick1", outgoing: make(chan message)})
-	expectedItem := historyItem{nick: "nick1", msg: "msg1"}
 
 	cmd := NewPublishCommand(hub, 254)
 	cmd.Handle("id1", "room1|msg1", make(chan message))
 
-	assert.Equal(t, expectedItem, hub.rooms["room1"].history.Prev().Value)
+	item := hub.rooms["room1"].history.Prev().Value.(historyItem)
+	assert.Equal(t, "nick1", item.nick)
+	assert.Equal(t, "msg1", item.msg)
 	assert.Nil(t, hub.rooms["room2"].history.Value)
 }
+
+func TestCreateCommand_CorrectArgs_RoomCreated(t *testing.T) {
+	hub := NewHub(128)
+	outgoing := make(chan message, 1)
+
+	cmd := NewCreateCommand(hub)
+	cmd.Handle("id1", "room1", outgoing)
+
+	assert.Contains(t, hub.rooms, "room1")
+	assert.Equal(t, "Room room1 created.", (<-outgoing).String())
+}
+
+func TestCreateCommand_DuplicateRoom_ErrorToOutgoing(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	outgoing := make(chan message, 1)
+
+	cmd := NewCreateCommand(hub)
+	cmd.Handle("id1", "room1", outgoing)
+
+	assert.Equal(t, "Attempt to create duplicate room: room1.", (<-outgoing).String())
+}
+
+func TestCreateCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
+	testCases := []struct {
+		args  string
+		reply string
+	}{
+		{args: "", reply: "Room name is missing."},
+		{args: "room:1", reply: "Room name may contain only letters, digits, '-', '_' and '.'."},
+		{args: "room|1", reply: "Room name may contain only letters, digits, '-', '_' and '.'."},
+		{args: "room 1", reply: "Room name may contain only letters, digits, '-', '_' and '.'."},
+		{args: "комната", reply: "Room name may contain only letters, digits, '-', '_' and '.'."},
+		{args: strings.Repeat("r", 33), reply: "Room name is too long."},
+	}
+
+	for _, testCase := range testCases {
+		hub := NewHub(128)
+		outgoing := make(chan message, 1)
+
+		cmd := NewCreateCommand(hub)
+		cmd.Handle("id1", testCase.args, outgoing)
+
+		assert.Len(t, outgoing, 1)
+		assert.Contains(t, (<-outgoing).String(), testCase.reply)
+		assert.Empty(t, hub.rooms)
+	}
+}
+
+func TestCreateCommand_TooManyRoomsOfOperator_ErrorToOutgoing(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("configured")
+	hub.ConfigureRoom("configured", RoomSettings{})
+	hub.addOperator("configured", "id1")
+	outgoing := make(chan message, 10)
+
+	cmd := NewCreateCommand(hub)
+	for i := 1; i <= 6; i++ {
+		cmd.Handle("id1", fmt.Sprintf("room%d", i), outgoing)
+	}
+	cmd.Handle("id2", "room7", outgoing)
+
+	assert.Len(t, hub.rooms, 7)
+	assert.NotContains(t, hub.rooms, "room6")
+	for i := 0; i < 5; i++ {
+		<-outgoing
+	}
+	assert.Equal(t, errorMsg(codeTooManyRooms, "You can't operate more than 5 rooms."), <-outgoing)
+	assert.Equal(t, "Room room7 created.", (<-outgoing).String())
+}
+
+func TestCreateCommand_TooManyRooms_ErrorToOutgoing(t *testing.T) {
+	hub := NewHub(128)
+	for i := 0; i < maxCreatedRooms; i++ {
+		hub.CreateRoom(fmt.Sprintf("room%d", i))
+	}
+	outgoing := make(chan message, 1)
+
+	cmd := NewCreateCommand(hub)
+	cmd.Handle("id1", "room", outgoing)
+
+	assert.NotContains(t, hub.rooms, "room")
+	assert.Equal(t, errorMsg(codeTooManyRooms, "Too many rooms on server."), <-outgoing)
+}
+
+func TestDeleteCommand_CorrectArgs_RoomDeletedMembersNotified(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	outgoing1 := make(chan message, 1)
+	outgoing2 := make(chan message, 1)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1", outgoing: outgoing1})
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: outgoing2})
+	hub.addOperator("room1", "id1")
+
+	cmd := NewDeleteCommand(hub)
+	cmd.Handle("id1", "room1", outgoing1)
+
+	assert.NotContains(t, hub.rooms, "room1")
+	assert.Contains(t, hub.rooms, "room2")
+	assert.Equal(t, "Room room1 deleted.", (<-outgoing1).String())
+	assert.Equal(t, "Room room1 was deleted.", (<-outgoing2).String())
+}
+
+func TestDeleteCommand_UnknownRoom_ErrorToOutgoing(t *testing.T) {
+	testCases := []struct {
+		args  string
+		reply string
+	}{
+		{args: "", reply: "Room name is missing."},
+		{args: "room2", reply: "You are not an operator of room2."},
+	}
+
+	for _, testCase := range testCases {
+		hub := NewHub(128)
+		hub.CreateRoom("room1")
+		outgoing := make(chan message, 1)
+
+		cmd := NewDeleteCommand(hub)
+		cmd.Handle("id1", testCase.args, outgoing)
+
+		assert.Len(t, outgoing, 1)
+		assert.Contains(t, (<-outgoing).String(), testCase.reply)
+		assert.Contains(t, hub.rooms, "room1")
+	}
+}
+
+func TestDeleteCommand_NotOperator_RoomKept(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	hub.ConfigureRoom("room2", RoomSettings{})
+	hub.addOperator("room1", "@user1")
+	hub.addOperator("room2", "@user2")
+	outgoing1 := make(chan message, 1)
+	outgoing2 := make(chan message, 1)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1", outgoing: outgoing1})
+
+	cmd := NewDeleteCommand(hub)
+	cmd.Handle("id1", "room1", outgoing1)
+	cmd.Handle("@user2", "room2", outgoing2)
+
+	assert.Contains(t, hub.rooms, "room1")
+	assert.Contains(t, hub.rooms, "room2")
+	assert.Equal(t, errorMsg(codeNotOperator, "You are not an operator of room1."), <-outgoing1)
+	assert.Equal(t, errorMsg(codeRoomConfigured, "Room room2 is configured and can't be deleted."), <-outgoing2)
+}
+
+func TestPulishCommand_GivenStore_HistoryAppendedToStore(t *testing.T) {
+	store := &testStore{Hub: NewHub(128), appendErr: errors.New("disk is full")}
+	store.CreateRoom("room1")
+	store.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+
+	cmd := NewPublishCommand(store, 254)
+	cmd.Handle("id1", "room1|msg1", make(chan message))
+
+	assert.Len(t, store.appended, 1)
+	assert.Equal(t, "msg1", store.appended[0].msg)
+	assert.Empty(t, store.getRoomHistory("room1"))
+}
+
+func TestWhisperCommand_CorrectArgs_DeliveredToTargetOnly(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	outgoing1 := make(chan message, 1)
+	outgoing2 := make(chan message, 1)
+	outgoing3 := make(chan message, 1)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1", outgoing: outgoing1})
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: outgoing2})
+	hub.SubscribeToRoom("id3", "room2", subscriber{nick: "nick3", outgoing: outgoing3})
+
+	cmd := NewWhisperCommand(hub, 254)
+	cmd.Handle("id1", "NICK3|msg1", outgoing1)
+
+	assert.Empty(t, outgoing1)
+	assert.Empty(t, outgoing2)
+	assert.Equal(t, privateMsg("nick1", "msg1"), <-outgoing3)
+	assert.Empty(t, hub.getRoomHistory("room1"))
+	assert.Empty(t, hub.getRoomHistory("room2"))
+}
+
+func TestWhisperCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
+	testCases := []struct {
+		user  identity
+		args  string
+		reply string
+	}{
+		{user: "id1", args: "", reply: "Target nick is missing."},
+		{user: "id1", args: "|msg1", reply: "Target nick is missing."},
+		{user: "id1", args: "nick2", reply: "Message is empty."},
+		{user: "id1", args: "nick2| ", reply: "Message is empty."},
+		{user: "id1", args: "nick2|mmmmm", reply: "Message is too long."},
+		{user: "id1", args: "nick3|msg1", reply: "No such user: nick3."},
+		{user: "id3", args: "nick2|msg1", reply: "Join a room to send private messages."},
+	}
+
+	for _, testCase := range testCases {
+		hub := NewHub(128)
+		hub.CreateRoom("room1")
+		hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+		hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2"})
+		outgoing := make(chan message, 1)
+
+		cmd := NewWhisperCommand(hub, 4)
+		cmd.Handle(testCase.user, testCase.args, outgoing)
+
+		assert.Len(t, outgoing, 1)
+		assert.Equal(t, testCase.reply, (<-outgoing).String())
+	}
+}
+
+func TestLeaveCommand_CorrectArgs_UserLeftMembersNotified(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	outgoing1 := make(chan message, 1)
+	outgoing2 := make(chan message, 1)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1", outgoing: outgoing1})
+	hub.SubscribeToRoom("id1", "room2", subscriber{nick: "nick1", outgoing: outgoing1})
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: outgoing2})
+
+	cmd := NewLeaveCommand(hub)
+	cmd.Handle("id1", "room1", outgoing1)
+
+	assert.NotContains(t, hub.getSubscribers("room1"), identity("id1"))
+	assert.Contains(t, hub.getSubscribers("room1"), identity("id2"))
+	assert.Contains(t, hub.getSubscribers("room2"), identity("id1"))
+	assert.Equal(t, "You left room1.", (<-outgoing1).String())
+	assert.Equal(t, presenceMsg("nick1", "room1", "nick1 left room1."), <-outgoing2)
+}
+
+func TestLeaveCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
+	testCases := []struct {
+		args  string
+		reply string
+	}{
+		{args: "", reply: "Room name is missing."},
+		{args: "room2", reply: "You are not subscribed to room2."},
+		{args: "room3", reply: "You are not subscribed to room3."},
+	}
+
+	for _, testCase := range testCases {
+		hub := NewHub(128)
+		hub.CreateRoom("room1")
+		hub.CreateRoom("room2")
+		hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+		outgoing := make(chan message, 1)
+
+		cmd := NewLeaveCommand(hub)
+		cmd.Handle("id1", testCase.args, outgoing)
+
+		assert.Len(t, outgoing, 1)
+		assert.Equal(t, testCase.reply, (<-outgoing).String())
+		assert.Contains(t, hub.getSubscribers("room1"), identity("id1"))
+	}
+}
+
+func TestSubscribeCommand_CorrectArgs_MembersNotified(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	outgoing2 := make(chan message, 1)
+	outgoing3 := make(chan message, 1)
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: outgoing2})
+	hub.SubscribeToRoom("id3", "room2", subscriber{nick: "nick3", outgoing: outgoing3})
+
+	cmd := NewSubscribeCommand(hub)
+	cmd.Handle("id1", "room1:nick1", make(chan message))
+
+	assert.Equal(t, presenceMsg("nick1", "room1", "nick1 joined room1."), <-outgoing2)
+	assert.Empty(t, outgoing3)
+}
+
+func TestHistoryCommand_BeforeGiven_PageToOutgoing(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+	for i := uint64(1); i <= 5; i++ {
+		hub.AppendRoomHistory("room1", historyItem{id: i, nick: "nick2", msg: fmt.Sprint("msg", i)})
+	}
+	outgoing := make(chan message, 16)
+
+	cmd := NewHistoryCommand(hub)
+	cmd.Handle("id1", "room1|before=4|limit=2", outgoing)
+	cmd.Handle("id1", "room1|limit=2|before=2", outgoing)
+	cmd.Handle("id1", "room1", outgoing)
+
+	assert.Equal(t, historyMsg("room1", historyItem{id: 2, nick: "nick2", msg: "msg2"}), <-outgoing)
+	assert.Equal(t, historyMsg("room1", historyItem{id: 3, nick: "nick2", msg: "msg3"}), <-outgoing)
+	assert.Equal(t, historyMsg("room1", historyItem{id: 1, nick: "nick2", msg: "msg1"}), <-outgoing)
+	assert.Equal(t, noticeMsg("No earlier messages in room1."), <-outgoing)
+	for i := uint64(1); i <= 5; i++ {
+		assert.Equal(t, i, (<-outgoing).msgID)
+	}
+	assert.Equal(t, noticeMsg("No earlier messages in room1."), <-outgoing)
+}
+
+func TestHistoryCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
+	testCases := []struct {
+		args  string
+		reply string
+	}{
+		{args: "", reply: "Room name is missing."},
+		{args: "room1|before=x", reply: "Invalid option: before=x."},
+		{args: "room1|limit=0", reply: "Invalid option: limit=0."},
+		{args: "room1|limit=101", reply: "Invalid option: limit=101."},
+		{args: "room1|after=1", reply: "Invalid option: after=1."},
+		{args: "room2", reply: "You are not subscribed to room2."},
+	}
+
+	for _, testCase := range testCases {
+		hub := NewHub(128)
+		hub.CreateRoom("room1")
+		hub.CreateRoom("room2")
+		hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+		outgoing := make(chan message, 1)
+
+		NewHistoryCommand(hub).Handle("id1", testCase.args, outgoing)
+
+		assert.Equal(t, testCase.reply, (<-outgoing).text)
+	}
+}
+
+func TestSearchCommand_QueryGiven_ResultsToOutgoing(t *testing.T) {
+	at := time.Date(2026, 10, 17, 7, 0, 0, 0, time.UTC)
+	hub := NewHub(2)
+	hub.CreateRoom("room1")
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+	hub.AppendRoomHistory("room1", historyItem{id: 1, time: at, nick: "nick2", msg: "deploy"})
+	hub.AppendRoomHistory("room1", historyItem{id: 2, time: at, nick: "nick2", msg: "Deploy done"})
+	hub.AppendRoomHistory("room1", historyItem{id: 3, time: at, nick: "nick3", msg: "deploy"})
+	outgoing := make(chan message, 8)
+
+	cmd := NewSearchCommand(hub)
+	cmd.Handle("id1", "room1|DEPLOY", outgoing)
+	cmd.Handle("id1", "room1|deploy|nick=nick2", outgoing)
+	cmd.Handle("id1", "room1|deploy|to=2026-10-17T06:00:00Z", outgoing)
+
+	assert.Equal(t, resultMsg("room1", historyItem{id: 3, time: at, nick: "nick3", msg: "deploy"}), <-outgoing)
+	assert.Equal(t, "Found: [2 2026-10-17T07:00:00Z] nick2@room1: Deploy done", (<-outgoing).String())
+	assert.Equal(t, uint64(2), (<-outgoing).msgID)
+	assert.Equal(t, noticeMsg("No messages in room1 match the query."), <-outgoing)
+}
+
+func TestSearchCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
+	testCases := []struct {
+		args  string
+		reply string
+	}{
+		{args: "", reply: "Room name is missing."},
+		{args: "room1", reply: "Search query is missing."},
+		{args: "room1|?!", reply: "Search query is missing."},
+		{args: "room1|msg|from=today", reply: "Invalid option: from=today."},
+		{args: "room1|msg|limit=101", reply: "Invalid option: limit=101."},
+		{args: "room1|msg|sort=time", reply: "Invalid option: sort=time."},
+		{args: "room2|msg", reply: "You are not subscribed to room2."},
+	}
+
+	for _, testCase := range testCases {
+		hub := NewHub(128)
+		hub.CreateRoom("room1")
+		hub.CreateRoom("room2")
+		hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+		outgoing := make(chan message, 1)
+
+		NewSearchCommand(hub).Handle("id1", testCase.args, outgoing)
+
+		assert.Equal(t, testCase.reply, (<-outgoing).text)
+	}
+}
+
+func TestWhoCommand_RoomExists_NicksToOutgoing(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2"})
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+	outgoing := make(chan message, 2)
+
+	cmd := NewWhoCommand(hub)
+	cmd.Handle("id3", "room1", outgoing)
+	cmd.Handle("id3", "room2", outgoing)
+
+	assert.Equal(t, membersMsg("room1", []string{"nick1", "nick2"}), <-outgoing)
+	assert.Equal(t, "Members of room1: nick1, nick2.", membersMsg("room1", []string{"nick1", "nick2"}).String())
+	assert.Equal(t, membersMsg("room2", []string{}), <-outgoing)
+}
+
+func TestWhoCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
+	testCases := []struct {
+		args  string
+		reply string
+	}{
+		{args: "", reply: "Room name is missing."},
+		{args: "room2", reply: "Unknown room: room2."},
+	}
+
+	for _, testCase := range testCases {
+		hub := NewHub(128)
+		hub.CreateRoom("room1")
+		outgoing := make(chan message, 1)
+
+		cmd := NewWhoCommand(hub)
+		cmd.Handle("id1", testCase.args, outgoing)
+
+		assert.Equal(t, testCase.reply, (<-outgoing).String())
+	}
+}
+
+func TestDisconnector_GivenUser_UnsubscribedMembersNotified(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	hub.CreateRoom("room3")
+	outgoing2 := make(chan message, 2)
+	outgoing3 := make(chan message, 1)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+	hub.SubscribeToRoom("id1", "room2", subscriber{nick: "nick11"})
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: outgoing2})
+	hub.SubscribeToRoom("id2", "room2", subscriber{nick: "nick2", outgoing: outgoing2})
+	hub.SubscribeToRoom("id3", "room3", subscriber{nick: "nick3", outgoing: outgoing3})
+
+	d := NewDisconnector(hub)
+	d.Unsubscribe("id1")
+
+	assert.NotContains(t, hub.getSubscribers("room1"), identity("id1"))
+	assert.NotContains(t, hub.getSubscribers("room2"), identity("id1"))
+	notices := []message{<-outgoing2, <-outgoing2}
+	assert.Contains(t, notices, presenceMsg("nick1", "room1", "nick1 disconnected."))
+	assert.Contains(t, notices, presenceMsg("nick11", "room2", "nick11 disconnected."))
+	assert.Empty(t, outgoing3)
+}
+
+func TestRetireRoom_RoomExists_MembersNotifiedRoomDeleted(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	outgoing := make(chan message, 1)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1", outgoing: outgoing})
+
+	err := RetireRoom(hub, "room1")
+
+	assert.NoError(t, err)
+	assert.NotContains(t, hub.rooms, "room1")
+	assert.Equal(t, "Room room1 was closed.", (<-outgoing).String())
+	assert.Error(t, RetireRoom(hub, "room1"))
+}
+
+func TestTopicCommand_TopicGiven_TopicSetMembersNotified(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	outgoing1 := make(chan message, 1)
+	outgoing2 := make(chan message, 1)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1", outgoing: outgoing1})
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: outgoing2})
+
+	cmd := NewTopicCommand(hub)
+	cmd.Handle("id1", "room1|topic|1", outgoing1)
+
+	topic, _ := hub.Topic("room1")
+	assert.Equal(t, "topic|1", topic)
+	assert.Equal(t, topicMsg("nick1", "room1", "topic|1"), <-outgoing1)
+	assert.Equal(t, topicMsg("nick1", "room1", "topic|1"), <-outgoing2)
+}
+
+func TestTopicCommand_NoTopicGiven_TopicToOutgoing(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.SetTopic("room1", "topic1")
+	outgoing := make(chan message, 1)
+
+	cmd := NewTopicCommand(hub)
+	cmd.Handle("id1", "room1", outgoing)
+
+	assert.Equal(t, topicMsg("", "room1", "topic1"), <-outgoing)
+}
+
+func TestTopicCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
+	testCases := []struct {
+		args  string
+		reply string
+	}{
+		{args: "", reply: "Room name is missing."},
+		{args: "room2", reply: "Unknown room: room2."},
+		{args: "room1|topic1", reply: "You are not subscribed to room1."},
+		{args: "room2|topic1", reply: "You are not subscribed to room2."},
+		{args: "room3|" + strings.Repeat("t", 255), reply: "Topic is too long."},
+	}
+
+	for _, testCase := range testCases {
+		hub := NewHub(128)
+		hub.CreateRoom("room1")
+		hub.CreateRoom("room3")
+		hub.SubscribeToRoom("id1", "room3", subscriber{nick: "nick1"})
+		outgoing := make(chan message, 1)
+
+		cmd := NewTopicCommand(hub)
+		cmd.Handle("id1", testCase.args, outgoing)
+
+		assert.Equal(t, testCase.reply, (<-outgoing).String())
+		topic, _ := hub.Topic("room3")
+		assert.Empty(t, topic)
+	}
+}
+
+func TestKickCommand_Operator_MemberRemovedWithReason(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.SetOperators("room1", []string{"op"})
+	outgoing1 := make(chan message, 2)
+	outgoing2 := make(chan message, 1)
+	hub.SubscribeToRoom("@op", "room1", subscriber{nick: "nick1", outgoing: outgoing1})
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: outgoing2})
+
+	cmd := NewKickCommand(hub)
+	cmd.Handle("@op", "room1|NICK2|spam", outgoing1)
+
+	assert.Equal(t, "You were kicked from room1 by nick1: spam", (<-outgoing2).String())
+	assert.Equal(t, "* nick2 was kicked by nick1: spam", (<-outgoing1).String())
+	assert.Equal(t, "You kicked NICK2 from room1.", (<-outgoing1).String())
+	assert.NotContains(t, hub.getSubscribers("room1"), identity("id2"))
+}
+
+func TestKickCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
+	testCases := []struct {
+		args  string
+		reply string
+	}{
+		{args: "", reply: "Room name is missing."},
+		{args: "room2|nick2", reply: "You are not an operator of room2."},
+		{args: "room1", reply: "Nick is missing."},
+		{args: "room1|nick3", reply: "No such user in room1: nick3."},
+	}
+
+	for _, testCase := range testCases {
+		hub := NewHub(128)
+		hub.CreateRoom("room1")
+		hub.CreateRoom("room2")
+		hub.SetOperators("room1", []string{"op"})
+		hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2"})
+		hub.SubscribeToRoom("id2", "room2", subscriber{nick: "nick2"})
+		outgoing := make(chan message, 1)
+
+		cmd := NewKickCommand(hub)
+		cmd.Handle("@op", testCase.args, outgoing)
+
+		assert.Equal(t, testCase.reply, (<-outgoing).String())
+		assert.Len(t, hub.getSubscribers("room1"), 1)
+	}
+}
+
+func TestBanCommand_Member_KickedAndCantRejoin(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.SetOperators("room1", []string{"op"})
+	outgoing := make(chan message, 2)
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: outgoing})
+
+	cmd := NewBanCommand(hub)
+	cmd.Handle("@op", "room1|nick2", outgoing)
+
+	assert.Equal(t, "You were kicked from room1 by op.", (<-outgoing).String())
+	assert.Equal(t, "You banned nick2 from room1.", (<-outgoing).String())
+	err := hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick3"})
+	assert.EqualError(t, err, "You are banned from room1")
+	err = hub.SubscribeToRoom("id3", "room1", subscriber{nick: "Nick2"})
+	assert.EqualError(t, err, "You are banned from room1")
+}
+
+func TestBanCommand_Identity_IdentityBanned(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.SetOperators("room1", []string{"op"})
+	outgoing := make(chan message, 1)
+
+	cmd := NewBanCommand(hub)
+	cmd.Handle("@op", "room1|@user1", outgoing)
+
+	assert.Equal(t, "You banned @user1 from room1.", (<-outgoing).String())
+	assert.Error(t, hub.SubscribeToRoom(accountIdentity("user1"), "room1", subscriber{nick: "nick1"}))
+	assert.NoError(t, hub.SubscribeToRoom("id2", "room1", subscriber{nick: "user1"}))
+}
+
+func TestBanCommand_NotOperator_ErrorToOutgoing(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	outgoing := make(chan message, 1)
+
+	cmd := NewBanCommand(hub)
+	cmd.Handle("id1", "room1|nick2", outgoing)
+
+	assert.Equal(t, errorMsg(codeNotOperator, "You are not an operator of room1."), <-outgoing)
+	assert.NoError(t, hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2"}))
+}
+
+func TestMuteCommand_Muted_PublishRejectedUntilUnmuted(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.SetOperators("room1", []string{"op"})
+	outgoing := make(chan message, 2)
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: outgoing})
+	mute := NewMuteCommand(hub)
+	publish := NewPublishCommand(hub, 254)
+
+	mute.Handle("@op", "room1|nick2|10m", outgoing)
+	assert.Equal(t, "You are muted in room1 for 10m0s by op.", (<-outgoing).String())
+	assert.Equal(t, "nick2 is muted in room1 for 10m0s.", (<-outgoing).String())
+	publish.Handle("id2", "room1|msg1", outgoing)
+	reply := <-outgoing
+	assert.Equal(t, codeMuted, reply.code)
+	assert.Equal(t, "You are muted in room1 for 10m0s.", reply.text)
+
+	mute.Handle("@op", "room1|nick2|0", outgoing)
+	assert.Equal(t, "You are no longer muted in room1.", (<-outgoing).String())
+	assert.Equal(t, "nick2 is no longer muted in room1.", (<-outgoing).String())
+	publish.Handle("id2", "room1|msg1", outgoing)
+	assert.Len(t, hub.getRoomHistory("room1"), 1)
+}
+
+func TestMuteCommand_InvalidArgs_ErrorToOutgoing(t *testing.T) {
+	testCases := []struct {
+		args  string
+		reply string
+	}{
+		{args: "room1|nick2", reply: "Duration is missing."},
+		{args: "room1|nick2|forever", reply: "Invalid duration: forever."},
+		{args: "room1|nick2|-1m", reply: "Invalid duration: -1m."},
+		{args: "room1|nick3|1m", reply: "No such user in room1: nick3."},
+	}
+
+	for _, testCase := range testCases {
+		hub := NewHub(128)
+		hub.CreateRoom("room1")
+		hub.SetOperators("room1", []string{"op"})
+		hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2"})
+		outgoing := make(chan message, 1)
+
+		cmd := NewMuteCommand(hub)
+		cmd.Handle("@op", testCase.args, outgoing)
+
+		assert.Equal(t, testCase.reply, (<-outgoing).String())
+		assert.True(t, hub.mutedUntil("room1", "id2").IsZero())
+	}
+}
+
+func TestCreateCommand_RoomCreated_CreatorIsOperator(t *testing.T) {
+	hub := NewHub(128)
+	outgoing := make(chan message, 1)
+
+	cmd := NewCreateCommand(hub)
+	cmd.Handle("id1", "room1", outgoing)
+
+	assert.True(t, hub.isOperator("room1", "id1"))
+	assert.False(t, hub.isOperator("room1", "id2"))
+}
+
+func TestPublishCommand_Published_IDsIncreaseTimeUTC(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	outgoing := make(chan message, 2)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: outgoing})
+
+	cmd := NewPublishCommand(hub, 254)
+	cmd.Handle("id1", "room1|msg1", make(chan message))
+	cmd.Handle("id1", "room1|msg2", make(chan message))
+
+	m1, m2 := <-outgoing, <-outgoing
+	assert.True(t, m2.msgID > m1.msgID)
+	assert.Equal(t, time.UTC, m1.time.Location())
+	history := hub.getRoomHistory("room1")
+	assert.Equal(t, m1.msgID, history[0].id)
+	assert.Equal(t, m2.time, history[1].time)
+}
+
+func TestSubscribeCommand_SinceID_NewerHistoryToOutgoing(t *testing.T) {
+	hub := NewHub(3)
+	hub.CreateRoom("room1")
+	for i := 1; i <= 3; i++ {
+		hub.AppendRoomHistory("room1", historyItem{id: uint64(i), nick: "nick8", msg: fmt.Sprint("msg", i)})
+	}
+	outgoing := make(chan message, 3)
+
+	cmd := NewSubscribeCommand(hub)
+	cmd.Handle("id1", "room1:nick1:since=1", outgoing)
+
+	assert.Equal(t, "msg2", (<-outgoing).text)
+	assert.Equal(t, "msg3", (<-outgoing).text)
+	assert.Len(t, outgoing, 0)
+}
+
+func TestSubscribeCommand_SinceEvicted_GapReported(t *testing.T) {
+	hub := NewHub(2)
+	hub.CreateRoom("room1")
+	for i := 1; i <= 4; i++ {
+		hub.AppendRoomHistory("room1", historyItem{id: uint64(i), nick: "nick8", msg: fmt.Sprint("msg", i)})
+	}
+	outgoing := make(chan message, 3)
+
+	cmd := NewSubscribeCommand(hub)
+	cmd.Handle("id1", "room1:nick1:since=1", outgoing)
+
+	assert.Equal(t, gapMsg("room1"), <-outgoing)
+	assert.Equal(t, "msg3", (<-outgoing).text)
+	assert.Equal(t, "msg4", (<-outgoing).text)
+
+	cmd.Handle("id2", "room1:nick2:since=2", outgoing)
+	assert.Equal(t, "msg3", (<-outgoing).text)
+}
+
+func TestSubscribeCommand_SinceTime_NewerHistoryToOutgoing(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	at := time.Date(2026, 10, 17, 7, 0, 0, 0, time.UTC)
+	hub.AppendRoomHistory("room1", historyItem{id: 1, time: at, nick: "nick8", msg: "msg1"})
+	hub.AppendRoomHistory("room1", historyItem{id: 2, time: at.Add(time.Minute), nick: "nick8", msg: "msg2"})
+	outgoing := make(chan message, 2)
+
+	cmd := NewSubscribeCommand(hub)
+	cmd.Handle("id1", "room1:nick:1:since=2026-10-17T07:00:00Z", outgoing)
+
+	assert.Equal(t, "msg2", (<-outgoing).text)
+	assert.Equal(t, "nick:1", hub.getSubscribers("room1")["id1"].nick)
+}
+
+func TestSubscribeCommand_InvalidSince_ErrorToOutgoing(t *testing.T) {
+	testCases := []struct {
+		args  string
+		reply string
+	}{
+		{args: "room1:nick1:since=yesterday", reply: "Invalid since value for room1."},
+		{args: "room1::since=1", reply: "Nickname for room1 is missing."},
+	}
+
+	for _, testCase := range testCases {
+		hub := NewHub(128)
+		hub.CreateRoom("room1")
+		outgoing := make(chan message, 1)
+
+		cmd := NewSubscribeCommand(hub)
+		cmd.Handle("id1", testCase.args, outgoing)
+
+		assert.Equal(t, testCase.reply, (<-outgoing).String())
+		assert.Empty(t, hub.getSubscribers("room1"))
+	}
+}
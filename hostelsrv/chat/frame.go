@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"time"
+)
+
+// DefaultFrameSize is the maximum length of request line
+// unless configured otherwise.
+const DefaultFrameSize = 64 << 10
+
+// deadlineClient is implemented by clients which support
+// timeouts, e.g. net.Conn.
+type deadlineClient interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// frameReader reads requests of client line by line. Lines longer than
+// the limit are skipped, so that client can go on after sending one.
+type frameReader struct {
+	br          *bufio.Reader
+	maxSize     int
+	conn        deadlineClient
+	idleTimeout time.Duration
+	readTimeout time.Duration
+}
+
+func newFrameReader(cl Client, maxSize int) *frameReader {
+	fr := &frameReader{
+		// Line ending doesn't count towards the limit.
+		br:      bufio.NewReaderSize(cl, maxSize+2),
+		maxSize: maxSize,
+	}
+	fr.conn, _ = cl.(deadlineClient)
+	return fr
+}
+
+// next returns the next line without line ending. Idle timeout limits
+// time of waiting for the line to start and read timeout limits time
+// of reading it. When line is too long, it's skipped and error with
+// codeTooLong is returned.
+func (fr *frameReader) next() (string, error) {
+	fr.setDeadline(fr.idleTimeout)
+	if _, err := fr.br.Peek(1); err != nil {
+		return "", err
+	}
+	if fr.readTimeout > 0 {
+		fr.setDeadline(fr.readTimeout)
+	}
+	line, err := fr.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = fr.br.ReadSlice('\n')
+		}
+		if err == nil || err == io.EOF {
+			err = newError(codeTooLong, "Request exceeds %d bytes", fr.maxSize)
+		}
+		return "", err
+	}
+	// The last line may be not terminated.
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", err
+	}
+	line = bytes.TrimSuffix(line, []byte{'\n'})
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	if len(line) > fr.maxSize {
+		return "", newError(codeTooLong, "Request exceeds %d bytes", fr.maxSize)
+	}
+	return string(line), nil
+}
+
+func (fr *frameReader) setDeadline(timeout time.Duration) {
+	if fr.conn == nil {
+		return
+	}
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	fr.conn.SetReadDeadline(t)
+}
@@ -0,0 +1,45 @@
+package chat
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type readerClient struct {
+	io.Reader
+	io.Writer
+}
+
+func (cl readerClient) Close() error {
+	return nil
+}
+
+func TestFrameReader_LineTooLong_SkippedNextRead(t *testing.T) {
+	cl := readerClient{Reader: strings.NewReader(strings.Repeat("x", 40) + "\nline2\r\nline3")}
+	fr := newFrameReader(cl, 20)
+
+	_, err := fr.next()
+	assert.EqualError(t, err, "Request exceeds 20 bytes")
+	line, err := fr.next()
+	assert.NoError(t, err)
+	assert.Equal(t, "line2", line)
+	line, err = fr.next()
+	assert.NoError(t, err)
+	assert.Equal(t, "line3", line)
+	_, err = fr.next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFrameReader_LineOfMaxSize_Read(t *testing.T) {
+	cl := readerClient{Reader: strings.NewReader(strings.Repeat("x", 20) + "\r\n" + strings.Repeat("y", 21) + "\n")}
+	fr := newFrameReader(cl, 20)
+
+	line, err := fr.next()
+	assert.NoError(t, err)
+	assert.Len(t, line, 20)
+	_, err = fr.next()
+	assert.Error(t, err)
+}
@@ -0,0 +1,538 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryStore defines storage of rooms history which
+// outlives the hub, e.g. survives server restart.
+type HistoryStore interface {
+	// Append adds item to the end of room history.
+	Append(roomName string, item historyItem) error
+	// Load returns at most limit of the latest items of room history
+	// in chronological order.
+	Load(roomName string, limit int) ([]historyItem, error)
+	// LoadBefore is Load of items which IDs are less than beforeID.
+	LoadBefore(roomName string, beforeID uint64, limit int) ([]historyItem, error)
+	// Drop removes the whole history of room.
+	Drop(roomName string) error
+	// SetLimit changes number of the latest items retained per room.
+	SetLimit(limit int)
+	// Limit returns number of the latest items retained per room.
+	Limit() int
+	// LastID returns the largest ID of items ever appended, so that
+	// IDs are not reused after restart.
+	LastID() uint64
+	// Close releases resources held by store.
+	Close() error
+}
+
+const (
+	logSegmentExt     = ".log"
+	logSegmentMaxSize = 4 << 20
+	logMaxSegments    = 8
+)
+
+// LogHistory is HistoryStore backed by append-only log split into
+// segment files. Log keeps only a limited number of items per room,
+// older ones are discarded when log is compacted. Log is compacted in
+// background when it grows, so that appending doesn't wait for it.
+type LogHistory struct {
+	dir         string
+	keep        int
+	segments    map[int]*os.File
+	active      int
+	size        int64
+	index       map[string][]logRef
+	lastID      uint64
+	closed      bool
+	mu          sync.Mutex
+	compactions chan struct{}
+	compactor   chan struct{}
+	cm          sync.Mutex
+}
+
+type logRecord struct {
+	// Reset tells that all records before this one are obsolete.
+	Reset bool   `json:"reset,omitempty"`
+	Drop  bool   `json:"drop,omitempty"`
+	Room  string `json:"room,omitempty"`
+	Nick  string `json:"nick,omitempty"`
+	Msg   string `json:"msg,omitempty"`
+	// ID is ID of item, reset record keeps the last ID of compacted log.
+	ID   uint64 `json:"id,omitempty"`
+	Time string `json:"time,omitempty"`
+}
+
+func itemRecord(roomName string, item historyItem) logRecord {
+	rec := logRecord{Room: roomName, Nick: item.nick, Msg: item.msg, ID: item.id}
+	if !item.time.IsZero() {
+		rec.Time = item.time.Format(time.RFC3339Nano)
+	}
+	return rec
+}
+
+func (rec logRecord) item() historyItem {
+	item := historyItem{id: rec.ID, nick: rec.Nick, msg: rec.Msg}
+	if rec.Time != "" {
+		item.time, _ = time.Parse(time.RFC3339Nano, rec.Time)
+	}
+	return item
+}
+
+type logRef struct {
+	id      uint64
+	segment int
+	offset  int64
+	length  int
+}
+
+// OpenLogHistory opens or creates log in the specified directory,
+// replays and compacts it. At most keep items are retained per room.
+func OpenLogHistory(dir string, keep int) (*LogHistory, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	h := &LogHistory{
+		dir:         dir,
+		keep:        keep,
+		segments:    make(map[int]*os.File),
+		index:       make(map[string][]logRef),
+		compactions: make(chan struct{}, 1),
+		compactor:   make(chan struct{}),
+	}
+	go h.compactInBackground()
+	if err := h.replay(); err != nil {
+		h.Close()
+		return nil, err
+	}
+	if err := h.Compact(); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// compactInBackground compacts log whenever it's requested, until
+// log is closed.
+func (h *LogHistory) compactInBackground() {
+	defer close(h.compactor)
+	for range h.compactions {
+		if err := h.Compact(); err != nil {
+			log.Println("Cannot compact history:", err)
+		}
+	}
+}
+
+func (h *LogHistory) segmentPath(n int) string {
+	return segmentPath(h.dir, n)
+}
+
+func segmentPath(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", n, logSegmentExt))
+}
+
+func (h *LogHistory) listSegments() ([]int, error) {
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for _, f := range files {
+		var n int
+		if !strings.HasSuffix(f.Name(), logSegmentExt) {
+			continue
+		}
+		if _, err := fmt.Sscanf(f.Name(), "%d"+logSegmentExt, &n); err == nil {
+			nums = append(nums, n)
+		}
+	}
+	sort.Ints(nums)
+	return nums, nil
+}
+
+func (h *LogHistory) replay() error {
+	nums, err := h.listSegments()
+	if err != nil {
+		return err
+	}
+	var obsolete []int
+	for _, n := range nums {
+		f, err := os.OpenFile(h.segmentPath(n), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		h.segments[n] = f
+		reset, err := h.replaySegment(n, f)
+		if err != nil {
+			return err
+		}
+		if reset {
+			// Segment was produced by compaction, whatever is before it
+			// is already included, but was not removed due to crash.
+			for prev, prevFile := range h.segments {
+				if prev < n {
+					prevFile.Close()
+					delete(h.segments, prev)
+					obsolete = append(obsolete, prev)
+				}
+			}
+		}
+		h.active = n
+	}
+	for _, n := range obsolete {
+		os.Remove(h.segmentPath(n))
+	}
+	if h.active == 0 {
+		return h.roll()
+	}
+	st, err := h.segments[h.active].Stat()
+	if err != nil {
+		return err
+	}
+	h.size = st.Size()
+	return nil
+}
+
+func (h *LogHistory) replaySegment(n int, f *os.File) (reset bool, err error) {
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var rec logRecord
+			if jerr := json.Unmarshal(line, &rec); jerr != nil {
+				return reset, fmt.Errorf("Corrupted history segment %d at %d: %v", n, offset, jerr)
+			}
+			if rec.ID > h.lastID {
+				h.lastID = rec.ID
+			}
+			switch {
+			case rec.Reset:
+				h.index = make(map[string][]logRef)
+				reset = true
+			case rec.Drop:
+				delete(h.index, rec.Room)
+			default:
+				h.addRef(rec.Room, logRef{id: rec.ID, segment: n, offset: offset, length: len(line)})
+			}
+			offset += int64(len(line))
+		}
+		if err != nil {
+			// Incomplete trailing record is a result of interrupted write,
+			// cut it off so that next records are appended correctly.
+			if len(line) > 0 && line[len(line)-1] != '\n' {
+				return reset, f.Truncate(offset)
+			}
+			return reset, nil
+		}
+	}
+}
+
+// SetLimit changes number of items retained per room. When limit is
+// decreased, older items are discarded by the next compaction.
+func (h *LogHistory) SetLimit(limit int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keep = limit
+	for roomName, refs := range h.index {
+		if len(refs) > limit {
+			h.index[roomName] = append(refs[:0:0], refs[len(refs)-limit:]...)
+		}
+	}
+}
+
+// Limit returns number of items retained per room.
+func (h *LogHistory) Limit() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.keep
+}
+
+// LastID returns the largest ID of items ever appended.
+func (h *LogHistory) LastID() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastID
+}
+
+func (h *LogHistory) addRef(roomName string, ref logRef) {
+	refs := append(h.index[roomName], ref)
+	if len(refs) > h.keep {
+		refs = append(refs[:0:0], refs[len(refs)-h.keep:]...)
+	}
+	h.index[roomName] = refs
+}
+
+func (h *LogHistory) roll() error {
+	n := h.active + 1
+	f, err := os.OpenFile(h.segmentPath(n), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	h.segments[n] = f
+	h.active = n
+	h.size = 0
+	return nil
+}
+
+func (h *LogHistory) write(rec logRecord) (logRef, error) {
+	if h.closed {
+		return logRef{}, os.ErrClosed
+	}
+	if h.size >= logSegmentMaxSize {
+		if err := h.roll(); err != nil {
+			return logRef{}, err
+		}
+		if len(h.segments) > logMaxSegments {
+			select {
+			case h.compactions <- struct{}{}:
+			default:
+			}
+		}
+	}
+	next, err := writeRecord(h.segments[h.active], h.size, rec)
+	if err != nil {
+		return logRef{}, err
+	}
+	ref := logRef{id: rec.ID, segment: h.active, offset: h.size, length: int(next - h.size)}
+	h.size = next
+	return ref, nil
+}
+
+func (h *LogHistory) read(ref logRef) (historyItem, error) {
+	return readRef(h.segments, ref)
+}
+
+func readRef(segments map[int]*os.File, ref logRef) (historyItem, error) {
+	b := make([]byte, ref.length)
+	if _, err := segments[ref.segment].ReadAt(b, ref.offset); err != nil {
+		return historyItem{}, err
+	}
+	var rec logRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return historyItem{}, err
+	}
+	return rec.item(), nil
+}
+
+// Append adds item to the end of room history.
+func (h *LogHistory) Append(roomName string, item historyItem) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ref, err := h.write(itemRecord(roomName, item))
+	if err != nil {
+		return err
+	}
+	h.addRef(roomName, ref)
+	if item.id > h.lastID {
+		h.lastID = item.id
+	}
+	return nil
+}
+
+// Load returns at most limit of the latest items of room history.
+func (h *LogHistory) Load(roomName string, limit int) ([]historyItem, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.readLatest(h.index[roomName], limit)
+}
+
+// LoadBefore returns at most limit of the latest items of room history
+// which IDs are less than beforeID, in chronological order.
+func (h *LogHistory) LoadBefore(roomName string, beforeID uint64, limit int) ([]historyItem, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	refs := h.index[roomName]
+	// Items are appended in order of IDs.
+	n := sort.Search(len(refs), func(i int) bool { return refs[i].id >= beforeID })
+	return h.readLatest(refs[:n], limit)
+}
+
+func (h *LogHistory) readLatest(refs []logRef, limit int) ([]historyItem, error) {
+	if limit < len(refs) {
+		refs = refs[len(refs)-limit:]
+	}
+	items := make([]historyItem, 0, len(refs))
+	for _, ref := range refs {
+		item, err := h.read(ref)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Drop removes the whole history of room.
+func (h *LogHistory) Drop(roomName string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.index[roomName]; !ok {
+		return nil
+	}
+	if _, err := h.write(logRecord{Drop: true, Room: roomName}); err != nil {
+		return err
+	}
+	delete(h.index, roomName)
+	return nil
+}
+
+// Compact rewrites log so that items of each room are stored together
+// and only retained items are kept. Items appended meanwhile go to a new
+// segment, which follows the compacted one.
+func (h *LogHistory) Compact() error {
+	h.cm.Lock()
+	defer h.cm.Unlock()
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return os.ErrClosed
+	}
+	last, n := h.active, h.active+1
+	h.active = n
+	if err := h.roll(); err != nil {
+		h.active = last
+		h.mu.Unlock()
+		return err
+	}
+	lastID := h.lastID
+	index := make(map[string][]logRef, len(h.index))
+	for roomName, refs := range h.index {
+		index[roomName] = refs
+	}
+	segments := make(map[int]*os.File, len(h.segments))
+	for num, f := range h.segments {
+		if num <= last {
+			segments[num] = f
+		}
+	}
+	h.mu.Unlock()
+
+	f, compacted, err := writeCompacted(h.dir, n, lastID, index, segments)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		f.Close()
+		return os.ErrClosed
+	}
+	// Items which were discarded, or rooms which were dropped in the
+	// meantime are not brought back: refs to old segments, which are
+	// the oldest refs of room, are replaced by the same number of
+	// the latest compacted ones.
+	for roomName, refs := range h.index {
+		old := 0
+		for old < len(refs) && refs[old].segment <= last {
+			old++
+		}
+		if old == 0 {
+			continue
+		}
+		merged := compacted[roomName]
+		merged = append(merged[len(merged)-old:len(merged):len(merged)], refs[old:]...)
+		h.index[roomName] = merged
+	}
+	for num, prev := range segments {
+		prev.Close()
+		os.Remove(h.segmentPath(num))
+		delete(h.segments, num)
+	}
+	h.segments[n] = f
+	return nil
+}
+
+// writeCompacted writes retained items of the specified segments to
+// segment n, which starts with reset record, and returns it along with
+// refs to items it contains.
+func writeCompacted(dir string, n int, lastID uint64, index map[string][]logRef,
+	segments map[int]*os.File) (*os.File, map[string][]logRef, error) {
+
+	tmp := filepath.Join(dir, "compact.tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, nil, err
+	}
+	compacted := make(map[string][]logRef, len(index))
+	offset, err := writeRecord(f, 0, logRecord{Reset: true, ID: lastID})
+	for roomName, refs := range index {
+		for _, ref := range refs {
+			if err != nil {
+				break
+			}
+			var item historyItem
+			if item, err = readRef(segments, ref); err != nil {
+				break
+			}
+			var next int64
+			next, err = writeRecord(f, offset, itemRecord(roomName, item))
+			compacted[roomName] = append(compacted[roomName], logRef{
+				id:      item.id,
+				segment: n,
+				offset:  offset,
+				length:  int(next - offset),
+			})
+			offset = next
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, segmentPath(dir, n))
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return nil, nil, err
+	}
+	return f, compacted, nil
+}
+
+func writeRecord(f *os.File, offset int64, rec logRecord) (int64, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return offset, err
+	}
+	b = append(b, '\n')
+	if _, err := f.WriteAt(b, offset); err != nil {
+		return offset, err
+	}
+	return offset + int64(len(b)), nil
+}
+
+// Close stops compaction and closes all segment files.
+func (h *LogHistory) Close() error {
+	h.mu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.compactions)
+	}
+	h.mu.Unlock()
+	<-h.compactor
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var firstErr error
+	for n, f := range h.segments {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(h.segments, n)
+	}
+	return firstErr
+}
@@ -0,0 +1,267 @@
+package chat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempHistoryDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "hostel-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLogHistoryAppend_GivenItems_LoadedInOrder(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	h, err := OpenLogHistory(dir, 128)
+	assert.NoError(t, err)
+	defer h.Close()
+
+	h.Append("room1", historyItem{nick: "nick1", msg: "msg1"})
+	h.Append("room2", historyItem{nick: "nick2", msg: "msg2"})
+	h.Append("room1", historyItem{nick: "nick3", msg: "msg3"})
+
+	items1, err1 := h.Load("room1", 128)
+	items2, err2 := h.Load("room2", 128)
+
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.Equal(t, []historyItem{
+		{nick: "nick1", msg: "msg1"},
+		{nick: "nick3", msg: "msg3"},
+	}, items1)
+	assert.Equal(t, []historyItem{{nick: "nick2", msg: "msg2"}}, items2)
+}
+
+func TestLogHistoryLoad_LimitExceeded_LatestReturned(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	h, _ := OpenLogHistory(dir, 3)
+	defer h.Close()
+
+	for _, msg := range []string{"msg1", "msg2", "msg3", "msg4"} {
+		h.Append("room1", historyItem{nick: "nick1", msg: msg})
+	}
+
+	items, _ := h.Load("room1", 128)
+	assert.Equal(t, []historyItem{
+		{nick: "nick1", msg: "msg2"},
+		{nick: "nick1", msg: "msg3"},
+		{nick: "nick1", msg: "msg4"},
+	}, items)
+
+	items, _ = h.Load("room1", 2)
+	assert.Equal(t, []historyItem{
+		{nick: "nick1", msg: "msg3"},
+		{nick: "nick1", msg: "msg4"},
+	}, items)
+}
+
+func TestLogHistoryLoadBefore_GivenID_LatestBeforeReturned(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	h, _ := OpenLogHistory(dir, 128)
+	defer h.Close()
+	for i := 1; i <= 5; i++ {
+		h.Append("room1", historyItem{id: uint64(i), nick: "nick1", msg: fmt.Sprint("msg", i)})
+	}
+
+	items, err := h.LoadBefore("room1", 4, 2)
+	all, _ := h.LoadBefore("room1", 10, 128)
+	none, _ := h.LoadBefore("room1", 1, 128)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []historyItem{
+		{id: 2, nick: "nick1", msg: "msg2"},
+		{id: 3, nick: "nick1", msg: "msg3"},
+	}, items)
+	assert.Len(t, all, 5)
+	assert.Empty(t, none)
+}
+
+func TestLogHistorySetLimit_Decreased_LatestKept(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	h, _ := OpenLogHistory(dir, 3)
+	defer h.Close()
+	for _, msg := range []string{"msg1", "msg2", "msg3"} {
+		h.Append("room1", historyItem{nick: "nick1", msg: msg})
+	}
+
+	h.SetLimit(1)
+
+	items, _ := h.Load("room1", 128)
+	assert.Equal(t, []historyItem{{nick: "nick1", msg: "msg3"}}, items)
+}
+
+func TestLogHistoryOpen_ExistingLog_Replayed(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	h, _ := OpenLogHistory(dir, 128)
+	h.Append("room1", historyItem{nick: "nick1", msg: "msg1"})
+	h.Append("room2", historyItem{nick: "nick2", msg: "msg2"})
+	h.Append("room3", historyItem{nick: "nick3", msg: "msg3"})
+	h.Drop("room2")
+	h.Close()
+
+	h, err := OpenLogHistory(dir, 128)
+	assert.NoError(t, err)
+	defer h.Close()
+	h.Append("room1", historyItem{nick: "nick1", msg: "msg4"})
+
+	items1, _ := h.Load("room1", 128)
+	items2, _ := h.Load("room2", 128)
+	items3, _ := h.Load("room3", 128)
+	assert.Equal(t, []historyItem{
+		{nick: "nick1", msg: "msg1"},
+		{nick: "nick1", msg: "msg4"},
+	}, items1)
+	assert.Empty(t, items2)
+	assert.Equal(t, []historyItem{{nick: "nick3", msg: "msg3"}}, items3)
+}
+
+func TestLogHistoryOpen_TruncatedRecord_RecordDiscarded(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	h, _ := OpenLogHistory(dir, 128)
+	h.Append("room1", historyItem{nick: "nick1", msg: "msg1"})
+	active := h.segmentPath(h.active)
+	h.Close()
+
+	f, _ := os.OpenFile(active, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"room":"room1","ni`)
+	f.Close()
+
+	h, err := OpenLogHistory(dir, 128)
+	assert.NoError(t, err)
+	h.Append("room1", historyItem{nick: "nick1", msg: "msg2"})
+	h.Close()
+
+	h, err = OpenLogHistory(dir, 128)
+	assert.NoError(t, err)
+	defer h.Close()
+	items, _ := h.Load("room1", 128)
+	assert.Equal(t, []historyItem{
+		{nick: "nick1", msg: "msg1"},
+		{nick: "nick1", msg: "msg2"},
+	}, items)
+}
+
+func TestLogHistoryCompact_ManySegments_OldSegmentsRemoved(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	h, _ := OpenLogHistory(dir, 2)
+	defer h.Close()
+	for i := 0; i < 5; i++ {
+		h.Append("room1", historyItem{nick: "nick1", msg: "msg"})
+		h.Append("room2", historyItem{nick: "nick2", msg: "msg"})
+		h.roll()
+	}
+	h.Append("room1", historyItem{nick: "nick1", msg: "last"})
+
+	err := h.Compact()
+	assert.NoError(t, err)
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	assert.Len(t, segments, 2)
+	items1, _ := h.Load("room1", 128)
+	items2, _ := h.Load("room2", 128)
+	assert.Equal(t, []historyItem{
+		{nick: "nick1", msg: "msg"},
+		{nick: "nick1", msg: "last"},
+	}, items1)
+	assert.Len(t, items2, 2)
+}
+
+func TestLogHistoryOpen_CompactionInterrupted_ObsoleteSegmentsIgnored(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	h, _ := OpenLogHistory(dir, 128)
+	h.Append("room1", historyItem{nick: "nick1", msg: "msg1"})
+	h.Close()
+	old, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	oldContent, _ := ioutil.ReadFile(old[0])
+
+	// Compaction on open renamed new segment in place but old one
+	// is brought back as if it was not removed.
+	h, _ = OpenLogHistory(dir, 128)
+	h.Close()
+	ioutil.WriteFile(old[0], oldContent, 0644)
+
+	h, err := OpenLogHistory(dir, 128)
+	assert.NoError(t, err)
+	defer h.Close()
+	items, _ := h.Load("room1", 128)
+	assert.Equal(t, []historyItem{{nick: "nick1", msg: "msg1"}}, items)
+}
+
+func TestLogHistory_Reopened_IDsAndTimesKept(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	h, _ := OpenLogHistory(dir, 128)
+	at := time.Date(2026, 10, 17, 7, 0, 0, 123, time.UTC)
+	h.Append("room1", historyItem{id: 1, time: at, nick: "nick1", msg: "msg1"})
+	h.Append("room2", historyItem{id: 2, time: at, nick: "nick1", msg: "msg2"})
+	h.Drop("room2")
+	h.Close()
+
+	h, _ = OpenLogHistory(dir, 128)
+	defer h.Close()
+
+	items, _ := h.Load("room1", 128)
+	assert.Equal(t, []historyItem{{id: 1, time: at, nick: "nick1", msg: "msg1"}}, items)
+	assert.Equal(t, uint64(2), h.LastID())
+}
+
+func TestLogHistoryCompact_ItemsDropped_LastIDKept(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	h, _ := OpenLogHistory(dir, 128)
+	h.Append("room1", historyItem{id: 7, nick: "nick1", msg: "msg1"})
+	h.Drop("room1")
+	h.Compact()
+	h.Close()
+
+	h, _ = OpenLogHistory(dir, 128)
+	defer h.Close()
+
+	assert.Equal(t, uint64(7), h.LastID())
+}
+
+func TestLogHistoryCompact_AppendedMeanwhile_ItemsKept(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	h, _ := OpenLogHistory(dir, 1000)
+	for i := 1; i <= 100; i++ {
+		h.Append("room1", historyItem{id: uint64(i), nick: "nick1", msg: "msg"})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 101; i <= 200; i++ {
+			h.Append("room1", historyItem{id: uint64(i), nick: "nick1", msg: "msg"})
+		}
+	}()
+	err := h.Compact()
+	<-done
+	h.Close()
+
+	assert.NoError(t, err)
+	h, _ = OpenLogHistory(dir, 1000)
+	defer h.Close()
+	items, _ := h.Load("room1", 1000)
+	assert.Len(t, items, 200)
+	for i, item := range items {
+		assert.Equal(t, uint64(i+1), item.id)
+	}
+}
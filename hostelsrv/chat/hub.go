@@ -2,18 +2,30 @@ package chat
 
 import (
 	"container/ring"
-	"fmt"
+	"log"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Hub represents chat database.
 // For simplicity, we don't introduce abstraction of DAO.
 // Instead, a hub is in-memory dataset that someday (maybe)
 // will be managed by data-access service.
+// Hub is safe for concurrent use, rooms can be created and
+// deleted while users are subscribing and publishing.
 type Hub struct {
+	// lastID is accessed atomically, so it goes first to be aligned.
+	lastID         uint64
 	rooms          map[string]*room
+	rm             sync.RWMutex
 	roomHistoryCap int
+	history        HistoryStore
+	// historyKeep is number of items history store retains per room,
+	// which is usually more than room history in memory holds.
+	historyKeep int
 }
 
 type subscriber struct {
@@ -24,56 +36,238 @@ type subscriber struct {
 type room struct {
 	name        string
 	subscribers map[identity]subscriber
+	deleted     bool
+	configured  bool
+	settings    RoomSettings
+	topic       string
+	operators   map[identity]struct{}
+	bannedUsers map[identity]struct{}
+	bannedNicks map[string]struct{}
+	muted       map[identity]time.Time
 	sm          sync.RWMutex
 	history     *ring.Ring
-	hm          sync.Mutex
+	historyCap  int
+	// evicted is the latest item which is no longer kept in history.
+	evicted historyItem
+	index   *searchIndex
+	hm      sync.Mutex
+	// pm keeps items persisted in order of IDs.
+	pm sync.Mutex
 }
 
+// RoomSettings defines limits and properties of a single room.
+// Zero limits mean defaults of hub or command.
+type RoomSettings struct {
+	// MaxMessageLength limits length of messages published to room.
+	MaxMessageLength int
+	// HistorySize is number of messages kept in room history.
+	HistorySize int
+	// ReadOnly room doesn't accept messages from users.
+	ReadOnly bool
+}
+
+// historyItem is a message published to room. Every message gets
+// server-wide monotonic ID and UTC time when it's published.
 type historyItem struct {
+	id   uint64
+	time time.Time
 	nick string
-	msg  message
+	msg  string
+}
+
+// cursor points to position in room history, either by message
+// ID or by time.
+type cursor struct {
+	id   uint64
+	time time.Time
+}
+
+// after reports whether item was published after the cursor.
+// Zero cursor points to the beginning of history.
+func (c cursor) after(item historyItem) bool {
+	if c.id != 0 {
+		return item.id > c.id
+	}
+	if !c.time.IsZero() {
+		return item.time.After(c.time)
+	}
+	return true
 }
 
 // NewHub creates a new hub, the storage of chat rooms.
 func NewHub(roomHistoryCap int) *Hub {
 	return &Hub{
+		lastID:         seedMessageID(),
 		rooms:          make(map[string]*room),
 		roomHistoryCap: roomHistoryCap,
 	}
 }
 
+// seedMessageID returns ID which message IDs start after when there is
+// no history they could continue. It's microseconds since Unix epoch,
+// so that IDs keep increasing across restarts.
+func seedMessageID() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+// NewHubWithHistory creates a new hub which keeps rooms history
+// in the specified store in addition to memory. Store retains as many
+// items as its limit allows, and at least as many as memory holds.
+func NewHubWithHistory(roomHistoryCap int, history HistoryStore) *Hub {
+	hub := NewHub(roomHistoryCap)
+	hub.history = history
+	hub.historyKeep = history.Limit()
+	if lastID := history.LastID(); lastID != 0 {
+		hub.lastID = lastID
+	}
+	return hub
+}
+
+// nextMessageID returns ID for a new message.
+func (hub *Hub) nextMessageID() uint64 {
+	return atomic.AddUint64(&hub.lastID, 1)
+}
+
 // CreateRoom adds to hub a new room with the specified name.
 func (hub *Hub) CreateRoom(roomName string) error {
+	hub.rm.Lock()
+	defer hub.rm.Unlock()
 	if _, exists := hub.rooms[roomName]; exists {
-		return fmt.Errorf("Attempt to create duplicate room: %s", roomName)
+		return newError(codeRoomExists, "Attempt to create duplicate room: %s", roomName)
 	}
-	hub.rooms[roomName] = &room{
+	room := &room{
 		name:        roomName,
 		subscribers: make(map[identity]subscriber),
+		operators:   make(map[identity]struct{}),
+		bannedUsers: make(map[identity]struct{}),
+		bannedNicks: make(map[string]struct{}),
+		muted:       make(map[identity]time.Time),
 		history:     ring.New(hub.roomHistoryCap),
+		historyCap:  hub.roomHistoryCap,
+		index:       newSearchIndex(hub.searchCap(hub.roomHistoryCap)),
 	}
+	if hub.history != nil {
+		// Store keeps at least one more item than memory, so that it's
+		// known what was evicted, and everything it keeps is searched.
+		limit := room.index.cap
+		if limit < hub.roomHistoryCap+1 {
+			limit = hub.roomHistoryCap + 1
+		}
+		items, err := hub.history.Load(roomName, limit)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			room.index.add(item)
+		}
+		if len(items) > hub.roomHistoryCap {
+			room.evicted = items[len(items)-hub.roomHistoryCap-1]
+			items = items[len(items)-hub.roomHistoryCap:]
+		}
+		for _, item := range items {
+			room.history.Value = item
+			room.history = room.history.Next()
+		}
+	}
+	hub.rooms[roomName] = room
 	return nil
 }
 
+// DeleteRoom removes room with the specified name from hub together
+// with its history. Subscribers of the deleted room are returned, so
+// that caller can notify them.
+func (hub *Hub) DeleteRoom(roomName string) (map[identity]subscriber, error) {
+	hub.rm.Lock()
+	room, ok := hub.rooms[roomName]
+	delete(hub.rooms, roomName)
+	hub.rm.Unlock()
+
+	if !ok {
+		return nil, newError(codeUnknownRoom, "Cannot delete unknown room: %s", roomName)
+	}
+	room.sm.Lock()
+	defer room.sm.Unlock()
+	subs := room.subscribers
+	room.subscribers = make(map[identity]subscriber)
+	room.deleted = true
+	if hub.history != nil {
+		// Items which are being persisted are dropped too.
+		room.pm.Lock()
+		defer room.pm.Unlock()
+		if err := hub.history.Drop(roomName); err != nil {
+			log.Println("Cannot drop history of", roomName+":", err)
+		}
+	}
+	return subs, nil
+}
+
+func (hub *Hub) getRoom(roomName string) (*room, bool) {
+	hub.rm.RLock()
+	defer hub.rm.RUnlock()
+	room, ok := hub.rooms[roomName]
+	return room, ok
+}
+
 // SubscribeToRoom subsribes the specified user to room by assigning
 // corresponding nick.
 func (hub *Hub) SubscribeToRoom(user identity, roomName string, sub subscriber) error {
-	if room, ok := hub.rooms[roomName]; ok {
-		room.sm.Lock()
-		defer room.sm.Unlock()
-		for _, roomSub := range room.subscribers {
-			if strings.EqualFold(roomSub.nick, sub.nick) {
-				return fmt.Errorf("User %s already joined %s", roomSub.nick, roomName)
-			}
+	if room, ok := hub.getRoom(roomName); ok {
+		return room.subscribe(user, sub)
+	}
+	return newError(codeUnknownRoom, "Cannot subscribe to unknown room: %s", roomName)
+}
+
+// joinRoom subscribes user to room and sends its history to subscriber,
+// either all of it or items published after the cursor. Messages are
+// published to room either before subscribing, so they are in history,
+// or after history is sent, so they are neither missed nor sent twice.
+func (hub *Hub) joinRoom(user identity, roomName string, sub subscriber, since *cursor) error {
+	room, ok := hub.getRoom(roomName)
+	if !ok {
+		return newError(codeUnknownRoom, "Cannot subscribe to unknown room: %s", roomName)
+	}
+	room.hm.Lock()
+	defer room.hm.Unlock()
+	if err := room.subscribe(user, sub); err != nil {
+		return err
+	}
+	history := room.items()
+	if since != nil {
+		var gap bool
+		history, gap = hub.historySince(room, *since)
+		if gap {
+			sub.outgoing <- gapMsg(roomName)
 		}
-		room.subscribers[user] = sub
-		return nil
 	}
-	return fmt.Errorf("Cannot subscribe to unknown room: %s", roomName)
+	for _, item := range history {
+		sub.outgoing <- historyMsg(roomName, item)
+	}
+	return nil
+}
+
+func (room *room) subscribe(user identity, sub subscriber) error {
+	room.sm.Lock()
+	defer room.sm.Unlock()
+	// The room might have been deleted after we got it from hub.
+	if room.deleted {
+		return newError(codeUnknownRoom, "Cannot subscribe to unknown room: %s", room.name)
+	}
+	_, userBanned := room.bannedUsers[user]
+	_, nickBanned := room.bannedNicks[strings.ToLower(sub.nick)]
+	if userBanned || nickBanned {
+		return newError(codeBanned, "You are banned from %s", room.name)
+	}
+	for _, roomSub := range room.subscribers {
+		if strings.EqualFold(roomSub.nick, sub.nick) {
+			return newError(codeNickTaken, "User %s already joined %s", roomSub.nick, room.name)
+		}
+	}
+	room.subscribers[user] = sub
+	return nil
 }
 
 func (hub *Hub) getSubscribers(roomName string) map[identity]subscriber {
-	if room, ok := hub.rooms[roomName]; ok {
+	if room, ok := hub.getRoom(roomName); ok {
 		room.sm.RLock()
 		defer room.sm.RUnlock()
 		result := make(map[identity]subscriber, len(room.subscribers))
@@ -87,36 +281,567 @@ func (hub *Hub) getSubscribers(roomName string) map[identity]subscriber {
 
 // AppendRoomHistory extends history of a given room with the specified item.
 func (hub *Hub) AppendRoomHistory(roomName string, item historyItem) error {
-	if room, ok := hub.rooms[roomName]; ok {
+	if room, ok := hub.getRoom(roomName); ok {
 		room.hm.Lock()
-		defer room.hm.Unlock()
-		room.history.Value = item
-		room.history = room.history.Next()
+		room.sm.RLock()
+		// Deleted room must not leave its history in the store.
+		if !room.deleted {
+			room.appendHistory(item)
+			room.pm.Lock()
+			room.sm.RUnlock()
+			room.hm.Unlock()
+			return hub.persist(room, item)
+		}
+		room.sm.RUnlock()
+		room.hm.Unlock()
+	}
+	return newError(codeUnknownRoom, "Cannot save history for unknown room: %s", roomName)
+}
+
+// publish gives item the next ID and current time, appends it to room
+// history and delivers it to members of room except sender. ID is
+// allocated under history lock, so that history is kept and delivered
+// in order of IDs. Item is persisted after room locks are released, so
+// that neither publishing nor joining room waits for the store.
+func (hub *Hub) publish(roomName string, sender identity, item historyItem) (historyItem, error) {
+	if room, ok := hub.getRoom(roomName); ok {
+		room.hm.Lock()
+		room.sm.RLock()
+		if !room.deleted {
+			item.id = hub.nextMessageID()
+			item.time = time.Now().UTC()
+			room.appendHistory(item)
+			m := publicMsg(roomName, item)
+			for user, sub := range room.subscribers {
+				if user != sender {
+					sub.outgoing <- m
+				}
+			}
+			room.pm.Lock()
+			room.sm.RUnlock()
+			room.hm.Unlock()
+			return item, hub.persist(room, item)
+		}
+		room.sm.RUnlock()
+		room.hm.Unlock()
+	}
+	return item, newError(codeUnknownRoom, "Cannot publish to unknown room: %s", roomName)
+}
+
+// appendHistory adds item to history of room kept in memory. Caller
+// must hold history lock and read lock of subscribers of room.
+func (room *room) appendHistory(item historyItem) {
+	if room.history.Value != nil {
+		room.evicted = room.history.Value.(historyItem)
+	}
+	room.history.Value = item
+	room.history = room.history.Next()
+	room.index.add(item)
+}
+
+// persist appends item to history store and releases persist lock of
+// room. Caller acquires the lock before releasing history lock, so that
+// items are persisted in order they were added to history.
+func (hub *Hub) persist(room *room, item historyItem) error {
+	defer room.pm.Unlock()
+	if hub.history == nil {
 		return nil
 	}
-	return fmt.Errorf("Cannot save history for unknown room: %s", roomName)
+	return hub.history.Append(room.name, item)
 }
 
 func (hub *Hub) getRoomHistory(roomName string) []historyItem {
-	var history []historyItem
-	if room, ok := hub.rooms[roomName]; ok {
+	if room, ok := hub.getRoom(roomName); ok {
 		room.hm.Lock()
 		defer room.hm.Unlock()
-		history = make([]historyItem, 0, room.history.Len())
-		room.history.Do(func(h interface{}) {
-			if h != nil {
-				history = append(history, h.(historyItem))
-			}
-		})
+		return room.items()
 	}
+	return nil
+}
+
+// items returns history of room kept in memory, oldest first.
+// Caller must hold history lock.
+func (room *room) items() []historyItem {
+	history := make([]historyItem, 0, room.history.Len())
+	room.history.Do(func(h interface{}) {
+		if h != nil {
+			history = append(history, h.(historyItem))
+		}
+	})
 	return history
 }
 
+// roomHistorySince returns items of room history published after the
+// cursor. It also reports a gap, i.e. whether some items published after
+// the cursor are no longer kept in history.
+func (hub *Hub) roomHistorySince(roomName string, since cursor) ([]historyItem, bool) {
+	room, ok := hub.getRoom(roomName)
+	if !ok {
+		return nil, false
+	}
+	room.hm.Lock()
+	defer room.hm.Unlock()
+	return hub.historySince(room, since)
+}
+
+// historySince is roomHistorySince for room which history lock is held
+// by caller, so that items and evicted one are consistent.
+func (hub *Hub) historySince(room *room, since cursor) ([]historyItem, bool) {
+	items := room.items()
+	// Cursor ahead of any ID was given out before IDs started over,
+	// e.g. because clock went back, so anything may be missed.
+	if since.id > atomic.LoadUint64(&hub.lastID) {
+		return items, true
+	}
+	var newer []historyItem
+	for _, item := range items {
+		if since.after(item) {
+			newer = append(newer, item)
+		}
+	}
+	gap := room.evicted != (historyItem{}) && since.after(room.evicted)
+	return newer, gap
+}
+
+// roomHistoryBefore returns at most limit of the latest items of room
+// history which IDs are less than the specified one. Items older than
+// memory holds are loaded from history store, if there is one.
+func (hub *Hub) roomHistoryBefore(roomName string, before uint64, limit int) ([]historyItem, error) {
+	if _, ok := hub.getRoom(roomName); !ok {
+		return nil, newError(codeUnknownRoom, "Unknown room: %s", roomName)
+	}
+	var items []historyItem
+	for _, item := range hub.getRoomHistory(roomName) {
+		if item.id < before {
+			items = append(items, item)
+		}
+	}
+	if len(items) >= limit || hub.history == nil {
+		if len(items) > limit {
+			items = items[len(items)-limit:]
+		}
+		return items, nil
+	}
+	// The latest items may be not persisted yet, so store is asked
+	// only for items which precede those in memory.
+	if len(items) > 0 {
+		before = items[0].id
+	}
+	older, err := hub.history.LoadBefore(roomName, before, limit-len(items))
+	if err != nil {
+		return nil, err
+	}
+	return append(older, items...), nil
+}
+
+// searchRoom returns items of room history which match the query,
+// the most relevant first.
+func (hub *Hub) searchRoom(roomName string, q searchQuery) ([]historyItem, error) {
+	room, ok := hub.getRoom(roomName)
+	if !ok {
+		return nil, newError(codeUnknownRoom, "Unknown room: %s", roomName)
+	}
+	room.hm.Lock()
+	defer room.hm.Unlock()
+	return room.index.search(q), nil
+}
+
+// SetHistoryCap changes number of items kept in history of every room
+// which doesn't have its own history size. The latest items are preserved.
+func (hub *Hub) SetHistoryCap(roomHistoryCap int) {
+	hub.rm.Lock()
+	defer hub.rm.Unlock()
+	hub.roomHistoryCap = roomHistoryCap
+	for _, room := range hub.rooms {
+		room.sm.RLock()
+		own := room.settings.HistorySize > 0
+		room.sm.RUnlock()
+		if !own {
+			room.resizeHistory(roomHistoryCap, hub.searchCap(roomHistoryCap))
+		}
+	}
+	hub.updateHistoryLimit()
+}
+
+// ConfigureRoom applies the specified settings to existing room.
+// Configured rooms can't be deleted by users.
+func (hub *Hub) ConfigureRoom(roomName string, settings RoomSettings) error {
+	hub.rm.Lock()
+	defer hub.rm.Unlock()
+	room, ok := hub.rooms[roomName]
+	if !ok {
+		return newError(codeUnknownRoom, "Cannot configure unknown room: %s", roomName)
+	}
+	room.sm.Lock()
+	room.settings = settings
+	room.configured = true
+	room.sm.Unlock()
+	historyCap := settings.HistorySize
+	if historyCap <= 0 {
+		historyCap = hub.roomHistoryCap
+	}
+	room.resizeHistory(historyCap, hub.searchCap(historyCap))
+	hub.updateHistoryLimit()
+	return nil
+}
+
+// SetTopic changes topic of the specified room.
+func (hub *Hub) SetTopic(roomName string, topic string) error {
+	if room, ok := hub.getRoom(roomName); ok {
+		room.sm.Lock()
+		defer room.sm.Unlock()
+		if !room.deleted {
+			room.topic = topic
+			return nil
+		}
+	}
+	return newError(codeUnknownRoom, "Unknown room: %s", roomName)
+}
+
+// Topic returns topic of the specified room.
+func (hub *Hub) Topic(roomName string) (string, error) {
+	if room, ok := hub.getRoom(roomName); ok {
+		room.sm.RLock()
+		defer room.sm.RUnlock()
+		return room.topic, nil
+	}
+	return "", newError(codeUnknownRoom, "Unknown room: %s", roomName)
+}
+
+// SetOperators makes accounts with the specified names operators
+// of room, who can kick, ban and mute its members. Operators set
+// before lose their role.
+func (hub *Hub) SetOperators(roomName string, accounts []string) error {
+	if room, ok := hub.getRoom(roomName); ok {
+		operators := make(map[identity]struct{}, len(accounts))
+		for _, name := range accounts {
+			operators[accountIdentity(name)] = struct{}{}
+		}
+		room.sm.Lock()
+		defer room.sm.Unlock()
+		room.operators = operators
+		return nil
+	}
+	return newError(codeUnknownRoom, "Unknown room: %s", roomName)
+}
+
+func (hub *Hub) addOperator(roomName string, user identity) {
+	if room, ok := hub.getRoom(roomName); ok {
+		room.sm.Lock()
+		defer room.sm.Unlock()
+		room.operators[user] = struct{}{}
+	}
+}
+
+// createdRooms returns number of rooms created by users, i.e. which
+// are not configured, and number of them operated by the specified user.
+func (hub *Hub) createdRooms(user identity) (created int, operated int) {
+	hub.rm.RLock()
+	defer hub.rm.RUnlock()
+	for _, room := range hub.rooms {
+		room.sm.RLock()
+		if !room.configured {
+			created++
+			if _, ok := room.operators[user]; ok {
+				operated++
+			}
+		}
+		room.sm.RUnlock()
+	}
+	return created, operated
+}
+
+func (hub *Hub) isConfigured(roomName string) bool {
+	if room, ok := hub.getRoom(roomName); ok {
+		room.sm.RLock()
+		defer room.sm.RUnlock()
+		return room.configured
+	}
+	return false
+}
+
+func (hub *Hub) isOperator(roomName string, user identity) bool {
+	if room, ok := hub.getRoom(roomName); ok {
+		room.sm.RLock()
+		defer room.sm.RUnlock()
+		_, ok := room.operators[user]
+		return ok
+	}
+	return false
+}
+
+// ban prevents user with the specified identity or nick, either of
+// which may be empty, from joining room. Members are not removed.
+func (hub *Hub) ban(roomName string, user identity, nick string) error {
+	if room, ok := hub.getRoom(roomName); ok {
+		room.sm.Lock()
+		defer room.sm.Unlock()
+		if user != "" {
+			room.bannedUsers[user] = struct{}{}
+		}
+		if nick != "" {
+			room.bannedNicks[strings.ToLower(nick)] = struct{}{}
+		}
+		return nil
+	}
+	return newError(codeUnknownRoom, "Unknown room: %s", roomName)
+}
+
+// mute prevents user from publishing to room until the specified time.
+func (hub *Hub) mute(roomName string, user identity, until time.Time) error {
+	if room, ok := hub.getRoom(roomName); ok {
+		room.sm.Lock()
+		defer room.sm.Unlock()
+		if until.After(time.Now()) {
+			room.muted[user] = until
+		} else {
+			delete(room.muted, user)
+		}
+		return nil
+	}
+	return newError(codeUnknownRoom, "Unknown room: %s", roomName)
+}
+
+// mutedUntil returns time when mute of user in room expires.
+// Zero time is returned when user isn't muted.
+func (hub *Hub) mutedUntil(roomName string, user identity) time.Time {
+	if room, ok := hub.getRoom(roomName); ok {
+		room.sm.RLock()
+		defer room.sm.RUnlock()
+		return room.muted[user]
+	}
+	return time.Time{}
+}
+
+func (hub *Hub) roomSettings(roomName string) (RoomSettings, bool) {
+	if room, ok := hub.getRoom(roomName); ok {
+		room.sm.RLock()
+		defer room.sm.RUnlock()
+		return room.settings, true
+	}
+	return RoomSettings{}, false
+}
+
+// updateHistoryLimit lets history store to retain at least as many
+// items as the largest room history holds. Caller must hold hub lock.
+// searchCap returns number of items indexed for search in room which
+// keeps historyCap items in memory. With history store, everything it
+// retains is searched.
+func (hub *Hub) searchCap(historyCap int) int {
+	if hub.history != nil && hub.historyKeep > historyCap {
+		return hub.historyKeep
+	}
+	return historyCap
+}
+
+func (hub *Hub) updateHistoryLimit() {
+	if hub.history == nil {
+		return
+	}
+	limit := hub.roomHistoryCap
+	for _, room := range hub.rooms {
+		room.hm.Lock()
+		if room.historyCap > limit {
+			limit = room.historyCap
+		}
+		room.hm.Unlock()
+	}
+	// One more item tells what was evicted from room history.
+	if limit+1 < hub.historyKeep {
+		limit = hub.historyKeep - 1
+	}
+	hub.history.SetLimit(limit + 1)
+}
+
+// resizeHistory changes capacity of room history and number of items
+// indexed for search, keeping the latest items.
+func (room *room) resizeHistory(historyCap int, searchCap int) {
+	room.hm.Lock()
+	defer room.hm.Unlock()
+	if historyCap == room.historyCap {
+		return
+	}
+	var items []interface{}
+	room.history.Do(func(h interface{}) {
+		if h != nil {
+			items = append(items, h)
+		}
+	})
+	room.index.setCap(searchCap)
+	if len(items) > historyCap {
+		room.evicted = items[len(items)-historyCap-1].(historyItem)
+		items = items[len(items)-historyCap:]
+	}
+	room.history = ring.New(historyCap)
+	for _, item := range items {
+		room.history.Value = item
+		room.history = room.history.Next()
+	}
+	room.historyCap = historyCap
+}
+
+// broadcast delivers message to all subscribers of the room except
+// the specified user. Message is delivered while the room is locked,
+// so that subscribers which left the room never receive it.
+func (hub *Hub) broadcast(roomName string, except identity, m message) bool {
+	room, ok := hub.getRoom(roomName)
+	if !ok {
+		return false
+	}
+	room.sm.RLock()
+	defer room.sm.RUnlock()
+	if room.deleted {
+		return false
+	}
+	for user, sub := range room.subscribers {
+		if user != except {
+			sub.outgoing <- m
+		}
+	}
+	return true
+}
+
+// notify delivers message to the specified member of room.
+func (hub *Hub) notify(roomName string, user identity, m message) bool {
+	room, ok := hub.getRoom(roomName)
+	if !ok {
+		return false
+	}
+	room.sm.RLock()
+	defer room.sm.RUnlock()
+	sub, ok := room.subscribers[user]
+	if ok {
+		sub.outgoing <- m
+	}
+	return ok
+}
+
+// whisper delivers private message of user to subscriber with the
+// specified nick, which is looked for in all rooms. Sender is named by
+// nick of the first room, in alphabetical order, shared with target,
+// or of the first room sender joined. Nick used by different users
+// in different rooms is ambiguous, and message is not delivered then.
+func (hub *Hub) whisper(from identity, nick string, text string) error {
+	hub.rm.RLock()
+	defer hub.rm.RUnlock()
+	names := make([]string, 0, len(hub.rooms))
+	for name := range hub.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var target identity
+	targetRoom, senderNick, shared := "", "", false
+	for _, name := range names {
+		room := hub.rooms[name]
+		room.sm.RLock()
+		sender, joined := room.subscribers[from]
+		for user, sub := range room.subscribers {
+			if !strings.EqualFold(sub.nick, nick) {
+				continue
+			}
+			if targetRoom != "" && user != target {
+				room.sm.RUnlock()
+				return newError(codeAmbiguousNick, "Nick %s is used by several users", nick)
+			}
+			if targetRoom == "" || joined && !shared {
+				target, targetRoom = user, name
+			}
+			if joined && !shared {
+				senderNick, shared = sender.nick, true
+			}
+		}
+		if joined && senderNick == "" {
+			senderNick = sender.nick
+		}
+		room.sm.RUnlock()
+	}
+	if senderNick == "" {
+		return newError(codeNotSubscribed, "Join a room to send private messages")
+	}
+	room := hub.rooms[targetRoom]
+	if room != nil {
+		room.sm.RLock()
+		defer room.sm.RUnlock()
+		if sub, ok := room.subscribers[target]; ok {
+			sub.outgoing <- privateMsg(senderNick, text)
+			return nil
+		}
+	}
+	return newError(codeNoSuchUser, "No such user: %s", nick)
+}
+
+// UnsubscribeFromRoom removes user with the specified id from the room.
+// Subscriber which is removed is returned.
+func (hub *Hub) UnsubscribeFromRoom(user identity, roomName string) (subscriber, error) {
+	if room, ok := hub.getRoom(roomName); ok {
+		room.sm.Lock()
+		defer room.sm.Unlock()
+		if sub, ok := room.subscribers[user]; ok {
+			delete(room.subscribers, user)
+			return sub, nil
+		}
+	}
+	return subscriber{}, newError(codeNotSubscribed, "You are not subscribed to %s", roomName)
+}
+
 // Unsubscribe removes user with the specified id from all rooms.
 func (hub *Hub) Unsubscribe(user identity) {
+	hub.leaveAll(user)
+}
+
+// leaveAll removes user with the specified id from all rooms and
+// returns removed subscribers by room names.
+func (hub *Hub) leaveAll(user identity) map[string]subscriber {
+	hub.rm.RLock()
+	defer hub.rm.RUnlock()
+	left := make(map[string]subscriber)
 	for _, room := range hub.rooms {
 		room.sm.Lock()
-		delete(room.subscribers, user)
+		if sub, ok := room.subscribers[user]; ok {
+			left[room.name] = sub
+			delete(room.subscribers, user)
+		}
 		room.sm.Unlock()
 	}
+	return left
+}
+
+// rebind moves memberships of user to another identity along with
+// operator roles and mutes. Rooms which the other identity is banned
+// from are left, and subscribers removed from them are returned by
+// room names.
+func (hub *Hub) rebind(from identity, to identity) map[string]subscriber {
+	hub.rm.RLock()
+	defer hub.rm.RUnlock()
+	left := make(map[string]subscriber)
+	for _, room := range hub.rooms {
+		room.sm.Lock()
+		if _, ok := room.operators[from]; ok {
+			delete(room.operators, from)
+			room.operators[to] = struct{}{}
+		}
+		if until, ok := room.muted[from]; ok {
+			delete(room.muted, from)
+			room.muted[to] = until
+		}
+		if sub, ok := room.subscribers[from]; ok {
+			delete(room.subscribers, from)
+			if _, banned := room.bannedUsers[to]; banned {
+				left[room.name] = sub
+			} else {
+				room.subscribers[to] = sub
+			}
+		}
+		room.sm.Unlock()
+	}
+	return left
+}
+
+// Close releases resources held by hub.
+func (hub *Hub) Close() error {
+	if hub.history != nil {
+		return hub.history.Close()
+	}
+	return nil
 }
@@ -1,7 +1,11 @@
 package chat
 
 import (
+	"fmt"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -39,6 +43,54 @@ func TestHubCreateRoom_DuplicateRoom_ErrorReturned(t *testing.T) {
 	assert.EqualError(t, err2, "Attempt to create duplicate room: room1")
 }
 
+func TestHubDeleteRoom_RoomExists_RoomRemoved(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+
+	_, err := hub.DeleteRoom("room1")
+
+	assert.NoError(t, err)
+	assert.NotContains(t, hub.rooms, "room1")
+	assert.Contains(t, hub.rooms, "room2")
+	assert.Empty(t, hub.getRoomHistory("room1"))
+}
+
+func TestHubDeleteRoom_HasSubscribers_SubscribersReturned(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	sub1 := subscriber{nick: "nick1"}
+	sub2 := subscriber{nick: "nick2"}
+	hub.SubscribeToRoom("id1", "room1", sub1)
+	hub.SubscribeToRoom("id2", "room1", sub2)
+
+	subs, err := hub.DeleteRoom("room1")
+
+	assert.NoError(t, err)
+	assert.Len(t, subs, 2)
+	assert.Equal(t, sub1, subs["id1"])
+	assert.Equal(t, sub2, subs["id2"])
+}
+
+func TestHubDeleteRoom_RoomDoesntExist_ErrorReturned(t *testing.T) {
+	hub := NewHub(128)
+
+	_, err := hub.DeleteRoom("room1")
+
+	assert.EqualError(t, err, "Cannot delete unknown room: room1")
+}
+
+func TestHubDeleteRoom_Recreated_HistoryDropped(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.AppendRoomHistory("room1", historyItem{nick: "nick1", msg: "msg1"})
+
+	hub.DeleteRoom("room1")
+	hub.CreateRoom("room1")
+
+	assert.Empty(t, hub.getRoomHistory("room1"))
+}
+
 func TestHubSubscribeToRoom_RoomsExist_UserSubscribedToRoom(t *testing.T) {
 	hub := NewHub(128)
 	hub.CreateRoom("room1")
@@ -151,6 +203,65 @@ func TestHubNewHub_GivenCapacity_ExpectCorrectHistoryRingLen(t *testing.T) {
 	}
 }
 
+func TestHubSetHistoryCap_Decreased_LatestItemsKept(t *testing.T) {
+	hub := NewHub(4)
+	hub.CreateRoom("room1")
+	for _, msg := range []string{"msg1", "msg2", "msg3"} {
+		hub.AppendRoomHistory("room1", historyItem{nick: "nick1", msg: msg})
+	}
+
+	hub.SetHistoryCap(2)
+	hub.AppendRoomHistory("room1", historyItem{nick: "nick1", msg: "msg4"})
+	hub.CreateRoom("room2")
+
+	assert.Equal(t, []historyItem{
+		{nick: "nick1", msg: "msg3"},
+		{nick: "nick1", msg: "msg4"},
+	}, hub.getRoomHistory("room1"))
+	assert.Equal(t, 2, hub.rooms["room2"].history.Len())
+}
+
+func TestHubSetHistoryCap_Increased_ItemsPreserved(t *testing.T) {
+	hub := NewHub(2)
+	hub.CreateRoom("room1")
+	for _, msg := range []string{"msg1", "msg2"} {
+		hub.AppendRoomHistory("room1", historyItem{nick: "nick1", msg: msg})
+	}
+
+	hub.SetHistoryCap(3)
+	hub.AppendRoomHistory("room1", historyItem{nick: "nick1", msg: "msg3"})
+
+	assert.Equal(t, []historyItem{
+		{nick: "nick1", msg: "msg1"},
+		{nick: "nick1", msg: "msg2"},
+		{nick: "nick1", msg: "msg3"},
+	}, hub.getRoomHistory("room1"))
+}
+
+func TestHubConfigureRoom_HistorySize_RoomHistoryResized(t *testing.T) {
+	hub := NewHub(4)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+
+	err := hub.ConfigureRoom("room1", RoomSettings{HistorySize: 2})
+	hub.SetHistoryCap(3)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, hub.rooms["room1"].history.Len())
+	assert.Equal(t, 3, hub.rooms["room2"].history.Len())
+	settings, ok := hub.roomSettings("room1")
+	assert.True(t, ok)
+	assert.Equal(t, RoomSettings{HistorySize: 2}, settings)
+}
+
+func TestHubConfigureRoom_RoomDoesntExist_ErrorReturned(t *testing.T) {
+	hub := NewHub(4)
+
+	err := hub.ConfigureRoom("room1", RoomSettings{ReadOnly: true})
+
+	assert.EqualError(t, err, "Cannot configure unknown room: room1")
+}
+
 func TestHubgetRoomHistory_RoomExists_HistoryItemsReturned(t *testing.T) {
 	hub := NewHub(128)
 	hub.CreateRoom("room1")
@@ -182,6 +293,120 @@ func TestHubgetRoomHistory_RoomDoesntExist_EmptyReturned(t *testing.T) {
 	assert.Empty(t, history)
 }
 
+func TestHubWhisper_NickExists_MessageDelivered(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	outgoing := make(chan message, 1)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+	hub.SubscribeToRoom("id2", "room2", subscriber{nick: "nick2", outgoing: outgoing})
+
+	assert.NoError(t, hub.whisper("id1", "NiCK2", "msg1"))
+	assert.Equal(t, privateMsg("nick1", "msg1"), <-outgoing)
+
+	assert.EqualError(t, hub.whisper("id1", "nick3", "msg2"), "No such user: nick3")
+	assert.EqualError(t, hub.whisper("id3", "nick2", "msg2"), "Join a room to send private messages")
+}
+
+func TestHubWhisper_SharedRoom_SharedRoomNickUsed(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	hub.CreateRoom("room3")
+	outgoing := make(chan message, 2)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+	hub.SubscribeToRoom("id1", "room3", subscriber{nick: "nick3"})
+	hub.SubscribeToRoom("id2", "room2", subscriber{nick: "nick2", outgoing: outgoing})
+	hub.SubscribeToRoom("id2", "room3", subscriber{nick: "nick2", outgoing: outgoing})
+
+	assert.NoError(t, hub.whisper("id1", "nick2", "msg1"))
+	assert.Equal(t, privateMsg("nick3", "msg1"), <-outgoing)
+}
+
+func TestHubWhisper_NickOfSeveralUsers_ErrorReturned(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	outgoing2 := make(chan message, 1)
+	outgoing3 := make(chan message, 1)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: outgoing2})
+	hub.SubscribeToRoom("id3", "room2", subscriber{nick: "NICK2", outgoing: outgoing3})
+
+	assert.EqualError(t, hub.whisper("id1", "nick2", "msg1"), "Nick nick2 is used by several users")
+	assert.Empty(t, outgoing2)
+	assert.Empty(t, outgoing3)
+}
+
+func TestHubPublish_Concurrently_KeptAndDeliveredInOrderOfIDs(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	outgoing := make(chan message, 100)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1", outgoing: outgoing})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				hub.publish("room1", "id2", historyItem{nick: "nick2", msg: "msg"})
+			}
+		}()
+	}
+	wg.Wait()
+
+	history := hub.getRoomHistory("room1")
+	assert.Len(t, history, 100)
+	for i := 1; i < len(history); i++ {
+		assert.True(t, history[i].id > history[i-1].id)
+		assert.False(t, history[i].time.Before(history[i-1].time))
+		assert.Equal(t, history[i-1].id, (<-outgoing).msgID)
+	}
+}
+
+func TestHubBroadcast_RoomExists_DeliveredToOthers(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	outgoing1 := make(chan message, 1)
+	outgoing2 := make(chan message, 1)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1", outgoing: outgoing1})
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: outgoing2})
+
+	assert.True(t, hub.broadcast("room1", "id1", noticeMsg("msg1")))
+	assert.Empty(t, outgoing1)
+	assert.Equal(t, noticeMsg("msg1"), <-outgoing2)
+
+	assert.False(t, hub.broadcast("room2", "id1", noticeMsg("msg2")))
+}
+
+func TestHubUnsubscribeFromRoom_Subscribed_RemovedFromRoomOnly(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	sub := subscriber{nick: "nick1"}
+	hub.SubscribeToRoom("id1", "room1", sub)
+	hub.SubscribeToRoom("id1", "room2", sub)
+
+	removed, err := hub.UnsubscribeFromRoom("id1", "room1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, sub, removed)
+	assert.NotContains(t, hub.rooms["room1"].subscribers, identity("id1"))
+	assert.Contains(t, hub.rooms["room2"].subscribers, identity("id1"))
+}
+
+func TestHubUnsubscribeFromRoom_NotSubscribed_ErrorReturned(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+
+	_, err1 := hub.UnsubscribeFromRoom("id1", "room1")
+	_, err2 := hub.UnsubscribeFromRoom("id1", "room2")
+
+	assert.EqualError(t, err1, "You are not subscribed to room1")
+	assert.EqualError(t, err2, "You are not subscribed to room2")
+}
+
 func TestHubUnsubscribe_GivenUser_UserRemovedFromAllRooms(t *testing.T) {
 	hub := NewHub(128)
 	hub.CreateRoom("room1")
@@ -204,3 +429,285 @@ func TestHubUnsubscribe_GivenUser_UserRemovedFromAllRooms(t *testing.T) {
 	assert.NotContains(t, hub.rooms["room2"].subscribers, identity("id2"))
 	assert.NotContains(t, hub.rooms["room3"].subscribers, identity("id2"))
 }
+
+func TestHubSubscribeToRoom_RoomDeleted_ErrorReturned(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	room := hub.rooms["room1"]
+	hub.DeleteRoom("room1")
+	// Emulate subscription which got the room right before deletion.
+	hub.rooms["room1"] = room
+
+	err := hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1"})
+
+	assert.EqualError(t, err, "Cannot subscribe to unknown room: room1")
+	assert.Empty(t, room.subscribers)
+}
+
+// Run with -race to let the detector catch unsafe access to hub.
+func TestHub_ConcurrentMutation_NoRace(t *testing.T) {
+	const workers = 8
+	const iterations = 200
+
+	hub := NewHub(4)
+	publish := NewPublishCommand(hub, 254)
+	rooms := []string{"room1", "room2", "room3"}
+
+	wg := sync.WaitGroup{}
+	wg.Add(workers * 2)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				room := rooms[(w+i)%len(rooms)]
+				hub.CreateRoom(room)
+				if i%3 == 0 {
+					hub.DeleteRoom(room)
+				}
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			user := identity(fmt.Sprint("id", w))
+			outgoing := make(chan message, iterations*len(rooms)*workers)
+			for i := 0; i < iterations; i++ {
+				room := rooms[i%len(rooms)]
+				hub.SubscribeToRoom(user, room, subscriber{
+					nick:     fmt.Sprint("nick", w),
+					outgoing: outgoing,
+				})
+				publish.Handle(user, room+"|msg", outgoing)
+				hub.getRoomHistory(room)
+				if i%5 == 0 {
+					hub.Unsubscribe(user)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestHubWithHistory_ReopenedStore_HistoryRestored(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	store, _ := OpenLogHistory(dir, 128)
+	hub := NewHubWithHistory(128, store)
+	hub.CreateRoom("room1")
+	hub.AppendRoomHistory("room1", historyItem{nick: "nick1", msg: "msg1"})
+	hub.AppendRoomHistory("room1", historyItem{nick: "nick2", msg: "msg2"})
+	hub.Close()
+
+	store, _ = OpenLogHistory(dir, 128)
+	hub = NewHubWithHistory(128, store)
+	defer hub.Close()
+	hub.CreateRoom("room1")
+
+	expected := []historyItem{
+		{nick: "nick1", msg: "msg1"},
+		{nick: "nick2", msg: "msg2"},
+	}
+	assert.Equal(t, expected, hub.getRoomHistory("room1"))
+	assert.Equal(t, expected[1], hub.rooms["room1"].history.Prev().Value)
+}
+
+func TestHubWithHistory_PageOlderThanMemory_PageLoaded(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	store, _ := OpenLogHistory(dir, 10)
+	hub := NewHubWithHistory(2, store)
+	defer hub.Close()
+	hub.CreateRoom("room1")
+	var ids []uint64
+	for i := 1; i <= 5; i++ {
+		item, _ := hub.publish("room1", "id1", historyItem{nick: "nick1", msg: fmt.Sprint("msg", i)})
+		ids = append(ids, item.id)
+	}
+
+	items, err := hub.roomHistoryBefore("room1", ids[4], 3)
+
+	assert.NoError(t, err)
+	assert.Len(t, items, 3)
+	for i, item := range items {
+		assert.Equal(t, ids[i+1], item.id)
+	}
+}
+
+func TestHubSearchRoom_ItemEvicted_FoundOnlyWithStore(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	store, _ := OpenLogHistory(dir, 10)
+	withStore := NewHubWithHistory(2, store)
+	inMemory := NewHub(2)
+
+	for _, hub := range []*Hub{withStore, inMemory} {
+		hub.CreateRoom("room1")
+		for i := 1; i <= 5; i++ {
+			hub.publish("room1", "id1", historyItem{nick: "nick1", msg: fmt.Sprint("msg", i)})
+		}
+	}
+	q := searchQuery{words: []string{"msg1"}}
+	found, _ := withStore.searchRoom("room1", q)
+	notFound, _ := inMemory.searchRoom("room1", q)
+
+	assert.Len(t, found, 1)
+	assert.Empty(t, notFound)
+	// Restored room searches the whole retained history too.
+	withStore.Close()
+	store, _ = OpenLogHistory(dir, 10)
+	restored := NewHubWithHistory(2, store)
+	defer restored.Close()
+	restored.CreateRoom("room1")
+	found, _ = restored.searchRoom("room1", q)
+	assert.Len(t, found, 1)
+	assert.Len(t, restored.getRoomHistory("room1"), 2)
+}
+
+func TestHubWithHistory_RoomDeleted_HistoryDropped(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	store, _ := OpenLogHistory(dir, 128)
+	hub := NewHubWithHistory(128, store)
+	defer hub.Close()
+	hub.CreateRoom("room1")
+	hub.AppendRoomHistory("room1", historyItem{nick: "nick1", msg: "msg1"})
+
+	hub.DeleteRoom("room1")
+	hub.CreateRoom("room1")
+
+	items, _ := store.Load("room1", 128)
+	assert.Empty(t, items)
+	assert.Empty(t, hub.getRoomHistory("room1"))
+}
+
+func TestHubJoinRoom_PublishedMeanwhile_EveryMessageOnce(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	first, _ := hub.publish("room1", "id2", historyItem{nick: "nick2", msg: "first"})
+	outgoing := make(chan message, 101)
+
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			hub.publish("room1", "id2", historyItem{nick: "nick2", msg: fmt.Sprint("msg", i)})
+		}
+		close(published)
+	}()
+	err := hub.joinRoom("id1", "room1", subscriber{nick: "nick1", outgoing: outgoing}, &cursor{id: first.id})
+	<-published
+
+	assert.NoError(t, err)
+	assert.Len(t, outgoing, 100)
+	for i := 0; len(outgoing) > 0; i++ {
+		assert.Equal(t, fmt.Sprint("msg", i), (<-outgoing).text)
+	}
+}
+
+// stalledHistory is history store which appends only when allowed.
+type stalledHistory struct {
+	HistoryStore
+	appending chan struct{}
+	allowed   chan struct{}
+}
+
+func (h *stalledHistory) Append(roomName string, item historyItem) error {
+	h.appending <- struct{}{}
+	<-h.allowed
+	return h.HistoryStore.Append(roomName, item)
+}
+
+func TestHubWithHistory_StoreStalled_RoomNotBlocked(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	store, _ := OpenLogHistory(dir, 128)
+	history := &stalledHistory{store, make(chan struct{}), make(chan struct{})}
+	hub := NewHubWithHistory(128, history)
+	defer hub.Close()
+	hub.CreateRoom("room1")
+	outgoing := make(chan message, 1)
+	hub.SubscribeToRoom("id1", "room1", subscriber{nick: "nick1", outgoing: outgoing})
+
+	published := make(chan error)
+	go func() {
+		_, err := hub.publish("room1", "id2", historyItem{nick: "nick2", msg: "msg1"})
+		published <- err
+	}()
+	<-history.appending
+
+	assert.Equal(t, "nick2@room1: msg1", unstamped(<-outgoing))
+	assert.NoError(t, hub.SubscribeToRoom("id3", "room1", subscriber{nick: "nick3"}))
+	items, _ := hub.roomHistorySince("room1", cursor{})
+	assert.Len(t, items, 1)
+	close(history.allowed)
+	assert.NoError(t, <-published)
+	persisted, _ := store.Load("room1", 128)
+	assert.Len(t, persisted, 1)
+}
+
+func TestHubWithHistory_ReopenedStore_IDsContinued(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	history, _ := OpenLogHistory(dir, 128)
+	history.Append("room1", historyItem{id: 41, nick: "nick1", msg: "msg1"})
+
+	hub := NewHubWithHistory(128, history)
+	defer hub.Close()
+
+	assert.Equal(t, uint64(42), hub.nextMessageID())
+	assert.Equal(t, uint64(43), hub.nextMessageID())
+}
+
+func TestHubNextMessageID_NewHub_GreaterThanBeforeRestart(t *testing.T) {
+	id := NewHub(128).nextMessageID()
+
+	time.Sleep(time.Millisecond)
+
+	assert.True(t, NewHub(128).nextMessageID() > id)
+}
+
+func TestHubRoomHistorySince_CursorAhead_GapReported(t *testing.T) {
+	hub := NewHub(3)
+	hub.CreateRoom("room1")
+	id := hub.nextMessageID()
+	hub.AppendRoomHistory("room1", historyItem{id: id})
+
+	items, gap := hub.roomHistorySince("room1", cursor{id: id + 10})
+	assert.Equal(t, []historyItem{{id: id}}, items)
+	assert.True(t, gap)
+	_, gap = hub.roomHistorySince("room1", cursor{id: id})
+	assert.False(t, gap)
+}
+
+func TestHubRoomHistorySince_HistoryResized_GapReported(t *testing.T) {
+	hub := NewHub(3)
+	hub.CreateRoom("room1")
+	for i := 1; i <= 3; i++ {
+		hub.AppendRoomHistory("room1", historyItem{id: uint64(i * 10)})
+	}
+
+	hub.SetHistoryCap(1)
+
+	items, gap := hub.roomHistorySince("room1", cursor{id: 15})
+	assert.Equal(t, []historyItem{{id: 30}}, items)
+	assert.True(t, gap)
+	_, gap = hub.roomHistorySince("room1", cursor{id: 20})
+	assert.False(t, gap)
+}
+
+func TestHubWithHistory_ReopenedStore_EvictedKnown(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	history, _ := OpenLogHistory(dir, 3)
+	for i := 1; i <= 3; i++ {
+		history.Append("room1", historyItem{id: uint64(i)})
+	}
+
+	hub := NewHubWithHistory(2, history)
+	defer hub.Close()
+	hub.CreateRoom("room1")
+
+	items, gap := hub.roomHistorySince("room1", cursor{id: 0})
+	assert.Len(t, items, 2)
+	assert.True(t, gap)
+	_, gap = hub.roomHistorySince("room1", cursor{id: 1})
+	assert.False(t, gap)
+}
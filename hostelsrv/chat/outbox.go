@@ -0,0 +1,146 @@
+package chat
+
+import (
+	"expvar"
+	"sync"
+)
+
+// OverflowPolicy defines what happens when client doesn't read
+// events fast enough and its outbound queue is full.
+type OverflowPolicy int
+
+// Overflow policies supported by chat service.
+const (
+	// DropOldest discards the oldest queued event to make room for a new one.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards events which don't fit into the queue.
+	DropNewest
+	// Disconnect closes connection of the slow client.
+	Disconnect
+)
+
+// DefaultQueueSize is the number of events queued for a client
+// unless configured otherwise.
+const DefaultQueueSize = 256
+
+var overflowPolicies = map[string]OverflowPolicy{
+	"drop-oldest": DropOldest,
+	"drop-newest": DropNewest,
+	"disconnect":  Disconnect,
+}
+
+// ParseOverflowPolicy returns policy by its name: "drop-oldest",
+// "drop-newest" or "disconnect". Empty name means DropOldest.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	if name == "" {
+		return DropOldest, nil
+	}
+	if p, ok := overflowPolicies[name]; ok {
+		return p, nil
+	}
+	return DropOldest, newError(codeBadRequest, "Unknown overflow policy: %s", name)
+}
+
+func (p OverflowPolicy) String() string {
+	for name, policy := range overflowPolicies {
+		if policy == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// droppedEvents counts events dropped because of full queues,
+// keyed by overflow policy. It's published with other expvars.
+var droppedEvents = expvar.NewMap("chat.droppedEvents")
+
+// outbox is bounded queue of events waiting to be written to client.
+// Pushing never blocks, so that a client which doesn't read can't
+// stall those who send events to it. Service markers and acks are
+// never dropped and don't count towards the size, as they are tied
+// to requests of the client itself.
+type outbox struct {
+	size   int
+	policy OverflowPolicy
+	items  []message
+	count  int
+	closed bool
+	mu     sync.Mutex
+	ready  chan struct{}
+}
+
+func newOutbox(size int, policy OverflowPolicy) *outbox {
+	return &outbox{
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+func droppable(m message) bool {
+	return m.kind != kindBegin && m.kind != kindSwitch && m.kind != kindAck
+}
+
+// push adds event to the queue. It returns false when the queue
+// overflowed and client must be disconnected.
+func (q *outbox) push(m message) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return true
+	}
+	if droppable(m) {
+		if q.count >= q.size {
+			droppedEvents.Add(q.policy.String(), 1)
+			switch q.policy {
+			case DropNewest:
+				return true
+			case Disconnect:
+				return false
+			}
+			q.dropOldest()
+		}
+		q.count++
+	}
+	q.items = append(q.items, m)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (q *outbox) dropOldest() {
+	for i, m := range q.items {
+		if droppable(m) {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			q.count--
+			return
+		}
+	}
+}
+
+// take waits for queued events and removes them from the queue.
+// It returns false when the queue is closed and nothing is left.
+func (q *outbox) take() ([]message, bool) {
+	for {
+		q.mu.Lock()
+		items, closed := q.items, q.closed
+		q.items, q.count = nil, 0
+		q.mu.Unlock()
+		if len(items) > 0 || closed {
+			return items, len(items) > 0
+		}
+		<-q.ready
+	}
+}
+
+func (q *outbox) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
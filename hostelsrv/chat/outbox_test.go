@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"expvar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pushAll(q *outbox, texts ...string) bool {
+	ok := true
+	for _, text := range texts {
+		ok = q.push(noticeMsg(text)) && ok
+	}
+	return ok
+}
+
+func TestOutbox_DropOldest_OldestDropped(t *testing.T) {
+	q := newOutbox(2, DropOldest)
+
+	assert.True(t, pushAll(q, "msg1", "msg2", "msg3"))
+
+	items, ok := q.take()
+	assert.True(t, ok)
+	assert.Equal(t, []message{noticeMsg("msg2"), noticeMsg("msg3")}, items)
+}
+
+func TestOutbox_DropNewest_NewestDropped(t *testing.T) {
+	q := newOutbox(2, DropNewest)
+
+	assert.True(t, pushAll(q, "msg1", "msg2", "msg3"))
+
+	items, _ := q.take()
+	assert.Equal(t, []message{noticeMsg("msg1"), noticeMsg("msg2")}, items)
+}
+
+func TestOutbox_Disconnect_OverflowReported(t *testing.T) {
+	q := newOutbox(2, Disconnect)
+
+	assert.True(t, pushAll(q, "msg1", "msg2"))
+	assert.False(t, pushAll(q, "msg3"))
+}
+
+func TestOutbox_QueueFull_MarkersKept(t *testing.T) {
+	q := newOutbox(1, DropOldest)
+
+	q.push(message{kind: kindBegin, id: "1"})
+	pushAll(q, "msg1")
+	q.push(message{kind: kindAck, id: "1"})
+	pushAll(q, "msg2")
+
+	items, _ := q.take()
+	assert.Equal(t, []message{
+		{kind: kindBegin, id: "1"},
+		{kind: kindAck, id: "1"},
+		noticeMsg("msg2"),
+	}, items)
+}
+
+func droppedCount(policy OverflowPolicy) int64 {
+	if v, ok := droppedEvents.Get(policy.String()).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestOutbox_Dropped_Counted(t *testing.T) {
+	before := droppedCount(DropNewest)
+	q := newOutbox(1, DropNewest)
+
+	pushAll(q, "msg1", "msg2", "msg3")
+
+	assert.Equal(t, before+2, droppedCount(DropNewest))
+}
+
+func TestOutbox_Closed_RemainingTaken(t *testing.T) {
+	q := newOutbox(2, DropOldest)
+	pushAll(q, "msg1")
+
+	q.close()
+
+	items, ok := q.take()
+	assert.True(t, ok)
+	assert.Len(t, items, 1)
+	_, ok = q.take()
+	assert.False(t, ok)
+}
+
+func TestParseOverflowPolicy_GivenName_PolicyReturned(t *testing.T) {
+	for name, expected := range map[string]OverflowPolicy{
+		"":            DropOldest,
+		"drop-oldest": DropOldest,
+		"drop-newest": DropNewest,
+		"disconnect":  Disconnect,
+	} {
+		p, err := ParseOverflowPolicy(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, p)
+	}
+	_, err := ParseOverflowPolicy("drop-all")
+	assert.Error(t, err)
+}
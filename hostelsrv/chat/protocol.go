@@ -0,0 +1,317 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Protocols supported by chat service. Every connection starts with
+// legacy protocol, where requests are "name|args" lines and replies are
+// plain text lines. Client can switch to JSON lines by "proto|json/1".
+const (
+	protoLegacy = "legacy"
+	protoJSON   = "json/1"
+)
+
+type eventKind string
+
+const (
+	kindMessage  eventKind = "message"
+	kindHistory  eventKind = "history"
+	kindPrivate  eventKind = "private"
+	kindError    eventKind = "error"
+	kindAck      eventKind = "ack"
+	kindPresence eventKind = "presence"
+	kindMembers  eventKind = "members"
+	kindNotice   eventKind = "notice"
+	kindTopic    eventKind = "topic"
+	kindKicked   eventKind = "kicked"
+	kindGap      eventKind = "gap"
+	kindResult   eventKind = "result"
+
+	// Service markers, they are never written to client as is.
+	kindBegin  eventKind = "begin"
+	kindSwitch eventKind = "switch"
+)
+
+type errorCode string
+
+const (
+	codeBadRequest     errorCode = "bad_request"
+	codeUnknownCommand errorCode = "unknown_command"
+	codeUnknownRoom    errorCode = "unknown_room"
+	codeRoomExists     errorCode = "room_exists"
+	codeRoomConfigured errorCode = "room_configured"
+	codeTooManyRooms   errorCode = "too_many_rooms"
+	codeNickTaken      errorCode = "nick_taken"
+	codeNickReserved   errorCode = "nick_reserved"
+	codeAuthFailed     errorCode = "auth_failed"
+	codeSignedIn       errorCode = "signed_in"
+	codeNotSubscribed  errorCode = "not_subscribed"
+	codeNoSuchUser     errorCode = "no_such_user"
+	codeAmbiguousNick  errorCode = "ambiguous_nick"
+	codeEmptyMessage   errorCode = "empty_message"
+	codeTooLong        errorCode = "too_long"
+	codeReadOnly       errorCode = "read_only"
+	codeRateLimited    errorCode = "rate_limited"
+	codeNotOperator    errorCode = "not_operator"
+	codeBanned         errorCode = "banned"
+	codeMuted          errorCode = "muted"
+	codeInternal       errorCode = "internal"
+)
+
+// message is an event sent to client. The same event is rendered
+// differently depending on protocol negotiated by client.
+type message struct {
+	kind  eventKind
+	code  errorCode
+	id    string
+	room  string
+	nick  string
+	text  string
+	nicks []string
+	msgID uint64
+	time  time.Time
+}
+
+func publicMsg(room string, item historyItem) message {
+	return message{kind: kindMessage, room: room, nick: item.nick, text: item.msg,
+		msgID: item.id, time: item.time}
+}
+
+func historyMsg(room string, item historyItem) message {
+	return message{kind: kindHistory, room: room, nick: item.nick, text: item.msg,
+		msgID: item.id, time: item.time}
+}
+
+// resultMsg is the item of room history found by search.
+func resultMsg(room string, item historyItem) message {
+	return message{kind: kindResult, room: room, nick: item.nick, text: item.msg,
+		msgID: item.id, time: item.time}
+}
+
+func privateMsg(nick string, text string) message {
+	return message{kind: kindPrivate, nick: nick, text: text}
+}
+
+func presenceMsg(nick string, room string, text string) message {
+	return message{kind: kindPresence, room: room, nick: nick, text: text}
+}
+
+func membersMsg(room string, nicks []string) message {
+	return message{
+		kind:  kindMembers,
+		room:  room,
+		nicks: nicks,
+		text:  "Members of " + room + ": " + strings.Join(nicks, ", ") + ".",
+	}
+}
+
+// topicMsg tells topic of room. When nick is specified,
+// the topic has just been set by that user.
+func topicMsg(nick string, room string, topic string) message {
+	return message{kind: kindTopic, room: room, nick: nick, text: topic}
+}
+
+// kickedMsg tells user that operator removed them from room
+// for the specified reason, which may be empty.
+func kickedMsg(operator string, room string, reason string) message {
+	return message{kind: kindKicked, room: room, nick: operator, text: reason}
+}
+
+// gapMsg tells that some messages of room requested by client
+// are no longer kept in history.
+func gapMsg(room string) message {
+	return message{kind: kindGap, room: room,
+		text: "Some messages of " + room + " are no longer available."}
+}
+
+func noticeMsg(text string) message {
+	return message{kind: kindNotice, text: text}
+}
+
+func errorMsg(code errorCode, text string) message {
+	return message{kind: kindError, code: code, text: text}
+}
+
+// errorReply converts error returned by hub to the error event.
+func errorReply(err error) message {
+	code := codeInternal
+	var chatErr *chatError
+	if errors.As(err, &chatErr) {
+		code = chatErr.code
+	}
+	return errorMsg(code, err.Error()+".")
+}
+
+// String renders message in legacy text format.
+func (m message) String() string {
+	switch m.kind {
+	case kindResult:
+		m.kind = kindMessage
+		return "Found: " + m.String()
+	case kindMessage, kindHistory:
+		if m.msgID != 0 {
+			return fmt.Sprintf("[%d %s] %s@%s: %s", m.msgID, m.time.Format(time.RFC3339Nano),
+				m.nick, m.room, m.text)
+		}
+		return fmt.Sprintf("%s@%s: %s", m.nick, m.room, m.text)
+	case kindPrivate:
+		return fmt.Sprintf("%s (private): %s", m.nick, m.text)
+	case kindPresence:
+		return "* " + m.text
+	case kindTopic:
+		if m.nick != "" {
+			return fmt.Sprintf("* %s set topic of %s: %s", m.nick, m.room, m.text)
+		}
+		if m.text == "" {
+			return "No topic is set for " + m.room + "."
+		}
+		return fmt.Sprintf("Topic of %s: %s", m.room, m.text)
+	case kindKicked:
+		if m.text == "" {
+			return fmt.Sprintf("You were kicked from %s by %s.", m.room, m.nick)
+		}
+		return fmt.Sprintf("You were kicked from %s by %s: %s", m.room, m.nick, m.text)
+	default:
+		return m.text
+	}
+}
+
+// chatError is an error that carries machine-readable code.
+type chatError struct {
+	code errorCode
+	text string
+}
+
+func newError(code errorCode, format string, args ...interface{}) error {
+	return &chatError{code: code, text: fmt.Sprintf(format, args...)}
+}
+
+func (e *chatError) Error() string {
+	return e.text
+}
+
+type request struct {
+	id   string
+	name string
+	args string
+}
+
+type jsonRequest struct {
+	ID   json.RawMessage `json:"id"`
+	Cmd  string          `json:"cmd"`
+	Args []string        `json:"args"`
+}
+
+type jsonEvent struct {
+	Type  string          `json:"type"`
+	ID    json.RawMessage `json:"id,omitempty"`
+	Code  errorCode       `json:"code,omitempty"`
+	Room  string          `json:"room,omitempty"`
+	Nick  string          `json:"nick,omitempty"`
+	Text  string          `json:"text,omitempty"`
+	Nicks []string        `json:"nicks,omitempty"`
+	MsgID uint64          `json:"msgId,omitempty"`
+	Time  string          `json:"time,omitempty"`
+}
+
+func parseRequest(line string, proto string) (request, error) {
+	if proto == protoJSON {
+		var jr jsonRequest
+		if err := json.Unmarshal([]byte(line), &jr); err != nil {
+			return request{}, newError(codeBadRequest, "Malformed request: %v", err)
+		}
+		if jr.Cmd == "" {
+			return request{id: string(jr.ID)}, newError(codeBadRequest, "Command is missing")
+		}
+		// Args are joined the same way legacy lines are split, so only
+		// the last one may contain separator. Line breaks would let
+		// client forge lines of other users in legacy protocol.
+		for i, arg := range jr.Args {
+			if i < len(jr.Args)-1 && strings.Contains(arg, "|") {
+				return request{id: string(jr.ID)}, newError(codeBadRequest, "Argument %d contains '|'", i+1)
+			}
+			if strings.IndexFunc(arg, isControl) >= 0 {
+				return request{id: string(jr.ID)}, newError(codeBadRequest, "Argument %d contains control characters", i+1)
+			}
+		}
+		return request{
+			id:   string(jr.ID),
+			name: jr.Cmd,
+			args: strings.Join(jr.Args, "|"),
+		}, nil
+	}
+	na := strings.SplitN(line, "|", 2)
+	req := request{name: na[0]}
+	if len(na) > 1 {
+		req.args = na[1]
+	}
+	return req, nil
+}
+
+// isControl reports whether character is a control one except tab.
+func isControl(r rune) bool {
+	return r != '\t' && (r < 0x20 || r == 0x7f)
+}
+
+// encoder writes events to client using negotiated protocol.
+// It keeps track of request being handled, so that errors and
+// other replies in JSON protocol are tagged with request id.
+type encoder struct {
+	w      io.Writer
+	proto  string
+	id     string
+	failed bool
+}
+
+func (e *encoder) encode(m message) error {
+	switch m.kind {
+	case kindBegin:
+		e.id, e.failed = m.id, false
+		return nil
+	case kindSwitch:
+		e.proto = m.text
+		return nil
+	case kindAck:
+		if e.proto != protoJSON || e.failed {
+			return nil
+		}
+	case kindError:
+		e.failed = true
+		fallthrough
+	case kindHistory, kindMembers, kindTopic, kindGap, kindResult:
+		if m.id == "" {
+			m.id = e.id
+		}
+	}
+	if e.proto != protoJSON {
+		_, err := fmt.Fprintln(e.w, m)
+		return err
+	}
+	ev := jsonEvent{
+		Type:  string(m.kind),
+		Code:  m.code,
+		Room:  m.room,
+		Nick:  m.nick,
+		Text:  m.text,
+		Nicks: m.nicks,
+		MsgID: m.msgID,
+	}
+	if !m.time.IsZero() {
+		ev.Time = m.time.Format(time.RFC3339Nano)
+	}
+	if m.id != "" {
+		ev.ID = json.RawMessage(m.id)
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.w, "%s\n", b)
+	return err
+}
@@ -0,0 +1,157 @@
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRequest_LegacyLine_NameArgsSplit(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected request
+	}{
+		{line: "cmd1|arg1", expected: request{name: "cmd1", args: "arg1"}},
+		{line: "cmd1|arg1|arg2", expected: request{name: "cmd1", args: "arg1|arg2"}},
+		{line: "cmd1", expected: request{name: "cmd1"}},
+		{line: "", expected: request{}},
+	}
+
+	for _, testCase := range testCases {
+		req, err := parseRequest(testCase.line, protoLegacy)
+
+		assert.NoError(t, err)
+		assert.Equal(t, testCase.expected, req)
+	}
+}
+
+func TestParseRequest_JSONLine_RequestDecoded(t *testing.T) {
+	testCases := []struct {
+		line     string
+		expected request
+	}{
+		{
+			line:     `{"id":1,"cmd":"publish","args":["room1","msg|1"]}`,
+			expected: request{id: "1", name: "publish", args: "room1|msg|1"},
+		}, {
+			line:     `{"id":"a","cmd":"subscribe","args":["room1:nick1","room2:nick2"]}`,
+			expected: request{id: `"a"`, name: "subscribe", args: "room1:nick1|room2:nick2"},
+		}, {
+			line:     `{"cmd":"who"}`,
+			expected: request{name: "who"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		req, err := parseRequest(testCase.line, protoJSON)
+
+		assert.NoError(t, err)
+		assert.Equal(t, testCase.expected, req)
+	}
+}
+
+func TestParseRequest_MalformedJSON_BadRequestReturned(t *testing.T) {
+	testCases := []string{
+		`publish|room1|msg1`,
+		`{"id":1,"args":["room1"]}`,
+		`{"id":1,"cmd":"publish","args":["room1","hi\n[99 2026-10-17T07:05:09Z] admin@room1: msg"]}`,
+		`{"id":1,"cmd":"publish","args":["room1","hi\rmsg"]}`,
+		`{"id":1,"cmd":"publish","args":["room1|room2","msg1"]}`,
+	}
+
+	for _, testCase := range testCases {
+		_, err := parseRequest(testCase, protoJSON)
+
+		assert.Error(t, err)
+		assert.Equal(t, codeBadRequest, errorReply(err).code)
+	}
+}
+
+func TestErrorReply_GivenError_CodePreserved(t *testing.T) {
+	m1 := errorReply(newError(codeNickTaken, "User %s already joined %s", "nick1", "room1"))
+	m2 := errorReply(errors.New("boom"))
+
+	assert.Equal(t, errorMsg(codeNickTaken, "User nick1 already joined room1."), m1)
+	assert.Equal(t, errorMsg(codeInternal, "boom."), m2)
+}
+
+func TestEncoder_Legacy_PlainLinesWritten(t *testing.T) {
+	w := &bytes.Buffer{}
+	enc := encoder{w: w, proto: protoLegacy}
+
+	enc.encode(message{kind: kindBegin})
+	enc.encode(historyMsg("room1", historyItem{nick: "nick1", msg: "msg1"}))
+	enc.encode(errorMsg(codeTooLong, "Message is too long."))
+	enc.encode(message{kind: kindAck})
+	enc.encode(publicMsg("room1", historyItem{nick: "nick2", msg: "msg2"}))
+	enc.encode(privateMsg("nick3", "msg3"))
+	enc.encode(presenceMsg("nick4", "room1", "nick4 joined room1."))
+	enc.encode(noticeMsg("Room room1 deleted."))
+	enc.encode(topicMsg("", "room2", "topic1"))
+	enc.encode(topicMsg("nick5", "room2", "topic2"))
+	enc.encode(topicMsg("", "room3", ""))
+
+	assert.Equal(t, "nick1@room1: msg1\n"+
+		"Message is too long.\n"+
+		"nick2@room1: msg2\n"+
+		"nick3 (private): msg3\n"+
+		"* nick4 joined room1.\n"+
+		"Room room1 deleted.\n"+
+		"Topic of room2: topic1\n"+
+		"* nick5 set topic of room2: topic2\n"+
+		"No topic is set for room3.\n", w.String())
+}
+
+func TestEncoder_JSON_RepliesTaggedWithRequestID(t *testing.T) {
+	w := &bytes.Buffer{}
+	enc := encoder{w: w, proto: protoJSON}
+
+	enc.encode(message{kind: kindBegin, id: "1"})
+	enc.encode(historyMsg("room1", historyItem{nick: "nick1", msg: "msg1"}))
+	enc.encode(publicMsg("room1", historyItem{nick: "nick2", msg: "msg2"}))
+	enc.encode(message{kind: kindAck, id: "1"})
+	enc.encode(message{kind: kindBegin, id: `"x"`})
+	enc.encode(errorMsg(codeTooLong, "Message is too long."))
+	enc.encode(message{kind: kindAck, id: `"x"`})
+
+	assert.Equal(t,
+		`{"type":"history","id":1,"room":"room1","nick":"nick1","text":"msg1"}`+"\n"+
+			`{"type":"message","room":"room1","nick":"nick2","text":"msg2"}`+"\n"+
+			`{"type":"ack","id":1}`+"\n"+
+			`{"type":"error","id":"x","code":"too_long","text":"Message is too long."}`+"\n",
+		w.String())
+}
+
+func TestEncoder_SwitchMarker_ProtocolChanged(t *testing.T) {
+	w := &bytes.Buffer{}
+	enc := encoder{w: w, proto: protoLegacy}
+
+	enc.encode(message{kind: kindBegin})
+	enc.encode(message{kind: kindSwitch, text: protoJSON})
+	enc.encode(message{kind: kindAck})
+	enc.encode(noticeMsg("hi"))
+
+	assert.Equal(t, `{"type":"ack"}`+"\n"+`{"type":"notice","text":"hi"}`+"\n", w.String())
+}
+
+func TestEncoder_StampedMessage_IDAndTimeWritten(t *testing.T) {
+	w := &bytes.Buffer{}
+	enc := encoder{w: w, proto: protoLegacy}
+	item := historyItem{
+		id:   42,
+		time: time.Date(2026, 10, 17, 7, 5, 9, 120000000, time.UTC),
+		nick: "nick1",
+		msg:  "msg1",
+	}
+
+	enc.encode(publicMsg("room1", item))
+	enc.encode(message{kind: kindSwitch, text: protoJSON})
+	enc.encode(historyMsg("room1", item))
+
+	assert.Equal(t, "[42 2026-10-17T07:05:09.12Z] nick1@room1: msg1\n"+
+		`{"type":"history","room":"room1","nick":"nick1","text":"msg1","msgId":42,"time":"2026-10-17T07:05:09.12Z"}`+"\n",
+		w.String())
+}
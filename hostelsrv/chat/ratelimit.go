@@ -0,0 +1,156 @@
+package chat
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket limit: Rate requests per second on
+// average, with bursts of up to Burst requests. Zero or negative
+// Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits throttle requests of every client. Requests limits all
+// requests of a client, Commands limit requests of specific commands
+// in addition to it. Client which exceeds limits is warned first, then
+// it's muted for MuteSeconds, then it's disconnected.
+type RateLimits struct {
+	Requests    RateLimit
+	Commands    map[string]RateLimit
+	MuteSeconds int
+}
+
+// strikeExpiry is how long client must respect limits to be
+// forgiven for exceeding them before.
+const strikeExpiry = time.Minute
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the bucket if there is any. Bucket is
+// refilled when the specified limit differs from the one it had.
+func (b *tokenBucket) allow(limit RateLimit, now time.Time) bool {
+	if limit.Rate <= 0 {
+		return true
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	if limit != b.limit || b.last.IsZero() {
+		b.limit, b.tokens, b.last = limit, burst, now
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// floodAction is what happens to request of client.
+type floodAction int
+
+const (
+	floodAllow floodAction = iota
+	floodWarn
+	floodMute
+	floodMuted
+	floodDisconnect
+)
+
+// floodGuard keeps rate limiting state of a single client.
+type floodGuard struct {
+	requests   tokenBucket
+	commands   map[string]*tokenBucket
+	strikes    int
+	lastStrike time.Time
+	mutedUntil time.Time
+	lastSeen   time.Time
+}
+
+// check decides what happens to request of the specified command.
+// Every time the limits are exceeded, client gets a strike, and
+// punishment escalates with the number of strikes.
+func (g *floodGuard) check(limits RateLimits, cmd string, now time.Time) floodAction {
+	g.lastSeen = now
+	if now.Before(g.mutedUntil) {
+		return floodMuted
+	}
+	ok := g.requests.allow(limits.Requests, now)
+	if limit, limited := limits.Commands[cmd]; ok && limited {
+		if g.commands == nil {
+			g.commands = make(map[string]*tokenBucket)
+		}
+		b, exists := g.commands[cmd]
+		if !exists {
+			b = &tokenBucket{}
+			g.commands[cmd] = b
+		}
+		ok = b.allow(limit, now)
+	}
+	if ok {
+		return floodAllow
+	}
+	if now.Sub(g.lastStrike) > strikeExpiry && now.Sub(g.mutedUntil) > strikeExpiry {
+		g.strikes = 0
+	}
+	g.strikes++
+	g.lastStrike = now
+	switch g.strikes {
+	case 1:
+		return floodWarn
+	case 2:
+		g.mutedUntil = now.Add(time.Duration(limits.MuteSeconds) * time.Second)
+		return floodMute
+	default:
+		return floodDisconnect
+	}
+}
+
+// expired tells whether client has been quiet long enough for its
+// strikes to expire and buckets to be refilled.
+func (g *floodGuard) expired(now time.Time) bool {
+	return now.Sub(g.lastSeen) > strikeExpiry && now.Sub(g.mutedUntil) > strikeExpiry
+}
+
+// floodGuards keeps flood guards of clients by key, e.g. account, so
+// that limits and strikes are shared by connections of a client and
+// outlive them. Guards of clients which stay quiet are forgotten.
+type floodGuards struct {
+	guards    map[string]*floodGuard
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+// check decides what happens to request of the specified command
+// made by client with the specified key.
+func (gs *floodGuards) check(key string, limits RateLimits, cmd string, now time.Time) floodAction {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if gs.guards == nil {
+		gs.guards = make(map[string]*floodGuard)
+	}
+	if now.Sub(gs.lastSweep) > strikeExpiry {
+		for k, g := range gs.guards {
+			if g.expired(now) {
+				delete(gs.guards, k)
+			}
+		}
+		gs.lastSweep = now
+	}
+	g, ok := gs.guards[key]
+	if !ok {
+		g = &floodGuard{}
+		gs.guards[key] = g
+	}
+	return g.check(limits, cmd, now)
+}
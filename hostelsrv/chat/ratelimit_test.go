@@ -0,0 +1,102 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket_BurstUsed_RefilledWithRate(t *testing.T) {
+	b := tokenBucket{}
+	limit := RateLimit{Rate: 2, Burst: 3}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.allow(limit, now))
+	}
+	assert.False(t, b.allow(limit, now))
+	assert.True(t, b.allow(limit, now.Add(500*time.Millisecond)))
+	assert.False(t, b.allow(limit, now.Add(500*time.Millisecond)))
+}
+
+func TestTokenBucket_NoRate_Unlimited(t *testing.T) {
+	b := tokenBucket{}
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, b.allow(RateLimit{}, now))
+	}
+}
+
+func TestFloodGuard_LimitsExceeded_PunishmentEscalates(t *testing.T) {
+	g := floodGuard{}
+	limits := RateLimits{
+		Requests:    RateLimit{Rate: 1, Burst: 1},
+		MuteSeconds: 10,
+	}
+	now := time.Now()
+
+	assert.Equal(t, floodAllow, g.check(limits, "publish", now))
+	assert.Equal(t, floodWarn, g.check(limits, "publish", now))
+	assert.Equal(t, floodMute, g.check(limits, "publish", now))
+	assert.Equal(t, floodMuted, g.check(limits, "who", now.Add(9*time.Second)))
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, floodAllow, g.check(limits, "publish", now))
+	assert.Equal(t, floodDisconnect, g.check(limits, "publish", now))
+}
+
+func TestFloodGuard_StrikesExpired_WarnedAgain(t *testing.T) {
+	g := floodGuard{}
+	limits := RateLimits{Requests: RateLimit{Rate: 1, Burst: 1}}
+	now := time.Now()
+
+	g.check(limits, "publish", now)
+	assert.Equal(t, floodWarn, g.check(limits, "publish", now))
+	now = now.Add(strikeExpiry + time.Second)
+	g.check(limits, "publish", now)
+	assert.Equal(t, floodWarn, g.check(limits, "publish", now))
+}
+
+func TestFloodGuard_CommandLimit_OtherCommandsAllowed(t *testing.T) {
+	g := floodGuard{}
+	limits := RateLimits{
+		Commands: map[string]RateLimit{"publish": {Rate: 1, Burst: 1}},
+	}
+	now := time.Now()
+
+	assert.Equal(t, floodAllow, g.check(limits, "publish", now))
+	assert.Equal(t, floodWarn, g.check(limits, "publish", now))
+	assert.Equal(t, floodAllow, g.check(limits, "who", now))
+}
+
+func TestFloodGuards_SameKey_GuardShared(t *testing.T) {
+	gs := floodGuards{}
+	limits := RateLimits{Requests: RateLimit{Rate: 1, Burst: 1}}
+	now := time.Now()
+
+	assert.Equal(t, floodAllow, gs.check("@user1", limits, "publish", now))
+	assert.Equal(t, floodWarn, gs.check("@user1", limits, "publish", now))
+	assert.Equal(t, floodAllow, gs.check("@user2", limits, "publish", now))
+}
+
+func TestFloodGuards_QuietClient_GuardForgotten(t *testing.T) {
+	gs := floodGuards{}
+	limits := RateLimits{Requests: RateLimit{Rate: 1, Burst: 1}, MuteSeconds: 10}
+	now := time.Now()
+
+	gs.check("@user1", limits, "publish", now)
+	gs.check("@user1", limits, "publish", now)
+	gs.check("@user1", limits, "publish", now)
+	gs.check("@user2", limits, "publish", now)
+	now = now.Add(strikeExpiry + 5*time.Second)
+	gs.check("@user2", limits, "publish", now)
+
+	assert.Contains(t, gs.guards, "@user1")
+	assert.Contains(t, gs.guards, "@user2")
+	now = now.Add(10 * time.Second)
+	gs.check("@user2", limits, "publish", now.Add(strikeExpiry))
+
+	assert.NotContains(t, gs.guards, "@user1")
+	assert.Contains(t, gs.guards, "@user2")
+}
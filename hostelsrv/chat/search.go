@@ -0,0 +1,142 @@
+package chat
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// searchQuery selects messages of room history. Messages must contain
+// all of the words, and filters apply when they are not zero. Nick is
+// matched ignoring case.
+type searchQuery struct {
+	words []string
+	nick  string
+	from  time.Time
+	to    time.Time
+	limit int
+}
+
+// searchIndex is an inverted index over items of room history. It maps
+// every word to items which contain it along with number of occurrences.
+// Index keeps at most cap of the latest items, which may be more than
+// room history keeps in memory. Items without ID, which were kept since
+// before messages got IDs, are not indexed.
+type searchIndex struct {
+	items    map[uint64]historyItem
+	postings map[string]map[uint64]int
+	// order lists IDs of indexed items, oldest first.
+	order []uint64
+	cap   int
+}
+
+func newSearchIndex(cap int) *searchIndex {
+	return &searchIndex{
+		items:    make(map[uint64]historyItem),
+		postings: make(map[string]map[uint64]int),
+		cap:      cap,
+	}
+}
+
+// searchWords splits text to lowercase words of letters and digits.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// add indexes item, which is newer than indexed ones, and removes
+// the oldest item if index is full.
+func (idx *searchIndex) add(item historyItem) {
+	if item.id == 0 {
+		return
+	}
+	idx.items[item.id] = item
+	idx.order = append(idx.order, item.id)
+	idx.trim()
+	for _, w := range searchWords(item.msg) {
+		p, ok := idx.postings[w]
+		if !ok {
+			p = make(map[uint64]int)
+			idx.postings[w] = p
+		}
+		p[item.id]++
+	}
+}
+
+// setCap changes number of indexed items, removing the oldest ones
+// which exceed it.
+func (idx *searchIndex) setCap(cap int) {
+	idx.cap = cap
+	idx.trim()
+}
+
+func (idx *searchIndex) trim() {
+	for len(idx.order) > idx.cap {
+		id := idx.order[0]
+		idx.order = idx.order[1:]
+		idx.remove(idx.items[id])
+	}
+}
+
+func (idx *searchIndex) remove(item historyItem) {
+	if _, ok := idx.items[item.id]; !ok {
+		return
+	}
+	delete(idx.items, item.id)
+	for _, w := range searchWords(item.msg) {
+		p := idx.postings[w]
+		delete(p, item.id)
+		if len(p) == 0 {
+			delete(idx.postings, w)
+		}
+	}
+}
+
+// search returns items matching the query, the most relevant first.
+// Items are ranked by TF-IDF, so that rare words weigh more than
+// common ones, and the latest of equally relevant items go first.
+func (idx *searchIndex) search(q searchQuery) []historyItem {
+	if len(q.words) == 0 {
+		return nil
+	}
+	scores := make(map[uint64]float64)
+	for i, w := range q.words {
+		p := idx.postings[w]
+		idf := math.Log(1 + float64(len(idx.items))/float64(len(p)+1))
+		for id, tf := range p {
+			if _, ok := scores[id]; i == 0 || ok {
+				scores[id] += float64(tf) * idf
+			}
+		}
+		// Items must contain every word.
+		for id := range scores {
+			if _, ok := p[id]; !ok {
+				delete(scores, id)
+			}
+		}
+	}
+	var found []historyItem
+	for id := range scores {
+		item := idx.items[id]
+		if q.nick != "" && !strings.EqualFold(item.nick, q.nick) ||
+			!q.from.IsZero() && item.time.Before(q.from) ||
+			!q.to.IsZero() && item.time.After(q.to) {
+			continue
+		}
+		found = append(found, item)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		si, sj := scores[found[i].id], scores[found[j].id]
+		if si != sj {
+			return si > sj
+		}
+		return found[i].id > found[j].id
+	})
+	if q.limit > 0 && len(found) > q.limit {
+		found = found[:q.limit]
+	}
+	return found
+}
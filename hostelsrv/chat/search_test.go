@@ -0,0 +1,72 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchWords_GivenText_LowercaseWords(t *testing.T) {
+	assert.Equal(t, []string{"hello", "wörld", "42"}, searchWords("Hello, WÖRLD! (42)"))
+	assert.Empty(t, searchWords(" ?! "))
+}
+
+func TestSearchIndexSearch_GivenWords_AllWordsMatchedRanked(t *testing.T) {
+	idx := newSearchIndex(128)
+	idx.add(historyItem{id: 1, nick: "nick1", msg: "deploy is done"})
+	idx.add(historyItem{id: 2, nick: "nick2", msg: "Deploy failed, deploy again"})
+	idx.add(historyItem{id: 3, nick: "nick1", msg: "lunch?"})
+	idx.add(historyItem{id: 4, nick: "nick3", msg: "deploy done"})
+
+	ids := func(items []historyItem) []uint64 {
+		var ids []uint64
+		for _, item := range items {
+			ids = append(ids, item.id)
+		}
+		return ids
+	}
+	assert.Equal(t, []uint64{2, 4, 1}, ids(idx.search(searchQuery{words: []string{"deploy"}})))
+	assert.Equal(t, []uint64{4, 1}, ids(idx.search(searchQuery{words: []string{"deploy", "done"}})))
+	assert.Equal(t, []uint64{2}, ids(idx.search(searchQuery{words: []string{"deploy"}, limit: 1})))
+	assert.Empty(t, idx.search(searchQuery{words: []string{"deploy", "lunch"}}))
+	assert.Empty(t, idx.search(searchQuery{words: []string{"dinner"}}))
+}
+
+func TestSearchIndexSearch_FiltersGiven_ItemsFiltered(t *testing.T) {
+	at := time.Date(2026, 10, 17, 7, 0, 0, 0, time.UTC)
+	idx := newSearchIndex(128)
+	idx.add(historyItem{id: 1, time: at, nick: "nick1", msg: "msg"})
+	idx.add(historyItem{id: 2, time: at.Add(time.Hour), nick: "nick2", msg: "msg"})
+	idx.add(historyItem{id: 3, time: at.Add(2 * time.Hour), nick: "nick1", msg: "msg"})
+
+	words := []string{"msg"}
+	assert.Len(t, idx.search(searchQuery{words: words, nick: "nick1"}), 2)
+	assert.Len(t, idx.search(searchQuery{words: words, nick: "NICK1"}), 2)
+	assert.Equal(t, []historyItem{{id: 2, time: at.Add(time.Hour), nick: "nick2", msg: "msg"}},
+		idx.search(searchQuery{words: words, from: at.Add(time.Minute), to: at.Add(time.Hour)}))
+}
+
+func TestSearchIndexAdd_CapExceeded_OldestNotFound(t *testing.T) {
+	idx := newSearchIndex(2)
+	idx.add(historyItem{id: 1, nick: "nick1", msg: "msg1 common"})
+	idx.add(historyItem{id: 2, nick: "nick1", msg: "msg2 common"})
+	idx.add(historyItem{nick: "nick1", msg: "msg3 common"})
+	idx.add(historyItem{id: 4, nick: "nick1", msg: "msg4 common"})
+
+	assert.Empty(t, idx.search(searchQuery{words: []string{"msg1"}}))
+	assert.Len(t, idx.search(searchQuery{words: []string{"common"}}), 2)
+	assert.NotContains(t, idx.postings, "msg1")
+}
+
+func TestSearchIndexSetCap_Decreased_OldestNotFound(t *testing.T) {
+	idx := newSearchIndex(3)
+	idx.add(historyItem{id: 1, nick: "nick1", msg: "msg1 common"})
+	idx.add(historyItem{id: 2, nick: "nick1", msg: "msg2 common"})
+	idx.add(historyItem{id: 3, nick: "nick1", msg: "msg3 common"})
+
+	idx.setCap(1)
+
+	assert.Equal(t, []uint64{3}, idx.order)
+	assert.Len(t, idx.search(searchQuery{words: []string{"common"}}), 1)
+}
@@ -1,13 +1,15 @@
 package chat
 
 import (
-	"bufio"
 	"crypto/rand"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Command provides interface for an action accepted by chat service.
@@ -20,18 +22,55 @@ type Unsubscriber interface {
 	Unsubscribe(user identity)
 }
 
+// rebinder is implemented by Unsubscriber which can move memberships
+// of user to another identity instead of removing them, e.g. Disconnector.
+type rebinder interface {
+	Rebind(from identity, to identity) []string
+}
+
 // Client defines requirements for chat client.
 type Client interface {
 	io.ReadWriteCloser
 }
 
-type message string
 type identity string
 
 // Service encapsulates features of chat server.
 type Service struct {
 	unsubscriber Unsubscriber
 	commands     map[string]Command
+	auth         Authenticator
+	online       map[identity]struct{}
+	om           sync.Mutex
+	queueSize    int
+	overflow     OverflowPolicy
+	limits       RateLimits
+	lm           sync.Mutex
+	floods       floodGuards
+	frameSize    int
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	conns        map[*connection]struct{}
+	closing      bool
+	cm           sync.Mutex
+	handlers     sync.WaitGroup
+}
+
+// connection lets service to stop handling of a client on shutdown.
+type connection struct {
+	cl      Client
+	queue   *outbox
+	stop    func()
+	drained chan struct{}
+}
+
+// session keeps state of a single client connection.
+type session struct {
+	user  identity
+	host  string
+	proto string
+	mu    sync.Mutex
 }
 
 // NewService creates new instance of chat service with
@@ -40,84 +79,484 @@ func NewService(commands map[string]Command, unsubscriber Unsubscriber) *Service
 	return &Service{
 		unsubscriber: unsubscriber,
 		commands:     commands,
+		online:       make(map[identity]struct{}),
+		conns:        make(map[*connection]struct{}),
+		queueSize:    DefaultQueueSize,
+		overflow:     DropOldest,
+		frameSize:    DefaultFrameSize,
 	}
 }
 
+// SetAuthenticator enables "auth" command, which lets clients to bind
+// connection to account verified by the specified authenticator.
+func (s *Service) SetAuthenticator(auth Authenticator) {
+	s.auth = auth
+}
+
+// SetQueue limits number of events waiting to be written to every
+// client. When a client doesn't read fast enough and its queue is
+// full, the specified policy is applied.
+func (s *Service) SetQueue(size int, policy OverflowPolicy) {
+	s.queueSize = size
+	s.overflow = policy
+}
+
+// SetFrameSize limits length of request lines. Longer lines are
+// rejected with error, and client stays connected.
+func (s *Service) SetFrameSize(size int) {
+	s.frameSize = size
+}
+
+// SetTimeouts limits time of reading request line once client started
+// to send it, time of writing events to client, and time client may
+// stay without sending any request. Zero duration means no limit.
+// Timeouts are applied to clients which support deadlines, and client
+// which exceeds them is disconnected.
+func (s *Service) SetTimeouts(read time.Duration, write time.Duration, idle time.Duration) {
+	s.readTimeout = read
+	s.writeTimeout = write
+	s.idleTimeout = idle
+}
+
+// SetRateLimits throttles requests of clients. Limits can be changed
+// while clients are connected.
+func (s *Service) SetRateLimits(limits RateLimits) {
+	s.lm.Lock()
+	defer s.lm.Unlock()
+	s.limits = limits
+}
+
+func (s *Service) rateLimits() RateLimits {
+	s.lm.Lock()
+	defer s.lm.Unlock()
+	return s.limits
+}
+
 func randToken() string {
 	b := make([]byte, 8)
 	rand.Read(b)
 	return fmt.Sprintf("%x", b)
 }
 
+// defaultHandshakeTimeout limits time of TLS handshake when read
+// timeout is not set, so that client which never sends anything
+// doesn't hold the connection.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// tlsClient is implemented by TLS connections, e.g. tls.Conn.
+type tlsClient interface {
+	Handshake() error
+	ConnectionState() tls.ConnectionState
+}
+
+// clientIdentity returns identity of account when client presented
+// verified TLS certificate, which common name is name of existing
+// account. Otherwise, random identity is returned. Handshake must
+// complete within read timeout.
+func (s *Service) clientIdentity(cl Client) identity {
+	if tc, ok := cl.(tlsClient); ok {
+		if dc, ok := cl.(deadlineClient); ok {
+			timeout := s.readTimeout
+			if timeout <= 0 {
+				timeout = defaultHandshakeTimeout
+			}
+			deadline := time.Now().Add(timeout)
+			dc.SetReadDeadline(deadline)
+			dc.SetWriteDeadline(deadline)
+			// Connection has no deadlines before handshake, and it's
+			// done before anything else is read or written. Afterwards
+			// frameReader sets read deadline before every line and
+			// handleOutgoing sets write deadline before every write,
+			// unless their timeouts are zero or negative.
+			defer dc.SetReadDeadline(time.Time{})
+			defer dc.SetWriteDeadline(time.Time{})
+		}
+		if err := tc.Handshake(); err != nil {
+			log.Println("TLS handshake failed:", err)
+			return identity(randToken())
+		}
+		chains := tc.ConnectionState().VerifiedChains
+		if len(chains) > 0 && chains[0][0].Subject.CommonName != "" {
+			name := chains[0][0].Subject.CommonName
+			if !validAccountName(name) || s.auth == nil || !s.auth.HasAccount(name) {
+				log.Printf("Certificate of unknown account %q", name)
+				return identity(randToken())
+			}
+			if s.signIn(accountIdentity(name)) {
+				log.Println("Signed in by certificate as", name)
+				return accountIdentity(name)
+			}
+			log.Println("Account", name, "is already signed in")
+		}
+	}
+	return identity(randToken())
+}
+
 // HandleClient starts handling chat commands from the specified client.
 func (s *Service) HandleClient(cl Client) {
 	defer cl.Close()
 
-	user := identity(randToken())
-	disconnect := make(chan struct{}, 1)
+	disconnect := make(chan struct{})
+	once := sync.Once{}
+	conn := &connection{
+		cl:      cl,
+		queue:   newOutbox(s.queueSize, s.overflow),
+		stop:    func() { once.Do(func() { close(disconnect) }) },
+		drained: make(chan struct{}),
+	}
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+
+	sess := &session{
+		user:  s.clientIdentity(cl),
+		host:  clientHost(cl),
+		proto: protoLegacy,
+	}
+	wg := sync.WaitGroup{}
 	defer func() {
-		close(disconnect)
-		s.unsubscriber.Unsubscribe(user)
+		conn.stop()
+		wg.Wait()
 	}()
 
 	incoming := make(chan message)
 	outgoing := make(chan message)
+	flooded := make(chan struct{})
+	queue := conn.queue
 
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+	wg.Add(3)
 	go func() {
 		defer wg.Done()
 		defer close(outgoing)
-		s.handleIncoming(user, incoming, outgoing, disconnect)
+		// User leaves rooms before outgoing is closed,
+		// so that nobody sends messages to closed channel.
+		defer func() {
+			user := sess.identity()
+			s.unsubscriber.Unsubscribe(user)
+			s.signOut(user)
+		}()
+		if !s.handleIncoming(sess, incoming, outgoing, disconnect) {
+			close(flooded)
+			conn.stop()
+		}
 	}()
 	go func() {
 		defer wg.Done()
-		s.handleOutgoing(cl, outgoing)
+		defer queue.close()
+		s.enqueueOutgoing(sess, cl, outgoing, queue)
+	}()
+	go func() {
+		defer wg.Done()
+		defer close(conn.drained)
+		err := s.handleOutgoing(cl, queue)
+		// Client which can't be written to, e.g. because of timeout, or
+		// which floods and has been told why, is disconnected, so that
+		// reading doesn't wait for it to send anything.
+		select {
+		case <-flooded:
+			cl.Close()
+		default:
+			if err != nil {
+				cl.Close()
+			}
+		}
 	}()
 
-	scanner := bufio.NewScanner(cl)
-	for scanner.Scan() {
-		incoming <- message(scanner.Text())
+	frames := newFrameReader(cl, s.frameSize)
+	frames.readTimeout = s.readTimeout
+	frames.idleTimeout = s.idleTimeout
+	for {
+		m := message{}
+		line, err := frames.next()
+		if _, tooLong := err.(*chatError); tooLong {
+			m = errorReply(err)
+		} else if err != nil {
+			s.readFailed(sess, queue, err)
+			return
+		} else {
+			m.text = line
+		}
+		select {
+		case incoming <- m:
+		case <-disconnect:
+			return
+		}
+	}
+}
+
+func (s *Service) readFailed(sess *session, queue *outbox, err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		log.Println("Client", sess.identity(), "timed out")
+		queue.push(noticeMsg("Connection timed out."))
+		return
 	}
-	if err := scanner.Err(); err != nil {
+	if err != io.EOF {
 		log.Println("Error reading input:", err)
 	}
-	disconnect <- struct{}{}
-	wg.Wait()
 }
 
-func (s *Service) handleIncoming(user identity, incoming <-chan message,
-	outgoing chan<- message, disconnect <-chan struct{}) {
+func (s *Service) track(conn *connection) bool {
+	s.cm.Lock()
+	defer s.cm.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *Service) untrack(conn *connection) {
+	s.cm.Lock()
+	delete(s.conns, conn)
+	s.cm.Unlock()
+	s.handlers.Done()
+}
+
+// Shutdown stops handling requests and tells every client, and so
+// members of every room, that server is shutting down. Events already
+// queued for clients are written to them within the specified timeout,
+// then clients are disconnected. Clients which connect after Shutdown
+// is called are disconnected immediately.
+func (s *Service) Shutdown(timeout time.Duration) {
+	s.cm.Lock()
+	s.closing = true
+	conns := make([]*connection, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.cm.Unlock()
+
+	for _, conn := range conns {
+		conn.queue.push(noticeMsg("Server is shutting down."))
+		conn.stop()
+	}
+	deadline := time.After(timeout)
+	for _, conn := range conns {
+		select {
+		case <-conn.drained:
+		case <-deadline:
+		}
+	}
+	for _, conn := range conns {
+		conn.cl.Close()
+	}
+	s.handlers.Wait()
+}
+
+// handleIncoming handles requests until client disconnects. It returns
+// false when client must be disconnected because of flooding.
+func (s *Service) handleIncoming(sess *session, incoming <-chan message,
+	outgoing chan<- message, disconnect <-chan struct{}) bool {
 
 	for {
 		select {
 		case <-disconnect:
-			return
+			return true
 		case m := <-incoming:
-			na := strings.SplitN(string(m), "|", 2)
-			name, args := na[0], ""
-			if len(na) > 1 {
-				args = na[1]
+			if m.kind == kindError {
+				// Request couldn't be read, e.g. it's too long,
+				// which counts towards limit of requests.
+				outgoing <- message{kind: kindBegin}
+				if action := s.throttle(sess, "", outgoing); action == floodDisconnect {
+					return false
+				} else if action == floodAllow {
+					outgoing <- m
+				}
+				continue
 			}
-			if cmd, ok := s.commands[name]; ok {
+			req, err := parseRequest(m.text, sess.proto)
+			outgoing <- message{kind: kindBegin, id: req.id}
+			if err != nil {
+				outgoing <- errorReply(err)
+			} else if action := s.throttle(sess, req.name, outgoing); action != floodAllow {
+				if action == floodDisconnect {
+					return false
+				}
+			} else if req.name == "ping" {
+				outgoing <- noticeMsg("pong")
+			} else if req.name == "proto" {
+				sess.proto = s.switchProto(sess.proto, req.args, outgoing)
+			} else if req.name == "auth" && s.auth != nil {
+				s.authenticate(sess, req.args, outgoing)
+			} else if cmd, ok := s.commands[req.name]; ok {
 				func() {
 					defer func() {
 						if r := recover(); r != nil {
-							outgoing <- "Unexpected server error!"
-							log.Println("Command", name, "paniced:", r)
+							outgoing <- errorMsg(codeInternal, "Unexpected server error!")
+							log.Println("Command", req.name, "paniced:", r)
 						}
 					}()
-					cmd.Handle(user, args, outgoing)
+					cmd.Handle(sess.identity(), req.args, outgoing)
 				}()
 			} else {
-				outgoing <- message("Unknown command: " + name + ".")
+				outgoing <- errorMsg(codeUnknownCommand, "Unknown command: "+req.name+".")
 			}
+			outgoing <- message{kind: kindAck, id: req.id}
 		}
 	}
 }
 
-func (s *Service) handleOutgoing(w io.Writer, outgoing <-chan message) {
+// throttle applies rate limits to request of the specified command,
+// which is empty when request couldn't be read. Request which exceeds
+// limits is answered with error and must not be handled.
+func (s *Service) throttle(sess *session, cmd string, outgoing chan<- message) floodAction {
+	limits := s.rateLimits()
+	action := s.floods.check(sess.floodKey(), limits, cmd, time.Now())
+	if cmd == "" {
+		cmd = "requests"
+	}
+	switch action {
+	case floodWarn:
+		log.Println("Client", sess.identity(), "exceeds rate limit of", cmd+", warned")
+		outgoing <- errorMsg(codeRateLimited, "Too many requests, slow down.")
+	case floodMute:
+		log.Println("Client", sess.identity(), "exceeds rate limit of", cmd+", muted")
+		outgoing <- errorMsg(codeRateLimited,
+			fmt.Sprintf("Too many requests, you are muted for %d seconds.", limits.MuteSeconds))
+	case floodMuted:
+		outgoing <- errorMsg(codeRateLimited, "You are muted for flooding.")
+	case floodDisconnect:
+		log.Println("Client", sess.identity(), "exceeds rate limit of", cmd+", disconnected")
+		outgoing <- errorMsg(codeRateLimited, "Too many requests, disconnecting.")
+	}
+	return action
+}
+
+func (s *Service) switchProto(current string, proto string, outgoing chan<- message) string {
+	if proto != protoLegacy && proto != protoJSON {
+		outgoing <- errorMsg(codeBadRequest, "Unsupported protocol: "+proto+".")
+		return current
+	}
+	outgoing <- message{kind: kindSwitch, text: proto}
+	return proto
+}
+
+// enqueueOutgoing moves events sent to client into its queue. Events
+// are taken from outgoing as soon as they are sent, so that senders
+// never wait for client to read them.
+func (s *Service) enqueueOutgoing(sess *session, cl Client,
+	outgoing <-chan message, queue *outbox) {
+
+	disconnected := false
 	for m := range outgoing {
-		fmt.Fprintln(w, m)
+		if !queue.push(m) && !disconnected {
+			disconnected = true
+			log.Println("Disconnecting slow client", sess.identity())
+			// Closing may wait for a pending write, which we don't want
+			// to keep senders waiting for.
+			go cl.Close()
+		}
 	}
 }
+
+func (s *Service) handleOutgoing(w io.Writer, queue *outbox) error {
+	enc := encoder{w: w, proto: protoLegacy}
+	conn, _ := w.(deadlineClient)
+	for {
+		items, ok := queue.take()
+		if !ok {
+			return nil
+		}
+		if conn != nil && s.writeTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		}
+		for _, m := range items {
+			if err := enc.encode(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Service) authenticate(sess *session, args string, outgoing chan<- message) {
+	np := strings.SplitN(args, "|", 2)
+	if np[0] == "" || len(np) == 1 {
+		outgoing <- errorMsg(codeBadRequest, "User name or password is missing.")
+		return
+	}
+	user, err := s.auth.Authenticate(np[0], np[1])
+	if err != nil {
+		log.Println("Failed sign in attempt for", np[0]+":", err)
+		outgoing <- errorReply(err)
+		return
+	}
+	prev := sess.identity()
+	if prev == user {
+		outgoing <- noticeMsg("Already signed in as " + np[0] + ".")
+		return
+	}
+	if !s.signIn(user) {
+		outgoing <- errorMsg(codeSignedIn, "Account "+np[0]+" is already signed in.")
+		return
+	}
+	// Subscriptions are bound to identity, so they follow the user
+	// to the new one, and the user is told about rooms left.
+	var left []string
+	rb, canRebind := s.unsubscriber.(rebinder)
+	if canRebind {
+		left = rb.Rebind(prev, user)
+	} else {
+		s.unsubscriber.Unsubscribe(prev)
+	}
+	s.signOut(prev)
+	sess.bind(user)
+	log.Println("Signed in as", np[0])
+	outgoing <- noticeMsg("Signed in as " + np[0] + ".")
+	if !canRebind {
+		outgoing <- noticeMsg("You left all rooms.")
+	}
+	for _, room := range left {
+		outgoing <- noticeMsg("You left " + room + ", account " + np[0] + " is banned from it.")
+	}
+}
+
+func (s *Service) signIn(user identity) bool {
+	s.om.Lock()
+	defer s.om.Unlock()
+	if _, ok := s.online[user]; ok {
+		return false
+	}
+	s.online[user] = struct{}{}
+	return true
+}
+
+func (s *Service) signOut(user identity) {
+	s.om.Lock()
+	defer s.om.Unlock()
+	delete(s.online, user)
+}
+
+func (sess *session) identity() identity {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.user
+}
+
+// floodKey returns key of rate limits of session. Connections of the
+// same account share limits, as well as anonymous ones from the same
+// host, so that reconnecting client doesn't start from scratch.
+func (sess *session) floodKey() string {
+	user := sess.identity()
+	if _, ok := user.account(); ok || sess.host == "" {
+		return string(user)
+	}
+	return sess.host
+}
+
+// clientHost returns host of remote address of client, if it has one.
+func clientHost(cl Client) string {
+	if rc, ok := cl.(interface{ RemoteAddr() net.Addr }); ok {
+		if host, _, err := net.SplitHostPort(rc.RemoteAddr().String()); err == nil {
+			return host
+		}
+	}
+	return ""
+}
+
+func (sess *session) bind(user identity) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.user = user
+}
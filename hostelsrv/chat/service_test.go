@@ -1,9 +1,22 @@
 package chat
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -31,9 +44,58 @@ func (cl *testClient) Close() error {
 	return nil
 }
 
+// pipeClient is a client which requests are written by test. Stuck
+// client never reads what service writes to it.
+type pipeClient struct {
+	in     *io.PipeReader
+	input  *io.PipeWriter
+	lines  chan string
+	stuck  bool
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeClient(stuck bool) *pipeClient {
+	in, input := io.Pipe()
+	return &pipeClient{
+		in:     in,
+		input:  input,
+		lines:  make(chan string, 64),
+		stuck:  stuck,
+		closed: make(chan struct{}),
+	}
+}
+
+func (cl *pipeClient) Read(p []byte) (n int, err error) {
+	return cl.in.Read(p)
+}
+
+func (cl *pipeClient) Write(p []byte) (n int, err error) {
+	if cl.stuck {
+		<-cl.closed
+		return 0, io.ErrClosedPipe
+	}
+	for _, ln := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		cl.lines <- ln
+	}
+	return len(p), nil
+}
+
+func (cl *pipeClient) Close() error {
+	cl.once.Do(func() {
+		close(cl.closed)
+		cl.in.Close()
+	})
+	return nil
+}
+
+func (cl *pipeClient) send(line string) {
+	fmt.Fprintln(cl.input, line)
+}
+
 type testCommand struct {
 	handleArgs      string
-	outgoingMessage message
+	outgoingMessage string
 	panic           interface{}
 }
 
@@ -42,7 +104,7 @@ func (cmd *testCommand) Handle(user identity, args string, outgoing chan<- messa
 		panic(cmd.panic)
 	}
 	if cmd.outgoingMessage != "" {
-		outgoing <- cmd.outgoingMessage
+		outgoing <- noticeMsg(cmd.outgoingMessage)
 	}
 	cmd.handleArgs = args
 }
@@ -176,3 +238,486 @@ func TestServiceHandleClient_ReadPaniced_UnsubscribesClient(t *testing.T) {
 	s := NewService(nil, &uns)
 	s.HandleClient(cl)
 }
+
+func TestServiceHandleClient_JSONNegotiated_RepliesInJSON(t *testing.T) {
+	cl := &testClient{}
+	fmt.Fprintln(&cl.readBuf, "proto|json/1")
+	fmt.Fprintln(&cl.readBuf, `{"id":1,"cmd":"cmd1","args":["arg1","arg2"]}`)
+	fmt.Fprintln(&cl.readBuf, `{"id":2,"cmd":"cmd2"}`)
+	fmt.Fprintln(&cl.readBuf, `not a json`)
+
+	cmd1 := testCommand{outgoingMessage: "message1"}
+	cmds := map[string]Command{
+		"cmd1": &cmd1,
+	}
+
+	s := NewService(cmds, &testUnsubscriber{})
+	s.HandleClient(cl)
+
+	assert.Equal(t, "arg1|arg2", cmd1.handleArgs)
+	lines := strings.Split(cl.writeBuf.String(), "\n")
+	assert.Len(t, lines, 6)
+	assert.Equal(t, `{"type":"ack"}`, lines[0])
+	assert.Equal(t, `{"type":"notice","text":"message1"}`, lines[1])
+	assert.Equal(t, `{"type":"ack","id":1}`, lines[2])
+	assert.Equal(t, `{"type":"error","id":2,"code":"unknown_command","text":"Unknown command: cmd2."}`, lines[3])
+	assert.Contains(t, lines[4], `"code":"bad_request"`)
+}
+
+func TestServiceHandleClient_UnsupportedProto_ErrorWritten(t *testing.T) {
+	cl := &testClient{}
+	fmt.Fprintln(&cl.readBuf, "proto|xml")
+	fmt.Fprintln(&cl.readBuf, "cmd1")
+
+	s := NewService(nil, &testUnsubscriber{})
+	s.HandleClient(cl)
+
+	assert.Equal(t, "Unsupported protocol: xml.\nUnknown command: cmd1.\n", cl.writeBuf.String())
+}
+
+type testAuthenticator map[string]string
+
+func (auth testAuthenticator) Authenticate(name string, password string) (identity, error) {
+	if p, ok := auth[name]; ok && p == password {
+		return accountIdentity(name), nil
+	}
+	return "", newError(codeAuthFailed, "Invalid user name or password")
+}
+
+func (auth testAuthenticator) HasAccount(name string) bool {
+	_, ok := auth[name]
+	return ok
+}
+
+type testIdentityCommand struct {
+	users []identity
+}
+
+func (cmd *testIdentityCommand) Handle(user identity, args string, outgoing chan<- message) {
+	cmd.users = append(cmd.users, user)
+}
+
+func TestServiceHandleClient_AuthSucceeded_IdentityBound(t *testing.T) {
+	cl := &testClient{}
+	fmt.Fprintln(&cl.readBuf, "cmd1")
+	fmt.Fprintln(&cl.readBuf, "auth|user1|secret1")
+	fmt.Fprintln(&cl.readBuf, "cmd1")
+
+	cmd1 := testIdentityCommand{}
+	uns := testUnsubscriber{}
+	s := NewService(map[string]Command{"cmd1": &cmd1}, &uns)
+	s.SetAuthenticator(testAuthenticator{"user1": "secret1"})
+	s.HandleClient(cl)
+
+	assert.Len(t, cmd1.users, 2)
+	assert.NotEqual(t, identity("@user1"), cmd1.users[0])
+	assert.Equal(t, identity("@user1"), cmd1.users[1])
+	assert.Equal(t, "Signed in as user1.\nYou left all rooms.\n", cl.writeBuf.String())
+	assert.True(t, uns.invoked)
+	assert.Empty(t, s.online)
+}
+
+func TestServiceHandleClient_AuthSucceeded_SubscriptionsKept(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	hub.CreateRoom("room2")
+	hub.ban("room2", "@user1", "")
+	members := make(chan message, 8)
+	hub.SubscribeToRoom("id2", "room1", subscriber{nick: "nick2", outgoing: members})
+	hub.SubscribeToRoom("id2", "room2", subscriber{nick: "nick2", outgoing: members})
+	cl := &testClient{}
+	fmt.Fprintln(&cl.readBuf, "subscribe|room1:nick1|room2:nick1")
+	fmt.Fprintln(&cl.readBuf, "auth|user1|secret1")
+	fmt.Fprintln(&cl.readBuf, "publish|room1|msg1")
+
+	cmds := map[string]Command{
+		"subscribe": NewSubscribeCommand(hub),
+		"publish":   NewPublishCommand(hub, 254),
+	}
+	s := NewService(cmds, NewDisconnector(hub))
+	s.SetAuthenticator(testAuthenticator{"user1": "secret1"})
+	s.HandleClient(cl)
+
+	assert.Contains(t, cl.writeBuf.String(), "Signed in as user1.\n"+
+		"You left room2, account user1 is banned from it.\n")
+	assert.Equal(t, "* nick1 joined room1.", (<-members).String())
+	assert.Equal(t, "* nick1 joined room2.", (<-members).String())
+	assert.Equal(t, "* nick1 left room2.", (<-members).String())
+	assert.Equal(t, "nick1@room1: msg1", unstamped(<-members))
+	assert.Equal(t, "* nick1 disconnected.", (<-members).String())
+}
+
+func TestServiceHandleClient_AuthFailed_ErrorWritten(t *testing.T) {
+	testCases := []struct {
+		args  string
+		reply string
+	}{
+		{args: "", reply: "User name or password is missing."},
+		{args: "user1", reply: "User name or password is missing."},
+		{args: "user1|secret2", reply: "Invalid user name or password."},
+		{args: "user2|secret1", reply: "Invalid user name or password."},
+	}
+
+	for _, testCase := range testCases {
+		cl := &testClient{}
+		fmt.Fprintln(&cl.readBuf, "auth|"+testCase.args)
+
+		s := NewService(nil, &testUnsubscriber{})
+		s.SetAuthenticator(testAuthenticator{"user1": "secret1"})
+		s.HandleClient(cl)
+
+		assert.Equal(t, testCase.reply+"\n", cl.writeBuf.String())
+	}
+}
+
+func TestServiceHandleClient_AccountSignedIn_ErrorWritten(t *testing.T) {
+	cl := &testClient{}
+	fmt.Fprintln(&cl.readBuf, "auth|user1|secret1")
+
+	s := NewService(nil, &testUnsubscriber{})
+	s.SetAuthenticator(testAuthenticator{"user1": "secret1"})
+	s.signIn("@user1")
+	s.HandleClient(cl)
+
+	assert.Equal(t, "Account user1 is already signed in.\n", cl.writeBuf.String())
+}
+
+func TestServiceHandleClient_NoAuthenticator_AuthUnknown(t *testing.T) {
+	cl := &testClient{}
+	fmt.Fprintln(&cl.readBuf, "auth|user1|secret1")
+
+	s := NewService(nil, &testUnsubscriber{})
+	s.HandleClient(cl)
+
+	assert.Equal(t, "Unknown command: auth.\n", cl.writeBuf.String())
+}
+
+func testCertificate(t *testing.T, cn string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestServiceHandleClient_ClientCertificate_IdentityBound(t *testing.T) {
+	ca, caKey := testCertificate(t, "ca", nil, nil)
+	srvCert, srvKey := testCertificate(t, "localhost", ca, caKey)
+	clCert, clKey := testCertificate(t, "user1", ca, caKey)
+	unknownCert, unknownKey := testCertificate(t, "user2", ca, caKey)
+	invalidCert, invalidKey := testCertificate(t, "user1|x", ca, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	anonymous := func(user identity) bool { _, ok := user.account(); return !ok }
+
+	testCases := []struct {
+		certs    []tls.Certificate
+		expected func(identity) bool
+	}{
+		{
+			certs:    []tls.Certificate{{Certificate: [][]byte{clCert.Raw}, PrivateKey: clKey}},
+			expected: func(user identity) bool { return user == "@user1" },
+		}, {
+			certs:    nil,
+			expected: anonymous,
+		}, {
+			certs:    []tls.Certificate{{Certificate: [][]byte{unknownCert.Raw}, PrivateKey: unknownKey}},
+			expected: anonymous,
+		}, {
+			certs:    []tls.Certificate{{Certificate: [][]byte{invalidCert.Raw}, PrivateKey: invalidKey}},
+			expected: anonymous,
+		},
+	}
+
+	for _, testCase := range testCases {
+		srvConn, clConn := net.Pipe()
+		srv := tls.Server(srvConn, &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{srvCert.Raw}, PrivateKey: srvKey}},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		})
+		cl := tls.Client(clConn, &tls.Config{
+			ServerName:   "localhost",
+			RootCAs:      pool,
+			Certificates: testCase.certs,
+		})
+
+		cmd1 := testIdentityCommand{}
+		s := NewService(map[string]Command{"cmd1": &cmd1}, &testUnsubscriber{})
+		s.SetAuthenticator(testAuthenticator{"user1": "secret1", "user1|x": "secret1"})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.HandleClient(srv)
+		}()
+		fmt.Fprintln(cl, "cmd1")
+		cl.Close()
+		<-done
+
+		assert.Len(t, cmd1.users, 1)
+		assert.True(t, testCase.expected(cmd1.users[0]), cmd1.users)
+		assert.Empty(t, s.online)
+	}
+}
+
+func TestServiceHandleClient_NoTLSHandshake_Disconnected(t *testing.T) {
+	srvCert, srvKey := testCertificate(t, "localhost", nil, nil)
+	srvConn, clConn := net.Pipe()
+	defer clConn.Close()
+	srv := tls.Server(srvConn, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{srvCert.Raw}, PrivateKey: srvKey}},
+	})
+
+	s := NewService(nil, &testUnsubscriber{})
+	s.SetTimeouts(50*time.Millisecond, time.Second, 0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.HandleClient(srv)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("client without handshake is not disconnected")
+	}
+}
+
+func TestServiceHandleClient_StuckClient_OthersNotDelayed(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	publisher := make(chan message, 16)
+	hub.SubscribeToRoom("id3", "room1", subscriber{nick: "nick3", outgoing: publisher})
+	cmds := map[string]Command{"subscribe": NewSubscribeCommand(hub)}
+	s := NewService(cmds, NewDisconnector(hub))
+	s.SetQueue(2, DropOldest)
+	dropped := droppedCount(DropOldest)
+
+	stuck, fast := newPipeClient(true), newPipeClient(false)
+	defer stuck.Close()
+	defer fast.Close()
+	go s.HandleClient(stuck)
+	go s.HandleClient(fast)
+	stuck.send("subscribe|room1:stuck")
+	fast.send("subscribe|room1:fast")
+	assert.Eventually(t, func() bool {
+		return len(hub.getSubscribers("room1")) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		cmd := NewPublishCommand(hub, 254)
+		for i := 0; i < 10; i++ {
+			cmd.Handle("id3", fmt.Sprintf("room1|msg%d", i), publisher)
+		}
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("Publisher is stalled by stuck client")
+	}
+
+	// The newest message is never dropped.
+	for ln := ""; !strings.HasSuffix(ln, "] nick3@room1: msg9"); {
+		select {
+		case ln = <-fast.lines:
+		case <-time.After(time.Second):
+			t.Fatal("Message is not delivered to fast client")
+		}
+	}
+	assert.True(t, droppedCount(DropOldest) > dropped)
+}
+
+func TestServiceHandleClient_SlowClientDisconnectPolicy_Disconnected(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	cmds := map[string]Command{"subscribe": NewSubscribeCommand(hub)}
+	s := NewService(cmds, NewDisconnector(hub))
+	s.SetQueue(1, Disconnect)
+
+	stuck := newPipeClient(true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.HandleClient(stuck)
+	}()
+	stuck.send("subscribe|room1:stuck")
+	assert.Eventually(t, func() bool {
+		return len(hub.getSubscribers("room1")) == 1
+	}, time.Second, 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		hub.broadcast("room1", "", noticeMsg("msg1"))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Slow client is not disconnected")
+	}
+	assert.Empty(t, hub.getSubscribers("room1"))
+}
+
+func TestServiceShutdown_ClientsConnected_NotifiedAndDisconnected(t *testing.T) {
+	hub := NewHub(128)
+	hub.CreateRoom("room1")
+	cmds := map[string]Command{"subscribe": NewSubscribeCommand(hub)}
+	s := NewService(cmds, NewDisconnector(hub))
+
+	fast, stuck := newPipeClient(false), newPipeClient(true)
+	done := make(chan struct{}, 2)
+	for _, cl := range []*pipeClient{fast, stuck} {
+		go func(cl *pipeClient) {
+			s.HandleClient(cl)
+			done <- struct{}{}
+		}(cl)
+	}
+	fast.send("subscribe|room1:fast")
+	stuck.send("subscribe|room1:stuck")
+	assert.Eventually(t, func() bool {
+		return len(hub.getSubscribers("room1")) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	start := time.Now()
+	s.Shutdown(100 * time.Millisecond)
+
+	assert.True(t, time.Since(start) < time.Second)
+	<-done
+	<-done
+	var lines []string
+	for len(fast.lines) > 0 {
+		lines = append(lines, <-fast.lines)
+	}
+	assert.Contains(t, lines, "Server is shutting down.")
+	assert.Empty(t, hub.getSubscribers("room1"))
+}
+
+func TestServiceHandleClient_AfterShutdown_Disconnected(t *testing.T) {
+	cl := &testClient{}
+	fmt.Fprintln(&cl.readBuf, "cmd1|arg1")
+	cmd1 := testCommand{}
+
+	s := NewService(map[string]Command{"cmd1": &cmd1}, &testUnsubscriber{})
+	s.Shutdown(time.Second)
+	s.HandleClient(cl)
+
+	assert.Empty(t, cmd1.handleArgs)
+	assert.Equal(t, 1, cl.closeCount)
+}
+
+func TestServiceHandleClient_Flooding_WarnedMutedDisconnected(t *testing.T) {
+	cmd1 := testCommand{outgoingMessage: "done"}
+	s := NewService(map[string]Command{"cmd1": &cmd1}, &testUnsubscriber{})
+	s.SetRateLimits(RateLimits{Requests: RateLimit{Rate: 0.001, Burst: 1}})
+	cl := newPipeClient(false)
+	done := make(chan struct{})
+	go func() {
+		s.HandleClient(cl)
+		close(done)
+	}()
+
+	for i := 0; i < 4; i++ {
+		cl.send("cmd1|arg1")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("flooding client is not disconnected")
+	}
+	assert.Equal(t, "done", <-cl.lines)
+	assert.Equal(t, "Too many requests, slow down.", <-cl.lines)
+	assert.Equal(t, "Too many requests, you are muted for 0 seconds.", <-cl.lines)
+	assert.Equal(t, "Too many requests, disconnecting.", <-cl.lines)
+}
+
+func TestServiceHandleClient_Reconnected_RateLimitsKept(t *testing.T) {
+	cmd1 := testCommand{}
+	s := NewService(map[string]Command{"cmd1": &cmd1}, &testUnsubscriber{})
+	s.SetAuthenticator(testAuthenticator{"user1": "secret1"})
+	s.SetRateLimits(RateLimits{Requests: RateLimit{Rate: 0.001, Burst: 1}})
+
+	cl1 := &testClient{}
+	fmt.Fprintln(&cl1.readBuf, "auth|user1|secret1")
+	fmt.Fprintln(&cl1.readBuf, "cmd1|arg1")
+	s.HandleClient(cl1)
+	cl2 := &testClient{}
+	fmt.Fprintln(&cl2.readBuf, "auth|user1|secret1")
+	fmt.Fprintln(&cl2.readBuf, "cmd1|arg2")
+	s.HandleClient(cl2)
+
+	assert.Equal(t, "arg1", cmd1.handleArgs)
+	assert.Contains(t, cl2.writeBuf.String(), "Too many requests, slow down.\n")
+}
+
+func TestServiceHandleClient_LineTooLong_ErrorConnectionKept(t *testing.T) {
+	cl := &testClient{}
+	fmt.Fprintln(&cl.readBuf, "cmd1|"+strings.Repeat("x", 64))
+	fmt.Fprintln(&cl.readBuf, "cmd1|arg1")
+	cmd1 := testCommand{}
+
+	s := NewService(map[string]Command{"cmd1": &cmd1}, &testUnsubscriber{})
+	s.SetFrameSize(32)
+	s.HandleClient(cl)
+
+	assert.Equal(t, "Request exceeds 32 bytes.\n", cl.writeBuf.String())
+	assert.Equal(t, "arg1", cmd1.handleArgs)
+}
+
+func TestServiceHandleClient_LinesTooLong_Throttled(t *testing.T) {
+	cl := &testClient{}
+	fmt.Fprintln(&cl.readBuf, "cmd1|"+strings.Repeat("x", 64))
+	fmt.Fprintln(&cl.readBuf, "cmd1|"+strings.Repeat("x", 64))
+
+	s := NewService(nil, &testUnsubscriber{})
+	s.SetFrameSize(32)
+	s.SetRateLimits(RateLimits{Requests: RateLimit{Rate: 0.001, Burst: 1}})
+	s.HandleClient(cl)
+
+	assert.Equal(t, "Request exceeds 32 bytes.\nToo many requests, slow down.\n", cl.writeBuf.String())
+}
+
+func TestServiceHandleClient_Idle_Disconnected(t *testing.T) {
+	srv, cl := net.Pipe()
+	defer cl.Close()
+	s := NewService(nil, &testUnsubscriber{})
+	s.SetTimeouts(0, time.Second, 50*time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		s.HandleClient(srv)
+		close(done)
+	}()
+
+	fmt.Fprintln(cl, "ping")
+	r := bufio.NewReader(cl)
+	ln, _ := r.ReadString('\n')
+	assert.Equal(t, "pong\n", ln)
+	ln, _ = r.ReadString('\n')
+	assert.Equal(t, "Connection timed out.\n", ln)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("idle client is not disconnected")
+	}
+}
@@ -0,0 +1,300 @@
+package chat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store defines data access used by chat commands: rooms, memberships
+// of users in rooms and rooms history. It's implemented by Hub, which
+// keeps everything in memory, and FileStore. Most of its methods are
+// unexported, so a fake store outside of the package embeds one of
+// them and overrides exported methods.
+type Store interface {
+	CreateRoom(roomName string) error
+	DeleteRoom(roomName string) (map[identity]subscriber, error)
+	SubscribeToRoom(user identity, roomName string, sub subscriber) error
+	UnsubscribeFromRoom(user identity, roomName string) (subscriber, error)
+	SetTopic(roomName string, topic string) error
+	Topic(roomName string) (string, error)
+
+	getSubscribers(roomName string) map[identity]subscriber
+	getRoomHistory(roomName string) []historyItem
+	joinRoom(user identity, roomName string, sub subscriber, since *cursor) error
+	roomHistoryBefore(roomName string, before uint64, limit int) ([]historyItem, error)
+	searchRoom(roomName string, q searchQuery) ([]historyItem, error)
+	roomSettings(roomName string) (RoomSettings, bool)
+	publish(roomName string, sender identity, item historyItem) (historyItem, error)
+	broadcast(roomName string, except identity, m message) bool
+	notify(roomName string, user identity, m message) bool
+	addOperator(roomName string, user identity)
+	isOperator(roomName string, user identity) bool
+	isConfigured(roomName string) bool
+	createdRooms(user identity) (created int, operated int)
+	ban(roomName string, user identity, nick string) error
+	mute(roomName string, user identity, until time.Time) error
+	mutedUntil(roomName string, user identity) time.Time
+	whisper(from identity, nick string, text string) error
+	leaveAll(user identity) map[string]subscriber
+	rebind(from identity, to identity) map[string]subscriber
+}
+
+const (
+	fileStoreRooms  = "rooms.json"
+	fileStoreTopics = "topics.json"
+)
+
+// Hub is the default in-memory store.
+var _ Store = (*Hub)(nil)
+
+// FileStore is store which keeps rooms, their topics and history in files
+// of the specified directory, so that they survive server restart.
+// Only rooms created by users are saved, configured ones are created
+// from config on every start. Memberships are bound to connections, so
+// they are kept in memory. Without directory, FileStore keeps everything
+// in memory as Hub does.
+type FileStore struct {
+	*Hub
+	dir string
+	// topics are saved topics of rooms which are not created yet,
+	// e.g. configured ones.
+	topics map[string]string
+	fm     sync.Mutex
+}
+
+// savedRoom is room created by user as it's kept in rooms file.
+// Operators are names of accounts, anonymous users don't outlive
+// their connections.
+type savedRoom struct {
+	Name      string   `json:"name"`
+	Operators []string `json:"operators,omitempty"`
+}
+
+// UnmarshalJSON accepts saved room, while rooms saved by older versions
+// are just names, which are left without name, as they are not known to
+// be created by users.
+func (sr *savedRoom) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*sr = savedRoom{}
+		return nil
+	}
+	type roomObject savedRoom
+	return json.Unmarshal(b, (*roomObject)(sr))
+}
+
+// OpenFileStore opens or creates store in the specified directory
+// and restores rooms saved there. Room history in memory is limited by
+// roomHistoryCap, and historyKeep of the latest items per room are
+// kept in directory, which is at least as many as memory holds.
+func OpenFileStore(dir string, roomHistoryCap int, historyKeep int) (*FileStore, error) {
+	if dir == "" {
+		return &FileStore{Hub: NewHub(roomHistoryCap)}, nil
+	}
+	// One more item tells what was evicted from room history.
+	if historyKeep < roomHistoryCap+1 {
+		historyKeep = roomHistoryCap + 1
+	}
+	history, err := OpenLogHistory(filepath.Join(dir, "history"), historyKeep)
+	if err != nil {
+		return nil, err
+	}
+	store := &FileStore{
+		Hub: NewHubWithHistory(roomHistoryCap, history),
+		dir: dir,
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, fileStoreRooms))
+	if err != nil && !os.IsNotExist(err) {
+		store.Close()
+		return nil, err
+	}
+	var rooms []savedRoom
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &rooms); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	b, err = ioutil.ReadFile(filepath.Join(dir, fileStoreTopics))
+	if err != nil && !os.IsNotExist(err) {
+		store.Close()
+		return nil, err
+	}
+	store.topics = make(map[string]string)
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &store.topics); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	stale := 0
+	var orphaned []string
+	for _, saved := range rooms {
+		if saved.Name == "" {
+			stale++
+			continue
+		}
+		// Nobody could operate or delete room created by anonymous
+		// user, so it's retired along with its history.
+		if len(saved.Operators) == 0 {
+			orphaned = append(orphaned, saved.Name)
+			if err := store.history.Drop(saved.Name); err != nil {
+				log.Println("Cannot drop history of", saved.Name+":", err)
+			}
+			continue
+		}
+		if err := store.Hub.CreateRoom(saved.Name); err != nil {
+			store.Close()
+			return nil, err
+		}
+		store.Hub.SetOperators(saved.Name, saved.Operators)
+		store.restoreTopic(saved.Name)
+	}
+	if stale > 0 {
+		// Rooms saved by older versions include configured ones, which
+		// may have been removed from config. History of rooms which are
+		// configured again is kept.
+		log.Println("Rooms saved by older version are not restored:", stale)
+	}
+	if len(orphaned) > 0 {
+		log.Println("Rooms without operators are not restored:", strings.Join(orphaned, ", "))
+	}
+	if stale > 0 || len(orphaned) > 0 {
+		if err := store.saveRooms(); err != nil {
+			log.Println("Cannot save rooms:", err)
+		}
+	}
+	return store, nil
+}
+
+// CreateRoom adds a new room with the specified name and saves it.
+// Topic saved for the room before is restored.
+func (store *FileStore) CreateRoom(roomName string) error {
+	if err := store.Hub.CreateRoom(roomName); err != nil {
+		return err
+	}
+	store.restoreTopic(roomName)
+	if err := store.saveRooms(); err != nil {
+		log.Println("Cannot save rooms:", err)
+	}
+	return nil
+}
+
+func (store *FileStore) restoreTopic(roomName string) {
+	store.fm.Lock()
+	topic, ok := store.topics[roomName]
+	delete(store.topics, roomName)
+	store.fm.Unlock()
+	if ok {
+		store.Hub.SetTopic(roomName, topic)
+	}
+}
+
+// ConfigureRoom applies the specified settings to existing room.
+// Configured room is no longer saved, as it's created from config.
+func (store *FileStore) ConfigureRoom(roomName string, settings RoomSettings) error {
+	if err := store.Hub.ConfigureRoom(roomName, settings); err != nil {
+		return err
+	}
+	if err := store.saveRooms(); err != nil {
+		log.Println("Cannot save rooms:", err)
+	}
+	return nil
+}
+
+func (store *FileStore) addOperator(roomName string, user identity) {
+	store.Hub.addOperator(roomName, user)
+	if err := store.saveRooms(); err != nil {
+		log.Println("Cannot save rooms:", err)
+	}
+}
+
+// rebind saves rooms, as their operators may sign in.
+func (store *FileStore) rebind(from identity, to identity) map[string]subscriber {
+	left := store.Hub.rebind(from, to)
+	if err := store.saveRooms(); err != nil {
+		log.Println("Cannot save rooms:", err)
+	}
+	return left
+}
+
+// DeleteRoom removes room with the specified name and its history.
+func (store *FileStore) DeleteRoom(roomName string) (map[identity]subscriber, error) {
+	subs, err := store.Hub.DeleteRoom(roomName)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.saveRooms(); err != nil {
+		log.Println("Cannot save rooms:", err)
+	}
+	return subs, nil
+}
+
+// SetTopic changes topic of the specified room and saves it.
+func (store *FileStore) SetTopic(roomName string, topic string) error {
+	if err := store.Hub.SetTopic(roomName, topic); err != nil {
+		return err
+	}
+	if err := store.saveRooms(); err != nil {
+		log.Println("Cannot save rooms:", err)
+	}
+	return nil
+}
+
+func (store *FileStore) saveRooms() error {
+	if store.dir == "" {
+		return nil
+	}
+	store.fm.Lock()
+	defer store.fm.Unlock()
+
+	topics := make(map[string]string, len(store.topics))
+	for roomName, topic := range store.topics {
+		topics[roomName] = topic
+	}
+	store.rm.RLock()
+	rooms := make([]savedRoom, 0, len(store.rooms))
+	for roomName, room := range store.rooms {
+		room.sm.RLock()
+		if !room.configured {
+			saved := savedRoom{Name: roomName}
+			for user := range room.operators {
+				if name, ok := user.account(); ok {
+					saved.Operators = append(saved.Operators, name)
+				}
+			}
+			sort.Strings(saved.Operators)
+			rooms = append(rooms, saved)
+		}
+		if room.topic != "" {
+			topics[roomName] = room.topic
+		}
+		room.sm.RUnlock()
+	}
+	store.rm.RUnlock()
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+
+	if err := store.writeJSON(fileStoreRooms, rooms); err != nil {
+		return err
+	}
+	return store.writeJSON(fileStoreTopics, topics)
+}
+
+func (store *FileStore) writeJSON(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(store.dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(store.dir, name))
+}
@@ -0,0 +1,173 @@
+package chat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStoreOpen_RoomsCreated_RoomsRestored(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	store, err := OpenFileStore(dir, 128, 0)
+	assert.NoError(t, err)
+	store.CreateRoom("room1")
+	store.CreateRoom("room2")
+	store.CreateRoom("room3")
+	store.addOperator("room1", "@user1")
+	store.addOperator("room2", "@user1")
+	store.addOperator("room3", "@user1")
+	store.DeleteRoom("room2")
+	store.Close()
+
+	store, err = OpenFileStore(dir, 128, 0)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	assert.Contains(t, store.rooms, "room1")
+	assert.NotContains(t, store.rooms, "room2")
+	assert.Contains(t, store.rooms, "room3")
+}
+
+func TestFileStoreOpen_HistoryAppended_HistoryRestored(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	store, _ := OpenFileStore(dir, 128, 0)
+	store.CreateRoom("room1")
+	store.addOperator("room1", "@user1")
+	store.AppendRoomHistory("room1", historyItem{nick: "nick1", msg: "msg1"})
+	store.Close()
+
+	store, _ = OpenFileStore(dir, 128, 0)
+	defer store.Close()
+
+	assert.Equal(t, []historyItem{{nick: "nick1", msg: "msg1"}}, store.getRoomHistory("room1"))
+}
+
+func TestFileStoreOpen_TopicSet_TopicRestored(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	store, _ := OpenFileStore(dir, 128, 0)
+	store.CreateRoom("room1")
+	store.CreateRoom("room2")
+	store.addOperator("room1", "@user1")
+	store.addOperator("room2", "@user1")
+	store.SetTopic("room1", "topic1")
+	store.Close()
+
+	store, _ = OpenFileStore(dir, 128, 0)
+	defer store.Close()
+
+	topic1, _ := store.Topic("room1")
+	topic2, _ := store.Topic("room2")
+	assert.Equal(t, "topic1", topic1)
+	assert.Empty(t, topic2)
+}
+
+func TestFileStoreCreateRoom_DuplicateRoom_ErrorReturned(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	store, _ := OpenFileStore(dir, 128, 0)
+	defer store.Close()
+
+	err1 := store.CreateRoom("room1")
+	err2 := store.CreateRoom("room1")
+
+	assert.NoError(t, err1)
+	assert.EqualError(t, err2, "Attempt to create duplicate room: room1")
+}
+
+func TestFileStore_HistoryKeep_MoreThanMemoryKept(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	store, _ := OpenFileStore(dir, 2, 5)
+	defer store.Close()
+	store.CreateRoom("room1")
+
+	for _, msg := range []string{"msg1", "msg2", "msg3", "msg4", "msg5", "msg6"} {
+		store.AppendRoomHistory("room1", historyItem{nick: "nick1", msg: msg})
+	}
+
+	stored, _ := store.history.Load("room1", 128)
+	assert.Len(t, store.getRoomHistory("room1"), 2)
+	assert.Len(t, stored, 5)
+	assert.Equal(t, "msg2", stored[0].msg)
+}
+
+func TestFileStoreOpen_RoomConfigured_RoomNotRestored(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	store, _ := OpenFileStore(dir, 128, 0)
+	store.CreateRoom("room1")
+	store.CreateRoom("room2")
+	store.addOperator("room1", "@user1")
+	store.ConfigureRoom("room2", RoomSettings{})
+	store.SetTopic("room2", "topic2")
+	store.AppendRoomHistory("room2", historyItem{nick: "nick1", msg: "msg1"})
+	store.Close()
+
+	store, _ = OpenFileStore(dir, 128, 0)
+	defer store.Close()
+
+	assert.Contains(t, store.rooms, "room1")
+	assert.NotContains(t, store.rooms, "room2")
+	// Configured again, the room gets its topic and history back.
+	store.CreateRoom("room2")
+	store.addOperator("room1", "@user1")
+	topic, _ := store.Topic("room2")
+	assert.Equal(t, "topic2", topic)
+	assert.Len(t, store.getRoomHistory("room2"), 1)
+}
+
+func TestFileStoreOpen_RoomsOfOlderVersion_RoomsRetired(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, fileStoreRooms), []byte(`["room1",{"name":"room2","operators":["user1"]}]`), 0644)
+
+	store, err := OpenFileStore(dir, 128, 0)
+	assert.NoError(t, err)
+	store.Close()
+	store, _ = OpenFileStore(dir, 128, 0)
+	defer store.Close()
+
+	assert.NotContains(t, store.rooms, "room1")
+	assert.Contains(t, store.rooms, "room2")
+}
+
+func TestFileStoreOpen_OperatorsSaved_OperatorsRestored(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	store, _ := OpenFileStore(dir, 128, 0)
+	store.CreateRoom("room1")
+	store.addOperator("room1", "id1")
+	store.rebind("id1", "@user1")
+	store.addOperator("room1", "@user2")
+	store.Close()
+
+	store, _ = OpenFileStore(dir, 128, 0)
+	defer store.Close()
+
+	assert.True(t, store.isOperator("room1", "@user1"))
+	assert.True(t, store.isOperator("room1", "@user2"))
+	assert.False(t, store.isOperator("room1", "id1"))
+}
+
+func TestFileStoreOpen_RoomOfAnonymousUser_RoomRetired(t *testing.T) {
+	dir := tempHistoryDir(t)
+	defer os.RemoveAll(dir)
+	store, _ := OpenFileStore(dir, 128, 0)
+	store.CreateRoom("room1")
+	store.addOperator("room1", "id1")
+	store.AppendRoomHistory("room1", historyItem{nick: "nick1", msg: "msg1"})
+	store.Close()
+
+	store, _ = OpenFileStore(dir, 128, 0)
+	defer store.Close()
+
+	assert.NotContains(t, store.rooms, "room1")
+	store.CreateRoom("room1")
+	assert.Empty(t, store.getRoomHistory("room1"))
+}
@@ -2,26 +2,126 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"io/ioutil"
 	"strings"
+	"time"
+
+	"github.com/mxmsk/hostel-chat/hostelsrv/chat"
+)
+
+const configFile = "config.json"
+
+// Defaults of limits which are not configured.
+const (
+	defaultMaxMessageLength = 254
+	defaultHistorySize      = 128
+	defaultHistoryRetention = 10000
+	defaultMuteSeconds      = 30
+	defaultReadTimeout      = 30
+	defaultWriteTimeout     = 30
+)
+
+var (
+	defaultRequestRate = chat.RateLimit{Rate: 10, Burst: 20}
+	defaultCommandRate = chat.RateLimit{Rate: 2, Burst: 5}
 )
 
 // Config defines configuration of chat server.
 type Config struct {
-	Port  uint
-	Rooms []string
+	Port uint
+	// WebPort enables WebSocket transport for browser clients.
+	WebPort uint
+	// WebOrigins are origins of pages on other sites, which may connect
+	// to web port, e.g. "https://chat.example.com".
+	WebOrigins []string
+	// AdminPort enables serving server metrics at /debug/vars,
+	// it's bound to localhost only.
+	AdminPort uint
+	Rooms     []RoomConfig
+	DataDir   string
+	// HistoryDir is the former name of DataDir, still accepted.
+	HistoryDir string
+	UsersFile  string
+	// TLSCert and TLSKey enable TLS when both are specified.
+	TLSCert string
+	TLSKey  string
+	// TLSClientCA lets clients to sign in with certificates issued by CA.
+	TLSClientCA string
+	// QueueSize limits events waiting to be written to a client, and
+	// Overflow is what happens when its queue is full: "drop-oldest",
+	// "drop-newest" or "disconnect".
+	QueueSize int
+	Overflow  string
+	// MaxMessageLength limits length of messages and HistorySize is
+	// number of messages kept per room, unless room has its own limits.
+	// Both are applied on reload.
+	MaxMessageLength int
+	HistorySize      int
+	// HistoryRetention is number of messages kept per room in data dir,
+	// which can be paged and searched. It's at least as many as room
+	// history holds.
+	HistoryRetention int
+	// RateLimits throttle requests of every client, in total and per
+	// command, e.g. {"requests": {"rate": 10, "burst": 20}, "commands":
+	// {"publish": {"rate": 2, "burst": 5}}, "muteSeconds": 30}. Negative
+	// rate disables limit. Applied on reload.
+	RateLimits chat.RateLimits
+	// MaxFrameSize limits length of request line in bytes.
+	MaxFrameSize int
+	// ReadTimeout limits seconds of receiving request line once client
+	// started to send it, WriteTimeout limits seconds of sending events
+	// to client, and IdleTimeout is how many seconds client may not send
+	// anything. Negative or zero IdleTimeout means no limit, the same is
+	// negative ReadTimeout and WriteTimeout.
+	ReadTimeout  int
+	WriteTimeout int
+	IdleTimeout  int
+	// WatchConfig reloads config when config file is changed,
+	// in addition to reloading on SIGHUP.
+	WatchConfig bool
+	// AddUser is name of account to be added to users file,
+	// its password is read from stdin.
+	AddUser string `json:"-"`
+
+	cli cliArgs
+}
+
+// cliArgs keeps CLI args, so that they take priority over
+// config file when it's reloaded.
+type cliArgs struct {
+	port       uint
+	webPort    uint
+	rooms      string
+	dataDir    string
+	historyDir string
+	usersFile  string
+	watch      bool
 }
 
 // Parse loads config from CLI and file where CLI args have priority.
 func (c *Config) Parse() error {
-	var cliPort uint
-	var cliRooms string
-	flag.UintVar(&cliPort, "port", 0, "Port to listen requests on")
-	flag.StringVar(&cliRooms, "rooms", "", "List of rooms [room1|room2|..|roomN]")
+	flag.UintVar(&c.cli.port, "port", 0, "Port to listen requests on")
+	flag.UintVar(&c.cli.webPort, "webport", 0, "Port to serve web clients on")
+	flag.StringVar(&c.cli.rooms, "rooms", "", "List of rooms [room1|room2|..|roomN]")
+	flag.StringVar(&c.cli.dataDir, "data", "", "Directory to persist rooms and history in")
+	flag.StringVar(&c.cli.historyDir, "history", "", "The same as -data, kept for compatibility")
+	flag.StringVar(&c.cli.usersFile, "users", "", "File with user accounts")
+	flag.BoolVar(&c.cli.watch, "watch", false, "Reload config when "+configFile+" is changed")
+	flag.StringVar(&c.AddUser, "adduser", "", "Add account to users file reading its password from stdin, and exit [name]")
 	flag.Parse()
+	return c.load()
+}
+
+// Reload loads config file again, keeping CLI args of c.
+func (c Config) Reload() (Config, error) {
+	n := Config{AddUser: c.AddUser, cli: c.cli}
+	return n, n.load()
+}
 
-	f, err := ioutil.ReadFile("config.json")
+func (c *Config) load() error {
+	f, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		return err
 	}
@@ -29,14 +129,114 @@ func (c *Config) Parse() error {
 		return err
 	}
 
-	if cliPort != 0 {
-		c.Port = cliPort
+	if c.cli.port != 0 {
+		c.Port = c.cli.port
+	}
+	if c.cli.webPort != 0 {
+		c.WebPort = c.cli.webPort
+	}
+	if c.DataDir == "" {
+		c.DataDir = c.HistoryDir
+	}
+	if c.cli.historyDir != "" {
+		c.DataDir = c.cli.historyDir
+	}
+	if c.cli.dataDir != "" {
+		c.DataDir = c.cli.dataDir
+	}
+	if c.cli.usersFile != "" {
+		c.UsersFile = c.cli.usersFile
 	}
-	if cliRooms != "" {
+	if c.cli.watch {
+		c.WatchConfig = true
+	}
+	if c.cli.rooms != "" {
 		c.Rooms = c.Rooms[:0]
-		for _, room := range strings.Split(cliRooms, "|") {
-			c.Rooms = append(c.Rooms, room)
+		for _, room := range strings.Split(c.cli.rooms, "|") {
+			c.Rooms = append(c.Rooms, RoomConfig{Name: room})
+		}
+	}
+	if c.MaxMessageLength <= 0 {
+		c.MaxMessageLength = defaultMaxMessageLength
+	}
+	if c.HistorySize <= 0 {
+		c.HistorySize = defaultHistorySize
+	}
+	if c.HistoryRetention <= 0 {
+		c.HistoryRetention = defaultHistoryRetention
+	}
+	if c.RateLimits.Requests == (chat.RateLimit{}) {
+		c.RateLimits.Requests = defaultRequestRate
+	}
+	if c.RateLimits.Commands == nil {
+		c.RateLimits.Commands = map[string]chat.RateLimit{
+			"publish": defaultCommandRate,
+			"whisper": defaultCommandRate,
 		}
 	}
+	if c.RateLimits.MuteSeconds <= 0 {
+		c.RateLimits.MuteSeconds = defaultMuteSeconds
+	}
+	if c.MaxFrameSize <= 0 {
+		c.MaxFrameSize = chat.DefaultFrameSize
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = defaultReadTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	return nil
+}
+
+// seconds converts number of seconds from config to duration.
+// Negative number means no limit, i.e. zero duration.
+func seconds(n int) time.Duration {
+	if n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// RoomConfig defines a room served by chat. In config file it's either
+// a name of room or an object with name and settings of room, e.g.
+// {"name": "news", "readOnly": true, "historySize": 500}.
+type RoomConfig struct {
+	Name string
+	// Topic is initial topic of room, it can be changed by members.
+	Topic string
+	// Operators are names of accounts which can kick, ban and mute
+	// members of room.
+	Operators []string
+	chat.RoomSettings
+}
+
+// UnmarshalJSON accepts both forms of room definition.
+func (rc *RoomConfig) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*rc = RoomConfig{Name: name}
+		return nil
+	}
+	type roomObject RoomConfig
+	var obj roomObject
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return err
+	}
+	if obj.Name == "" {
+		return errors.New("room name is missing")
+	}
+	*rc = RoomConfig(obj)
 	return nil
 }
+
+// maxHistorySize returns the largest history size of all rooms.
+func (c Config) maxHistorySize() int {
+	size := c.HistorySize
+	for _, room := range c.Rooms {
+		if room.HistorySize > size {
+			size = room.HistorySize
+		}
+	}
+	return size
+}
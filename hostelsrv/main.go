@@ -1,9 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mxmsk/hostel-chat/hostelsrv/chat"
 )
@@ -13,39 +25,226 @@ var chatCommands = map[string]chat.Command{
 	"publish":   &chat.PublishCommand{},
 }
 
+// shutdownTimeout limits time clients are given to receive events
+// queued for them when server shuts down.
+const shutdownTimeout = 5 * time.Second
+
 func main() {
 	c := Config{}
 	if err := c.Parse(); err != nil {
 		log.Fatalln("Config error:", err)
 	}
+	if c.AddUser != "" {
+		if err := addUser(c); err != nil {
+			log.Fatalln("Can't add user:", err)
+		}
+		return
+	}
 	log.Println("Use config:", c)
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", c.Port))
 	if err != nil {
 		log.Fatalln("Can't start server:", err)
 	}
+	var tlsConfig *tls.Config
+	if c.TLSCert != "" || c.TLSKey != "" {
+		if tlsConfig, err = loadTLSConfig(c); err != nil {
+			log.Fatalln("TLS error:", err)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+		log.Println("TLS enabled")
+	}
 	log.Println("Listening on port", c.Port)
 
-	chatSvc := initChatService(c)
+	srv, err := newChatServer(c)
+	if err != nil {
+		log.Fatalln("Can't start chat:", err)
+	}
+	var webSrv *http.Server
+	if c.WebPort != 0 {
+		webSrv = serveWeb(c.WebPort, c.WebOrigins, srv.svc, tlsConfig)
+	}
+	var adminSrv *http.Server
+	if c.AdminPort != 0 {
+		adminSrv = serveAdmin(c.AdminPort)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	changes := make(chan struct{}, 1)
+	if c.WatchConfig {
+		go watchConfig(configFile, changes)
+	}
+	go acceptClients(listener, srv.svc)
+
+	for {
+		select {
+		case <-changes:
+			srv.reloadConfig()
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				srv.reloadConfig()
+				continue
+			}
+			log.Println("Got", sig, "signal, shutting down")
+			listener.Close()
+			if webSrv != nil {
+				webSrv.Close()
+			}
+			if adminSrv != nil {
+				adminSrv.Close()
+			}
+			srv.shutdown()
+			log.Println("Server stopped")
+			return
+		}
+	}
+}
+
+func acceptClients(listener net.Listener, chatSvc *chat.Service) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("Accept error:", err)
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Println("Accept error:", err)
+				continue
+			}
+			return
 		}
 		log.Println("New connection", conn.RemoteAddr())
 		go chatSvc.HandleClient(conn)
 	}
 }
 
-func initChatService(c Config) *chat.Service {
-	hub := chat.NewHub(128)
+// chatServer keeps chat service together with config it was started
+// with and parts of it which can be changed when config is reloaded.
+type chatServer struct {
+	config  Config
+	svc     *chat.Service
+	store   *chat.FileStore
+	publish *chat.PublishCommand
+	whisper *chat.WhisperCommand
+}
+
+func newChatServer(c Config) (*chatServer, error) {
+	overflow, err := chat.ParseOverflowPolicy(c.Overflow)
+	if err != nil {
+		return nil, err
+	}
+	// Store retains as much history as the largest room needs,
+	// so that it's not lost before rooms are configured. Without
+	// data dir, nothing is saved.
+	store, err := chat.OpenFileStore(c.DataDir, c.maxHistorySize(), c.HistoryRetention)
+	if err != nil {
+		return nil, err
+	}
+	var accounts *chat.Accounts
+	subscribe := chat.NewSubscribeCommand(store)
+	if c.UsersFile != "" {
+		if accounts, err = chat.OpenAccounts(c.UsersFile); err != nil {
+			store.Close()
+			return nil, err
+		}
+		subscribe = chat.NewSubscribeCommandWithNicks(store, accounts)
+	}
+	srv := &chatServer{
+		config:  c,
+		store:   store,
+		publish: chat.NewPublishCommand(store, c.MaxMessageLength),
+		whisper: chat.NewWhisperCommand(store, c.MaxMessageLength),
+	}
 	commands := map[string]chat.Command{
-		"subscribe": chat.NewSubscribeCommand(hub),
-		"publish":   chat.NewPublishCommand(hub, 254),
+		"subscribe": subscribe,
+		"publish":   srv.publish,
+		"create":    chat.NewCreateCommand(store),
+		"delete":    chat.NewDeleteCommand(store),
+		"whisper":   srv.whisper,
+		"leave":     chat.NewLeaveCommand(store),
+		"who":       chat.NewWhoCommand(store),
+		"topic":     chat.NewTopicCommand(store),
+		"history":   chat.NewHistoryCommand(store),
+		"search":    chat.NewSearchCommand(store),
+		"kick":      chat.NewKickCommand(store),
+		"ban":       chat.NewBanCommand(store),
+		"mute":      chat.NewMuteCommand(store),
 	}
 	for _, room := range c.Rooms {
-		hub.CreateRoom(room)
+		store.CreateRoom(room.Name)
+		store.ConfigureRoom(room.Name, room.RoomSettings)
+		store.SetOperators(room.Name, room.Operators)
+		// Topic changed by members outlives restart when store is persistent.
+		if topic, _ := store.Topic(room.Name); topic == "" && room.Topic != "" {
+			store.SetTopic(room.Name, room.Topic)
+		}
+	}
+	store.SetHistoryCap(c.HistorySize)
+	svc := chat.NewService(commands, chat.NewDisconnector(store))
+	if accounts != nil {
+		svc.SetAuthenticator(accounts)
+	}
+	queueSize := chat.DefaultQueueSize
+	if c.QueueSize > 0 {
+		queueSize = c.QueueSize
+	}
+	svc.SetQueue(queueSize, overflow)
+	svc.SetRateLimits(c.RateLimits)
+	svc.SetFrameSize(c.MaxFrameSize)
+	svc.SetTimeouts(seconds(c.ReadTimeout), seconds(c.WriteTimeout), seconds(c.IdleTimeout))
+	srv.svc = svc
+	return srv, nil
+}
+
+// shutdown disconnects clients and closes store.
+func (srv *chatServer) shutdown() {
+	srv.svc.Shutdown(shutdownTimeout)
+	if err := srv.store.Close(); err != nil {
+		log.Println("Can't close store:", err)
+	}
+}
+
+func addUser(c Config) error {
+	if c.UsersFile == "" {
+		return errors.New("users file is not configured")
+	}
+	// Password is never passed in args, where other users can see it.
+	if strings.Contains(c.AddUser, ":") {
+		return errors.New("only account name is expected, password is read from stdin")
+	}
+	fmt.Fprintf(os.Stderr, "Password for %s: ", c.AddUser)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("password is missing")
+	}
+	accounts, err := chat.OpenAccounts(c.UsersFile)
+	if err != nil {
+		return err
+	}
+	return accounts.SetPassword(c.AddUser, password)
+}
+
+func loadTLSConfig(c Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(c.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + c.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
 	}
-	return chat.NewService(commands, hub)
+	return tlsConfig, nil
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mxmsk/hostel-chat/hostelsrv/chat"
+)
+
+// watchInterval is how often config file is checked for changes.
+const watchInterval = 2 * time.Second
+
+// reloadConfig reads config file again and applies changes of rooms
+// and limits. Other settings, e.g. ports, take effect after restart,
+// and changes of those related to clients are logged.
+func (srv *chatServer) reloadConfig() {
+	c, err := srv.config.Reload()
+	if err != nil {
+		log.Println("Can't reload config:", err)
+		return
+	}
+	srv.apply(c)
+	log.Println("Config reloaded")
+}
+
+// apply updates running chat to match the specified config. Rooms which
+// are new in config are created, rooms which were removed from it are
+// retired, so their members are notified and unsubscribed.
+func (srv *chatServer) apply(c Config) {
+	prev := srv.config
+	for _, room := range c.Rooms {
+		prevRoom, existed := findRoom(prev.Rooms, room.Name)
+		if !existed {
+			if err := srv.store.CreateRoom(room.Name); err != nil {
+				log.Println("Can't create room:", err)
+			}
+		}
+		if !existed || prevRoom.RoomSettings != room.RoomSettings {
+			if err := srv.store.ConfigureRoom(room.Name, room.RoomSettings); err != nil {
+				log.Println("Can't configure room:", err)
+			}
+		}
+		if !existed || !reflect.DeepEqual(prevRoom.Operators, room.Operators) {
+			if err := srv.store.SetOperators(room.Name, room.Operators); err != nil {
+				log.Println("Can't set operators:", err)
+			}
+		}
+		if !existed || prevRoom.Topic != room.Topic {
+			if err := srv.store.SetTopic(room.Name, room.Topic); err != nil {
+				log.Println("Can't set topic:", err)
+			}
+		}
+	}
+	for _, room := range prev.Rooms {
+		if _, ok := findRoom(c.Rooms, room.Name); !ok {
+			if err := chat.RetireRoom(srv.store, room.Name); err != nil {
+				log.Println("Can't retire room:", err)
+			}
+		}
+	}
+	if c.MaxMessageLength != prev.MaxMessageLength {
+		srv.publish.SetMsgCap(c.MaxMessageLength)
+		srv.whisper.SetMsgCap(c.MaxMessageLength)
+	}
+	if c.HistorySize != prev.HistorySize {
+		srv.store.SetHistoryCap(c.HistorySize)
+	}
+	if !reflect.DeepEqual(c.RateLimits, prev.RateLimits) {
+		srv.svc.SetRateLimits(c.RateLimits)
+	}
+	if skipped := keepRestartSettings(&c, prev); len(skipped) > 0 {
+		log.Println("Settings take effect after restart:", strings.Join(skipped, ", "))
+	}
+	srv.config = c
+}
+
+// keepRestartSettings reverts settings of c which can't be changed
+// while server runs to their values in prev, so that they are reported
+// on every reload until restart. Names of changed settings are returned.
+func keepRestartSettings(c *Config, prev Config) []string {
+	var skipped []string
+	keepInt := func(name string, v *int, prev int) {
+		if *v != prev {
+			skipped = append(skipped, name)
+			*v = prev
+		}
+	}
+	keepInt("queueSize", &c.QueueSize, prev.QueueSize)
+	if c.Overflow != prev.Overflow {
+		skipped = append(skipped, "overflow")
+		c.Overflow = prev.Overflow
+	}
+	keepInt("historyRetention", &c.HistoryRetention, prev.HistoryRetention)
+	keepInt("maxFrameSize", &c.MaxFrameSize, prev.MaxFrameSize)
+	keepInt("readTimeout", &c.ReadTimeout, prev.ReadTimeout)
+	keepInt("writeTimeout", &c.WriteTimeout, prev.WriteTimeout)
+	keepInt("idleTimeout", &c.IdleTimeout, prev.IdleTimeout)
+	return skipped
+}
+
+func findRoom(rooms []RoomConfig, name string) (RoomConfig, bool) {
+	for _, room := range rooms {
+		if room.Name == name {
+			return room, true
+		}
+	}
+	return RoomConfig{}, false
+}
+
+// watchConfig signals when modification time of the specified
+// file changes.
+func watchConfig(path string, changes chan<- struct{}) {
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+	for range time.Tick(watchInterval) {
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = fi.ModTime()
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/mxmsk/hostel-chat/hostelsrv/chat"
+	"github.com/mxmsk/hostel-chat/hostelsrv/websocket"
+)
+
+// serveWeb starts serving chat over WebSocket at /chat and a tiny web UI
+// at /. Returned server is closed on shutdown.
+func serveWeb(port uint, origins []string, chatSvc *chat.Service, tlsConfig *tls.Config) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, webPage)
+	})
+	mux.HandleFunc("/chat", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r, origins)
+		if err != nil {
+			log.Println("WebSocket upgrade error:", err)
+			return
+		}
+		log.Println("New WebSocket connection", r.RemoteAddr)
+		chatSvc.HandleClient(conn)
+	})
+
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+	log.Println("Serving web clients on port", port)
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatalln("Can't serve web clients:", err)
+		}
+	}()
+	return srv
+}
+
+// serveAdmin starts serving server metrics, such as events dropped for
+// slow clients, at /debug/vars of localhost. Returned server is closed
+// on shutdown.
+func serveAdmin(port uint) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("localhost:%d", port),
+		Handler: mux,
+	}
+	log.Println("Serving metrics on localhost port", port)
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalln("Can't serve metrics:", err)
+		}
+	}()
+	return srv
+}
+
+const webPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>hostel-chat</title>
+<style>
+body { font-family: monospace; margin: 0; display: flex; flex-direction: column; height: 100vh; }
+#log { flex: 1; overflow-y: auto; padding: 8px; white-space: pre-wrap; }
+#log .error { color: #b00; }
+#log .notice, #log .presence, #log .topic, #log .kicked { color: #777; }
+form { display: flex; padding: 8px; gap: 8px; border-top: 1px solid #ccc; }
+#line { flex: 1; }
+</style>
+</head>
+<body>
+<form id="join">
+  <input id="subs" placeholder="room:nick|room2:nick" size="40">
+  <button>Join</button>
+</form>
+<div id="log"></div>
+<form id="send">
+  <input id="line" placeholder="message, or /room message" autocomplete="off">
+  <button>Send</button>
+</form>
+<script>
+(function() {
+  var log = document.getElementById("log");
+  var room = "";
+  var seq = 0;
+  var proto = location.protocol === "https:" ? "wss://" : "ws://";
+  var ws = new WebSocket(proto + location.host + "/chat");
+
+  function print(cls, text) {
+    var div = document.createElement("div");
+    div.className = cls;
+    div.textContent = text;
+    log.appendChild(div);
+    log.scrollTop = log.scrollHeight;
+  }
+  function request(cmd, args) {
+    ws.send(JSON.stringify({id: ++seq, cmd: cmd, args: args}));
+  }
+
+  ws.onopen = function() { ws.send("proto|json/1"); print("notice", "Connected."); };
+  ws.onclose = function() { print("error", "Disconnected."); };
+  ws.onmessage = function(e) {
+    var ev = JSON.parse(e.data);
+    switch (ev.type) {
+    case "message":
+    case "history":
+    case "result":
+      var at = ev.time ? "[" + new Date(ev.time).toLocaleTimeString() + "] " : "";
+      print(ev.type, at + ev.nick + "@" + ev.room + ": " + ev.text);
+      break;
+    case "private":
+      print(ev.type, ev.nick + " (private): " + ev.text);
+      break;
+    case "kicked":
+      print(ev.type, "You were kicked from " + ev.room + " by " + ev.nick + (ev.text ? ": " + ev.text : "."));
+      break;
+    case "topic":
+      print(ev.type, ev.nick ? "* " + ev.nick + " set topic of " + ev.room + ": " + ev.text
+        : "Topic of " + ev.room + ": " + (ev.text || "(none)"));
+      break;
+    case "ack":
+      break;
+    default:
+      print(ev.type, ev.text);
+    }
+  };
+
+  document.getElementById("join").onsubmit = function(e) {
+    e.preventDefault();
+    var subs = document.getElementById("subs").value.split("|");
+    request("subscribe", subs);
+    room = subs[subs.length - 1].split(":")[0];
+  };
+  document.getElementById("send").onsubmit = function(e) {
+    e.preventDefault();
+    var input = document.getElementById("line");
+    var line = input.value, target = room;
+    input.value = "";
+    if (!line) {
+      return;
+    }
+    var m = /^\/msg (\S+) (.+)$/.exec(line);
+    if (m) {
+      request("whisper", [m[1], m[2]]);
+      print("private", "me -> " + m[1] + ": " + m[2]);
+      return;
+    }
+    if (line[0] === "/" && line.indexOf(" ") > 0) {
+      target = line.substring(1, line.indexOf(" "));
+      line = line.substring(line.indexOf(" ") + 1);
+    }
+    request("publish", [target, line]);
+    print("message", "me@" + target + ": " + line);
+  };
+})();
+</script>
+</body>
+</html>
+`
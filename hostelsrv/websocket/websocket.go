@@ -0,0 +1,321 @@
+// Package websocket implements server side of WebSocket protocol (RFC 6455)
+// good enough to exchange text lines with browser chat clients.
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// MaxMessageSize limits size of a message which can be received from peer.
+const MaxMessageSize = 1 << 20
+
+// maxControlSize limits payload of control frames.
+const maxControlSize = 125
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+var (
+	// ErrMessageTooLarge is returned when peer sends message exceeding MaxMessageSize.
+	ErrMessageTooLarge = errors.New("websocket: message too large")
+	// ErrClosed is returned when writing to closed connection.
+	ErrClosed = errors.New("websocket: connection closed")
+	// ErrProtocol is returned when peer sends frame violating the protocol,
+	// e.g. unmasked one. Connection is closed with 1002 status then.
+	ErrProtocol = errors.New("websocket: protocol error")
+	// ErrInvalidUTF8 is returned when peer sends text message which is not
+	// valid UTF-8. Connection is closed with 1007 status then.
+	ErrInvalidUTF8 = errors.New("websocket: invalid UTF-8 in text message")
+)
+
+// Conn is server side of WebSocket connection. It's io.ReadWriteCloser,
+// where every received message is read as a line, i.e. followed by '\n',
+// and every written line is sent as a separate text message.
+type Conn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	pending []byte
+	wm      sync.Mutex
+	closed  bool
+}
+
+// Upgrade performs WebSocket handshake for the specified HTTP request.
+// If handshake fails, error response is written to w. Requests sent by
+// browsers from pages of other sites are rejected, unless their origin
+// is one of the specified ones, e.g. "https://chat.example.com".
+func Upgrade(w http.ResponseWriter, r *http.Request, origins []string) (*Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade expected", http.StatusBadRequest)
+		return nil, errors.New("websocket: not an upgrade request")
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	if !originAllowed(r, origins) {
+		http.Error(w, "Origin is not allowed", http.StatusForbidden)
+		return nil, errors.New("websocket: origin not allowed: " + r.Header.Get("Origin"))
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(w, "WebSocket key is missing", http.StatusBadRequest)
+		return nil, errors.New("websocket: key is missing")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket is not supported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response can't be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, br: brw.Reader}, nil
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+acceptGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// originAllowed tells whether request has no Origin, as sent by other
+// clients than browsers, comes from the same host or allowed origin.
+func originAllowed(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range origins {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func headerContains(h http.Header, name string, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Read reads received messages, each is terminated by '\n'.
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = append(msg, '\n')
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) readMessage() ([]byte, error) {
+	var msg []byte
+	var text bool
+	started := false
+	for {
+		fin, op, payload, err := c.readFrame()
+		// Continuation must follow the first frame of message,
+		// and new message can't start before the previous one ends.
+		if err == nil && op&0x8 == 0 && started != (op == opContinuation) {
+			err = ErrProtocol
+		}
+		if err == ErrProtocol {
+			c.writeFrame(opClose, []byte{0x03, 0xEA}) // 1002, protocol error
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.writeFrame(opClose, payload)
+			return nil, io.EOF
+		case opText:
+			text = true
+		}
+		started = true
+		if len(msg)+len(payload) > MaxMessageSize {
+			return nil, ErrMessageTooLarge
+		}
+		msg = append(msg, payload...)
+		if fin {
+			// Characters may be split between frames,
+			// so the whole message is checked.
+			if text && !utf8.Valid(msg) {
+				c.writeFrame(opClose, []byte{0x03, 0xEF}) // 1007, invalid payload
+				return nil, ErrInvalidUTF8
+			}
+			return msg, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	// Clients must mask frames, and control frames
+	// must be short and not fragmented. No extensions
+	// are negotiated, so reserved bits must be clear.
+	if !masked || head[0]&0x70 != 0 || !knownOpcode(op) ||
+		op&0x8 != 0 && (!fin || size > maxControlSize) {
+		err = ErrProtocol
+		return
+	}
+	if size > MaxMessageSize {
+		err = ErrMessageTooLarge
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+func knownOpcode(op byte) bool {
+	switch op {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+		return true
+	}
+	return false
+}
+
+// Write sends every line of p as a separate text message.
+func (c *Conn) Write(p []byte) (int, error) {
+	lines := bytes.Split(bytes.TrimSuffix(p, []byte("\n")), []byte("\n"))
+	for _, ln := range lines {
+		if err := c.writeFrame(opText, ln); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|op)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		frame = append(append(frame, 127), ext[:]...)
+	}
+	frame = append(frame, payload...)
+	_, err := c.conn.Write(frame)
+	if op == opClose {
+		c.closed = true
+	}
+	return err
+}
+
+// RemoteAddr returns address of peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline sets deadline for reading from underlying connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets deadline for writing to underlying connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// closeTimeout limits time Close waits for pending writes and
+// close message to be sent to peer which doesn't read.
+const closeTimeout = time.Second
+
+// Close sends close message to peer and closes underlying connection.
+func (c *Conn) Close() error {
+	c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.writeFrame(opClose, []byte{0x03, 0xE8}) // 1000, normal closure
+	return c.conn.Close()
+}
@@ -0,0 +1,264 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testPeer struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialTestServer(t *testing.T, srv *httptest.Server) *testPeer {
+	p, resp := dialTestServerFrom(t, srv, "")
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	return p
+}
+
+func dialTestServerFrom(t *testing.T, srv *httptest.Server, origin string) (*testPeer, *http.Response) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin != "" {
+		origin = "Origin: " + origin + "\r\n"
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		origin+
+		"Upgrade: websocket\r\n"+
+		"Connection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return &testPeer{conn: conn, br: br}, resp
+	}
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	return &testPeer{conn: conn, br: br}, resp
+}
+
+func (p *testPeer) send(fin bool, op byte, payload string) {
+	head := op
+	if fin {
+		head |= 0x80
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{head, 0x80 | byte(len(payload))}
+	if len(payload) >= 126 {
+		frame = append(frame[:1], 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	frame = append(frame, mask[:]...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	p.conn.Write(frame)
+}
+
+func (p *testPeer) receive() (byte, string) {
+	var head [2]byte
+	io.ReadFull(p.br, head[:])
+	size := int(head[1] & 0x7F)
+	if size == 126 {
+		var ext [2]byte
+		io.ReadFull(p.br, ext[:])
+		size = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, size)
+	io.ReadFull(p.br, payload)
+	return head[0] & 0x0F, string(payload)
+}
+
+func (p *testPeer) sendUnmasked(op byte, payload string) {
+	frame := append([]byte{0x80 | op, byte(len(payload))}, payload...)
+	p.conn.Write(frame)
+}
+
+func echoServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, []string{"https://chat.example.com"})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := bufio.NewScanner(conn)
+		for s.Scan() {
+			io.WriteString(conn, "echo: "+s.Text()+"\n")
+		}
+	}))
+}
+
+func TestUpgrade_TextMessages_ReadAsLines(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+	p := dialTestServer(t, srv)
+	defer p.conn.Close()
+
+	p.send(true, opText, "msg1")
+	p.send(false, opText, "ms")
+	p.send(true, opContinuation, "g2")
+
+	op, msg := p.receive()
+	assert.Equal(t, byte(opText), op)
+	assert.Equal(t, "echo: msg1", msg)
+	_, msg = p.receive()
+	assert.Equal(t, "echo: msg2", msg)
+}
+
+func TestUpgrade_LongMessage_ExtendedLengthWritten(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+	p := dialTestServer(t, srv)
+	defer p.conn.Close()
+
+	long := strings.Repeat("m", 120)
+	p.send(true, opText, long)
+
+	_, msg := p.receive()
+	assert.Equal(t, "echo: "+long, msg)
+}
+
+func TestUpgrade_Ping_PongReplied(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+	p := dialTestServer(t, srv)
+	defer p.conn.Close()
+
+	p.send(true, opPing, "hey")
+
+	op, msg := p.receive()
+	assert.Equal(t, byte(opPong), op)
+	assert.Equal(t, "hey", msg)
+}
+
+func TestUpgrade_CloseReceived_CloseReplied(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+	p := dialTestServer(t, srv)
+	defer p.conn.Close()
+
+	p.send(true, opClose, "\x03\xe8")
+
+	op, _ := p.receive()
+	assert.Equal(t, byte(opClose), op)
+	_, err := p.br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestUpgrade_NotUpgradeRequest_BadRequest(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestUpgrade_ProtocolViolated_ClosedWithProtocolError(t *testing.T) {
+	testCases := []struct {
+		name string
+		send func(p *testPeer)
+	}{
+		{name: "unmasked", send: func(p *testPeer) { p.sendUnmasked(opText, "msg1") }},
+		{name: "fragmented ping", send: func(p *testPeer) { p.send(false, opPing, "hey") }},
+		{name: "long ping", send: func(p *testPeer) { p.send(true, opPing, strings.Repeat("h", 126)) }},
+		{name: "continuation first", send: func(p *testPeer) { p.send(true, opContinuation, "msg1") }},
+		{name: "unfinished message", send: func(p *testPeer) {
+			p.send(false, opText, "ms")
+			p.send(true, opText, "g1")
+		}},
+		{name: "reserved bit", send: func(p *testPeer) { p.send(true, 0x40|opText, "msg1") }},
+		{name: "unknown opcode", send: func(p *testPeer) { p.send(true, 0x3, "msg1") }},
+	}
+
+	for _, testCase := range testCases {
+		srv := echoServer(t)
+		p := dialTestServer(t, srv)
+
+		testCase.send(p)
+
+		op, msg := p.receive()
+		assert.Equal(t, byte(opClose), op, testCase.name)
+		assert.Equal(t, "\x03\xea", msg, testCase.name)
+		p.conn.Close()
+		srv.Close()
+	}
+}
+
+func TestUpgrade_InvalidUTF8_ClosedWithInvalidPayload(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+	p := dialTestServer(t, srv)
+	defer p.conn.Close()
+
+	p.send(true, opText, "msg\xff")
+
+	op, msg := p.receive()
+	assert.Equal(t, byte(opClose), op)
+	assert.Equal(t, "\x03\xef", msg)
+}
+
+func TestUpgrade_CharacterSplitBetweenFragments_MessageRead(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+	p := dialTestServer(t, srv)
+	defer p.conn.Close()
+
+	p.send(false, opText, "msg\xd0")
+	p.send(true, opContinuation, "\xb9")
+
+	_, msg := p.receive()
+	assert.Equal(t, "echo: msgй", msg)
+}
+
+func TestUpgrade_PingBetweenFragments_MessageRead(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+	p := dialTestServer(t, srv)
+	defer p.conn.Close()
+
+	p.send(false, opText, "ms")
+	p.send(true, opPing, "hey")
+	p.send(true, opContinuation, "g1")
+
+	op, _ := p.receive()
+	assert.Equal(t, byte(opPong), op)
+	_, msg := p.receive()
+	assert.Equal(t, "echo: msg1", msg)
+}
+
+func TestUpgrade_Origin_AllowedWhenSameOrConfigured(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+
+	testCases := []struct {
+		origin string
+		status int
+	}{
+		{origin: "", status: http.StatusSwitchingProtocols},
+		{origin: "http://localhost", status: http.StatusSwitchingProtocols},
+		{origin: "https://chat.example.com", status: http.StatusSwitchingProtocols},
+		{origin: "https://evil.example.com", status: http.StatusForbidden},
+		{origin: "null", status: http.StatusForbidden},
+	}
+
+	for _, testCase := range testCases {
+		p, resp := dialTestServerFrom(t, srv, testCase.origin)
+		assert.Equal(t, testCase.status, resp.StatusCode, testCase.origin)
+		p.conn.Close()
+	}
+}